@@ -1,6 +1,8 @@
 package main
 
 import . "file-structures/block/byteslice"
+import buf "file-structures/block/buffers"
+import file "file-structures/block/file2"
 import "file-structures/bptree"
 import "os"
 import "bufio"
@@ -27,6 +29,8 @@ type Command struct {
 }
 */
 
+const BUFFERSIZE = 536870912 // 512 megabytes of cached blocks
+
 const (
 	insert = iota
 	find
@@ -69,12 +73,20 @@ func main() {
 		json.Unmarshal(infoJson, &info)
 	}
 
-	bpt, bperr := bptree.NewBpTree(info.Path, info.Keysize, info.Fieldsizes)
-	if !bperr {
-		panic("Failed B+ tree creation")
+	bpt, cache, err := open(info)
+	if err != nil {
+		panic(err)
 	} else {
 		fmt.Println("ok")
 	}
+	defer func() {
+		if err := cache.Persist(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if err := bpt.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
 
 	to_byte_slice := func(bytes []byte) []ByteSlice {
 		B := make([]ByteSlice, 0, len(info.Fieldsizes))
@@ -121,8 +133,11 @@ serveloop:
 			       fmt.Fprintf(os.Stderr, "bytesliced field (%v) = '%v'\n", i, bfields[i])
 			   }
 			*/
-			result := bpt.Insert(key[:], to_byte_slice(fields))
-			fmt.Println(result)
+			err := bpt.Insert(key[:], to_byte_slice(fields))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			fmt.Println(err == nil)
 		} else if cmd_type == size {
 			size := ByteSlice64(bpt.Size())
 			output.Write(size)
@@ -131,7 +146,10 @@ serveloop:
 			if err := binary.Read(input, binary.LittleEndian, &key); err != nil {
 				break
 			}
-			if bpt.Contains(key) {
+			if has, err := bpt.Contains(key); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				break serveloop
+			} else if has {
 				output.Write(ByteSlice8(1))
 			} else {
 				output.Write(ByteSlice8(0))
@@ -145,7 +163,11 @@ serveloop:
 			if err := binary.Read(input, binary.LittleEndian, &rightkey); err != nil {
 				break
 			}
-			records := bpt.Find(leftkey, rightkey)
+			records, err := bpt.Find(leftkey, rightkey)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				break serveloop
+			}
 			for record := range records {
 				if err := binary.Write(output, binary.LittleEndian, byte(cont)); err != nil {
 					fmt.Fprintln(os.Stderr, err)
@@ -167,6 +189,36 @@ serveloop:
 	fmt.Println("exited")
 }
 
+// opens the tree in the file at info.Path behind a cache, making it if the file
+// is new
+func open(info Metadata) (*bptree.BpTree, *file.LRUCacheFile, error) {
+	bf := file.NewBlockFile(info.Path, &buf.NoBuffer{})
+	if err := bf.Open(); err != nil {
+		return nil, nil, err
+	}
+	cache, err := file.OpenLRUCacheFile(bf, BUFFERSIZE)
+	if err != nil {
+		bf.Close()
+		return nil, nil, err
+	}
+	stype, err := cache.StructureType()
+	if err != nil {
+		cache.Close()
+		return nil, nil, err
+	}
+	var bpt *bptree.BpTree
+	if stype == 0 {
+		bpt, err = bptree.NewBpTree(cache, info.Keysize, info.Fieldsizes)
+	} else {
+		bpt, err = bptree.OpenBpTree(cache, info.Keysize, info.Fieldsizes)
+	}
+	if err != nil {
+		cache.Close()
+		return nil, nil, err
+	}
+	return bpt, cache, nil
+}
+
 // Determine which file and schema is being opened
 //  (filename string, keysize uint32, fields []uint32)
 
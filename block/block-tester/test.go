@@ -1,7 +1,7 @@
 package main
 
 import "fmt"
-import . "file-structures/block/file"
+import . "file-structures/block/file2"
 import . "file-structures/block/keyblock"
 import . "file-structures/block/buffers"
 import . "file-structures/block/byteslice"
@@ -10,11 +10,11 @@ func main() {
 	fmt.Println("hi")
 	positions := make([][]byte, 4)
 	dim, _ := NewBlockDimensions(RECORDS|POINTERS, 4096, 8, 8, ([]uint32{1, 1, 2}))
-	t, _ := NewBlockFile("hello.btree", NewLFU(3))
+	t := NewBlockFile("hello.btree", NewLFU(3))
 	fmt.Println(t)
 	fmt.Println(t.Open())
 
-	if b, ok := NewKeyBlock(t, dim); ok {
+	if b, err := NewKeyBlock(t, dim); err == nil {
 		positions[0] = b.Position()
 
 		r := b.NewRecord(ByteSlice64(2))
@@ -64,7 +64,7 @@ func main() {
 		fmt.Println(b)
 	}
 
-	if b, ok := NewKeyBlock(t, dim); ok {
+	if b, err := NewKeyBlock(t, dim); err == nil {
 		positions[1] = b.Position()
 		r := b.NewRecord(ByteSlice64(3))
 		r.Set(2, []byte{3, 4})
@@ -76,7 +76,7 @@ func main() {
 		//         fmt.Println(b)
 	}
 
-	if b, ok := NewKeyBlock(t, dim); ok {
+	if b, err := NewKeyBlock(t, dim); err == nil {
 		positions[2] = b.Position()
 		r := b.NewRecord(ByteSlice64(0x0900000000000000))
 		r.Set(2, []byte{6, 12})
@@ -88,7 +88,7 @@ func main() {
 		//         fmt.Println(b)
 	}
 
-	if b, ok := NewKeyBlock(t, dim); ok {
+	if b, err := NewKeyBlock(t, dim); err == nil {
 		positions[3] = b.Position()
 		r := b.NewRecord(ByteSlice64(0x1001001001001001))
 		r.Set(2, []byte{6, 12})
@@ -112,8 +112,8 @@ func main() {
 	DeserializeFromFile(t, dim, positions[1])
 	DeserializeFromFile(t, dim, positions[2])
 	DeserializeFromFile(t, dim, positions[3])
-	rb, ok := DeserializeFromFile(t, dim, positions[0])
-	fmt.Println(ok)
+	rb, err := DeserializeFromFile(t, dim, positions[0])
+	fmt.Println(err)
 	fmt.Println(rb)
 	{
 		i, _, _, _, _ := rb.Find(ByteSlice64(6))
@@ -0,0 +1,507 @@
+package compressed
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+	"file-structures/varchar"
+)
+
+/*
+CompressedFile is a BlockDevice which deflates every block before it reaches
+the device underneath. The compressed images are stored as varchars, so a block
+only takes up as many bytes as it compresses to. Callers still see fixed size
+blocks with the same keys a BlockFile would hand out.
+
+A logical key is mapped to the varchar holding its image through a table kept
+in a chain of blocks. Each table block is a pointer to the next one followed by
+one entry per logical block:
+
+	0            the block has been allocated but never written, it reads as
+	             zeros. A block written as all zeros goes back to this state.
+	FREE | next  the block is on the free list, next is the index + 1 of the
+	             next free block or 0.
+	otherwise    the key of the varchar holding the image.
+
+The images start with a byte saying whether they are deflated or stored raw,
+blocks which do not shrink are stored raw.
+
+The control data of the device underneath holds the varchar's control data
+followed by the control block below. The control data callers see is kept in
+a block of its own.
+*/
+type CompressedFile struct {
+	file    file.RemovableBlockDevice
+	store   *varchar.Varchar
+	ctrl    ctrlblk
+	pages   []int64
+	dead    file.DeadList
+	blksize int64
+}
+
+type ctrlblk struct {
+	userdata  int64
+	table     int64
+	next      int64
+	free_head int64
+	free_len  uint32
+}
+
+const CONTROLSIZE = 36
+
+const FREE = uint64(1) << 63
+
+const (
+	RAW = iota
+	DEFLATED
+)
+
+func (self *ctrlblk) Bytes() []byte {
+	bytes := make([]byte, CONTROLSIZE)
+	copy(bytes[0:8], bs.ByteSlice64(uint64(self.userdata)))
+	copy(bytes[8:16], bs.ByteSlice64(uint64(self.table)))
+	copy(bytes[16:24], bs.ByteSlice64(uint64(self.next)))
+	copy(bytes[24:32], bs.ByteSlice64(uint64(self.free_head)))
+	copy(bytes[32:36], bs.ByteSlice32(self.free_len))
+	return bytes
+}
+
+func load_ctrlblk(bytes bs.ByteSlice) (cb *ctrlblk, err error) {
+	if len(bytes) < CONTROLSIZE {
+		return nil, fmt.Errorf("len(bytes) < %d", CONTROLSIZE)
+	}
+	cb = &ctrlblk{
+		userdata:  int64(bytes[0:8].Int64()),
+		table:     int64(bytes[8:16].Int64()),
+		next:      int64(bytes[16:24].Int64()),
+		free_head: int64(bytes[24:32].Int64()),
+		free_len:  bytes[32:36].Int32(),
+	}
+	return cb, nil
+}
+
+// varchar_device hands the varchar the front of the control data, the rest
+// belongs to the CompressedFile.
+type varchar_device struct {
+	file.BlockDevice
+}
+
+func (self *varchar_device) ControlData() (data bs.ByteSlice, err error) {
+	data, err = self.BlockDevice.ControlData()
+	if err != nil {
+		return nil, err
+	}
+	return data[:varchar.CONTROLSIZE], nil
+}
+
+func (self *varchar_device) SetControlData(data bs.ByteSlice) (err error) {
+	if len(data) > varchar.CONTROLSIZE {
+		return fmt.Errorf("control data was too large")
+	}
+	all, err := self.BlockDevice.ControlData()
+	if err != nil {
+		return err
+	}
+	copy(all[:varchar.CONTROLSIZE], data)
+	return self.BlockDevice.SetControlData(all)
+}
+
+// the varchar is part of the CompressedFile, the structure type belongs to
+// whatever is kept in the CompressedFile
+func (self *varchar_device) StructureType() (stype uint32, err error) { return 0, nil }
+
+func (self *varchar_device) SetStructureType(stype uint32) error { return nil }
+
+func NewCompressedFile(f file.RemovableBlockDevice) (self *CompressedFile, err error) {
+	self = &CompressedFile{
+		file:    f,
+		blksize: int64(f.BlockSize()),
+	}
+	if self.store, err = varchar.NewVarchar(&varchar_device{f}); err != nil {
+		return nil, err
+	}
+	if self.ctrl.userdata, err = f.Allocate(); err != nil {
+		return nil, err
+	}
+	if err := f.WriteBlock(self.ctrl.userdata, make(bs.ByteSlice, self.blksize)); err != nil {
+		return nil, err
+	}
+	return self, self.write_ctrlblk()
+}
+
+func OpenCompressedFile(f file.RemovableBlockDevice) (self *CompressedFile, err error) {
+	self = &CompressedFile{
+		file:    f,
+		blksize: int64(f.BlockSize()),
+	}
+	if self.store, err = varchar.OpenVarchar(&varchar_device{f}); err != nil {
+		return nil, err
+	}
+	if err := self.read_ctrlblk(); err != nil {
+		return nil, err
+	}
+	for page := self.ctrl.table; page != 0; {
+		self.pages = append(self.pages, page)
+		blk, err := f.ReadBlock(page)
+		if err != nil {
+			return nil, err
+		}
+		page = int64(blk[0:8].Int64())
+	}
+	return self, nil
+}
+
+func (self *CompressedFile) write_ctrlblk() error {
+	data, err := self.file.ControlData()
+	if err != nil {
+		return err
+	}
+	copy(data[varchar.CONTROLSIZE:], self.ctrl.Bytes())
+	return self.file.SetControlData(data)
+}
+
+func (self *CompressedFile) read_ctrlblk() error {
+	data, err := self.file.ControlData()
+	if err != nil {
+		return err
+	}
+	cb, err := load_ctrlblk(data[varchar.CONTROLSIZE:])
+	if err != nil {
+		return err
+	}
+	self.ctrl = *cb
+	return nil
+}
+
+func (self *CompressedFile) Close() error {
+	if err := self.dead.ReleaseAll(self.free); err != nil {
+		return err
+	}
+	return self.file.Close()
+}
+
+func (self *CompressedFile) Remove() error {
+	return self.file.Remove()
+}
+
+func (self *CompressedFile) Sync() error {
+	if syncer, ok := self.file.(file.Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (self *CompressedFile) BlockSize() uint32 { return uint32(self.blksize) }
+
+func (self *CompressedFile) ControlData() (data bs.ByteSlice, err error) {
+	blk, err := self.file.ReadBlock(self.ctrl.userdata)
+	if err != nil {
+		return nil, err
+	}
+	data = make(bs.ByteSlice, self.blksize-file.CONTROLSIZE)
+	copy(data, blk)
+	return data, nil
+}
+
+func (self *CompressedFile) SetControlData(data bs.ByteSlice) (err error) {
+	if len(data) > int(self.blksize-file.CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	blk := make(bs.ByteSlice, self.blksize)
+	copy(blk, data)
+	return self.file.WriteBlock(self.ctrl.userdata, blk)
+}
+
+func (self *CompressedFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+func (self *CompressedFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
+// ----------------------------------------------------------------------------
+// the indirection table
+
+func (self *CompressedFile) per_page() int64 {
+	return (self.blksize - 8) / 8
+}
+
+func (self *CompressedFile) index(key int64) (int64, error) {
+	if key < self.blksize || key%self.blksize != 0 {
+		return 0, fmt.Errorf("Bad block key %d", key)
+	}
+	idx := key/self.blksize - 1
+	if idx >= self.ctrl.next {
+		return 0, fmt.Errorf("Block %d has not been allocated", key)
+	}
+	return idx, nil
+}
+
+func (self *CompressedFile) key(idx int64) int64 {
+	return (idx + 1) * self.blksize
+}
+
+// grow adds table blocks until the table has an entry for every index below n.
+func (self *CompressedFile) grow(n int64) error {
+	for int64(len(self.pages))*self.per_page() < n {
+		page, err := self.file.Allocate()
+		if err != nil {
+			return err
+		}
+		if err := self.file.WriteBlock(page, make(bs.ByteSlice, self.blksize)); err != nil {
+			return err
+		}
+		if len(self.pages) == 0 {
+			self.ctrl.table = page
+		} else {
+			last := self.pages[len(self.pages)-1]
+			blk, err := self.file.ReadBlock(last)
+			if err != nil {
+				return err
+			}
+			copy(blk[0:8], bs.ByteSlice64(uint64(page)))
+			if err := self.file.WriteBlock(last, blk); err != nil {
+				return err
+			}
+		}
+		self.pages = append(self.pages, page)
+	}
+	return nil
+}
+
+func (self *CompressedFile) location(idx int64) (page int64, offset int64) {
+	return self.pages[idx/self.per_page()], 8 + (idx%self.per_page())*8
+}
+
+func (self *CompressedFile) entry(idx int64) (uint64, error) {
+	page, offset := self.location(idx)
+	blk, err := self.file.ReadBlock(page)
+	if err != nil {
+		return 0, err
+	}
+	return blk[offset : offset+8].Int64(), nil
+}
+
+func (self *CompressedFile) set_entry(idx int64, entry uint64) error {
+	page, offset := self.location(idx)
+	blk, err := self.file.ReadBlock(page)
+	if err != nil {
+		return err
+	}
+	copy(blk[offset:offset+8], bs.ByteSlice64(entry))
+	return self.file.WriteBlock(page, blk)
+}
+
+// ----------------------------------------------------------------------------
+// allocation
+
+func (self *CompressedFile) Allocate() (key int64, err error) {
+	if self.ctrl.free_head == 0 {
+		return self.AllocateBlocks(1)
+	}
+	idx := self.ctrl.free_head - 1
+	entry, err := self.entry(idx)
+	if err != nil {
+		return 0, err
+	}
+	if entry&FREE == 0 {
+		return 0, fmt.Errorf("Block %d is on the free list but is not free", self.key(idx))
+	}
+	if err := self.set_entry(idx, 0); err != nil {
+		return 0, err
+	}
+	self.ctrl.free_head = int64(entry &^ FREE)
+	self.ctrl.free_len -= 1
+	return self.key(idx), self.write_ctrlblk()
+}
+
+func (self *CompressedFile) AllocateBlocks(n int) (key int64, err error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("Cannot allocate %d blocks", n)
+	}
+	idx := self.ctrl.next
+	if err := self.grow(idx + int64(n)); err != nil {
+		return 0, err
+	}
+	self.ctrl.next += int64(n)
+	return self.key(idx), self.write_ctrlblk()
+}
+
+func (self *CompressedFile) Free(key int64) error {
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	return self.free(key)
+}
+
+func (self *CompressedFile) free(key int64) error {
+	idx, err := self.index(key)
+	if err != nil {
+		return err
+	}
+	entry, err := self.entry(idx)
+	if err != nil {
+		return err
+	}
+	if entry&FREE != 0 {
+		return fmt.Errorf("Block %d is already free", key)
+	} else if entry != 0 {
+		if err := self.store.Remove(int64(entry)); err != nil {
+			return err
+		}
+	}
+	if err := self.set_entry(idx, FREE|uint64(self.ctrl.free_head)); err != nil {
+		return err
+	}
+	self.ctrl.free_head = idx + 1
+	self.ctrl.free_len += 1
+	return self.write_ctrlblk()
+}
+
+func (self *CompressedFile) MarkDead(key int64) error {
+	if _, err := self.index(key); err != nil {
+		return err
+	}
+	return self.dead.Mark(key)
+}
+
+func (self *CompressedFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *CompressedFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *CompressedFile) Reclaim() error {
+	return self.dead.Reclaim(self.free)
+}
+
+// ----------------------------------------------------------------------------
+// reading and writing
+
+func compress(block bs.ByteSlice) (image bs.ByteSlice, err error) {
+	var buf bytes.Buffer
+	buf.WriteByte(DEFLATED)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(block); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= len(block)+1 {
+		image = make(bs.ByteSlice, len(block)+1)
+		image[0] = RAW
+		copy(image[1:], block)
+		return image, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(image bs.ByteSlice, blksize int64) (block bs.ByteSlice, err error) {
+	if len(image) == 0 {
+		return nil, fmt.Errorf("Empty block image")
+	}
+	block = make(bs.ByteSlice, blksize)
+	switch image[0] {
+	case RAW:
+		if int64(len(image)-1) != blksize {
+			return nil, fmt.Errorf("Raw block image is %d bytes expected %d", len(image)-1, blksize)
+		}
+		copy(block, image[1:])
+	case DEFLATED:
+		r := flate.NewReader(bytes.NewReader(image[1:]))
+		defer r.Close()
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Unknown block image kind %d", image[0])
+	}
+	return block, nil
+}
+
+func (self *CompressedFile) WriteBlock(key int64, block bs.ByteSlice) error {
+	if int64(len(block)) != self.blksize {
+		return fmt.Errorf("Expected a block of %d bytes got %d", self.blksize, len(block))
+	}
+	idx, err := self.index(key)
+	if err != nil {
+		return err
+	}
+	entry, err := self.entry(idx)
+	if err != nil {
+		return err
+	}
+	if entry&FREE != 0 {
+		return fmt.Errorf("Block %d is free", key)
+	}
+	if block.Zero() {
+		if entry == 0 {
+			return nil
+		}
+		if err := self.store.Remove(int64(entry)); err != nil {
+			return err
+		}
+		return self.set_entry(idx, 0)
+	}
+	image, err := compress(block)
+	if err != nil {
+		return err
+	}
+	if entry != 0 {
+		if old, err := self.store.Read(int64(entry)); err != nil {
+			return err
+		} else if len(old) == len(image) {
+			return self.store.Update(int64(entry), image)
+		}
+		if err := self.store.Remove(int64(entry)); err != nil {
+			return err
+		}
+	}
+	vkey, err := self.store.Write(image)
+	if err != nil {
+		return err
+	}
+	return self.set_entry(idx, uint64(vkey))
+}
+
+func (self *CompressedFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	idx, err := self.index(key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := self.entry(idx)
+	if err != nil {
+		return nil, err
+	}
+	if entry&FREE != 0 {
+		return nil, fmt.Errorf("Block %d is free", key)
+	} else if entry == 0 {
+		return make(bs.ByteSlice, self.blksize), nil
+	}
+	image, err := self.store.Read(int64(entry))
+	if err != nil {
+		return nil, err
+	}
+	return decompress(image, self.blksize)
+}
+
+func (self *CompressedFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	blocks = make(bs.ByteSlice, int64(n)*self.blksize)
+	for i := int64(0); i < int64(n); i++ {
+		block, err := self.ReadBlock(key + i*self.blksize)
+		if err != nil {
+			return nil, err
+		}
+		copy(blocks[i*self.blksize:(i+1)*self.blksize], block)
+	}
+	return blocks, nil
+}
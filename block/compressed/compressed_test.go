@@ -0,0 +1,219 @@
+package compressed
+
+import "testing"
+
+import (
+	"math/rand"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+	"file-structures/varchar"
+)
+
+func testfile(t *testing.T) (*CompressedFile, *file.MemBlockFile) {
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewCompressedFile(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cf, mf
+}
+
+func reopen(t *testing.T, cf *CompressedFile, mf *file.MemBlockFile) (*CompressedFile, *file.MemBlockFile) {
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mf, err := file.LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if cf, err = OpenCompressedFile(mf); err != nil {
+		t.Fatal(err)
+	}
+	return cf, mf
+}
+
+// text makes a compressible block, the same few words over and over
+func text(blksize uint32, seed int64) bs.ByteSlice {
+	words := []string{"linear ", "hash ", "bucket ", "varchar ", "block "}
+	r := rand.New(rand.NewSource(seed))
+	block := make(bs.ByteSlice, 0, blksize)
+	for len(block) < int(blksize) {
+		block = append(block, words[r.Intn(len(words))]...)
+	}
+	return block[:blksize]
+}
+
+func random(blksize uint32, seed int64) bs.ByteSlice {
+	r := rand.New(rand.NewSource(seed))
+	block := make(bs.ByteSlice, blksize)
+	for i := range block {
+		block[i] = byte(r.Intn(256))
+	}
+	return block
+}
+
+func expect(t *testing.T, f file.BlockDevice, key int64, block bs.ByteSlice) {
+	if got, err := f.ReadBlock(key); err != nil {
+		t.Fatal(err)
+	} else if !got.Eq(block) {
+		t.Fatalf("Block %d was not as written got %v", key, got[:8])
+	}
+}
+
+func TestCompressedWriteRead(t *testing.T) {
+	const BLOCKS = 200
+	cf, mf := testfile(t)
+	blocks := make(map[int64]bs.ByteSlice)
+	for i := 0; i < BLOCKS; i++ {
+		key, err := cf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != int64(i+1)*int64(cf.BlockSize()) {
+			t.Fatalf("Expected keys to be handed out like a BlockFile got %d", key)
+		}
+		expect(t, cf, key, make(bs.ByteSlice, cf.BlockSize()))
+		if i%10 == 0 {
+			blocks[key] = random(cf.BlockSize(), int64(i))
+		} else {
+			blocks[key] = text(cf.BlockSize(), int64(i))
+		}
+		if err := cf.WriteBlock(key, blocks[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, block := range blocks {
+		expect(t, cf, key, block)
+	}
+	if size, err := mf.Size(); err != nil {
+		t.Fatal(err)
+	} else if size > BLOCKS*uint64(cf.BlockSize())/2 {
+		t.Fatalf("Expected the blocks to take less than half the space got %d bytes", size)
+	}
+
+	// rewrite every block so images change size and move
+	for key := range blocks {
+		blocks[key] = text(cf.BlockSize(), key+1)
+		if err := cf.WriteBlock(key, blocks[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cf.SetControlData([]byte("control")); err != nil {
+		t.Fatal(err)
+	}
+
+	cf, mf = reopen(t, cf, mf)
+	for key, block := range blocks {
+		expect(t, cf, key, block)
+	}
+	if data, err := cf.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if string(data[:7]) != "control" {
+		t.Fatalf("Expected the control data to survive got %v", data[:7])
+	}
+}
+
+func TestCompressedFree(t *testing.T) {
+	cf, mf := testfile(t)
+	A, err := cf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := cf.AllocateBlocks(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if B != A+int64(cf.BlockSize()) {
+		t.Fatalf("Expected the run to follow A got %d", B)
+	}
+	if err := cf.WriteBlock(A, text(cf.BlockSize(), 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Free(A); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.ReadBlock(A); err == nil {
+		t.Fatal("Expected reading a free block to fail")
+	}
+	if err := cf.Free(A); err == nil {
+		t.Fatal("Expected freeing a free block to fail")
+	}
+	cf, mf = reopen(t, cf, mf)
+	if C, err := cf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if C != A {
+		t.Fatalf("Expected the freed block to be reused %d != %d", A, C)
+	}
+	expect(t, cf, A, make(bs.ByteSlice, cf.BlockSize()))
+}
+
+func TestCompressedVarchar(t *testing.T) {
+	cf, _ := testfile(t)
+	v, err := varchar.NewVarchar(cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(map[int64]bs.ByteSlice)
+	for i := 0; i < 100; i++ {
+		record := text(uint32(rand.Intn(5000)+10), int64(i))
+		key, err := v.Write(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[key] = record
+	}
+	for key, record := range records {
+		if got, err := v.Read(key); err != nil {
+			t.Fatal(err)
+		} else if !got.Eq(record) {
+			t.Fatal("varchar record was not as written")
+		}
+	}
+}
+
+// Rewriting a block frees its varchar and writes a new one, once the free list
+// covers the churn the file has to level off. Fragmentation may still cost it a
+// block.
+func TestCompressedChurn(t *testing.T) {
+	cf, mf := testfile(t)
+	keys := make([]int64, 16)
+	for i := range keys {
+		key, err := cf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	var settled uint64
+	for round := 0; round < 600; round++ {
+		for i, key := range keys {
+			if err := cf.WriteBlock(key, text(cf.BlockSize(), int64(round*len(keys)+i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round == 200 {
+			size, err := mf.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			settled = size
+		}
+	}
+	if size, err := mf.Size(); err != nil {
+		t.Fatal(err)
+	} else if size > settled+uint64(cf.BlockSize()) {
+		t.Fatalf("Expected the file to stay near %d bytes it grew to %d", settled, size)
+	}
+	for i, key := range keys {
+		expect(t, cf, key, text(cf.BlockSize(), int64(599*len(keys)+i)))
+	}
+}
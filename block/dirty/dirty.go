@@ -12,11 +12,15 @@ func New(size int) *DirtyBlocks {
 	return self
 }
 func (self *DirtyBlocks) Insert(b *keyblock.KeyBlock) {
-	self.slice = self.slice[0 : len(self.slice)+1]
-	self.slice[len(self.slice)-1] = b
+	self.slice = append(self.slice, b)
 }
-func (self *DirtyBlocks) Sync() {
+
+// Sync writes the blocks back, stopping at the first which fails.
+func (self *DirtyBlocks) Sync() error {
 	for _, b := range self.slice {
-		b.SerializeToFile()
+		if err := b.SerializeToFile(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
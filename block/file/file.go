@@ -2,15 +2,18 @@ package file
 
 import "os"
 import "fmt"
+import "io"
+import "syscall"
 import . "file-structures/block/buffers"
 import . "file-structures/block/byteslice"
 
 type BlockFile struct {
 	path string
 	//     dim      *blockDimensions
-	opened bool
-	buf    Buffer
-	file   *os.File
+	opened   bool
+	readonly bool
+	buf      Buffer
+	file     *os.File
 }
 
 func NewBlockFile(path string, buf Buffer) (*BlockFile, bool) {
@@ -22,6 +25,47 @@ func NewBlockFile(path string, buf Buffer) (*BlockFile, bool) {
 	return self, true
 }
 
+// Open opens the file read write, creating it if needed. It fails if another
+// process has the file open.
+func (self *BlockFile) Open() bool {
+	return self.open(false)
+}
+
+// OpenReadOnly opens an existing file for reading only, WriteBlock and
+// Allocate fail. Any number of processes can have a file open read only as
+// long as none has it open read write.
+func (self *BlockFile) OpenReadOnly() bool {
+	return self.open(true)
+}
+
+func (self *BlockFile) open(readonly bool) bool {
+	flag := OPENFLAG
+	if readonly {
+		flag = READONLYFLAG
+	}
+	f, err := open_file(self.path, flag)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	// an advisory lock, exclusive for writers and shared by readers
+	how := syscall.LOCK_EX
+	if readonly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		fmt.Printf("%s is locked by another process: %v\n", self.path, err)
+		f.Close()
+		return false
+	}
+	self.file = f
+	self.opened = true
+	self.readonly = readonly
+	return true
+}
+
+func (self *BlockFile) ReadOnly() bool { return self.readonly }
+
 func (self *BlockFile) Close() bool {
 	if err := self.file.Close(); err != nil {
 		fmt.Println(err)
@@ -55,6 +99,9 @@ func (self *BlockFile) resize(size int64) bool {
 }
 
 func (self *BlockFile) Allocate(amt uint32) (uint64, bool) {
+	if self.readonly {
+		return 0, false
+	}
 	size, ok := self.Size()
 	if ok {
 		if self.resize(int64(size + uint64(amt))) {
@@ -65,7 +112,7 @@ func (self *BlockFile) Allocate(amt uint32) (uint64, bool) {
 }
 
 func (self *BlockFile) WriteBlock(p int64, block []byte) bool {
-	if !self.opened {
+	if !self.opened || self.readonly {
 		return false
 	}
 	if b, ok := self.buf.Read(p, uint32(len(block))); ok {
@@ -74,13 +121,7 @@ func (self *BlockFile) WriteBlock(p int64, block []byte) bool {
 			return true
 		}
 	}
-	for pos, err := self.file.Seek(p, 0); pos != p; pos, err = self.file.Seek(p, 0) {
-		if err != nil {
-			fmt.Println(err)
-			return false
-		}
-	}
-	if n, err := self.file.Write(block); err != nil {
+	if n, err := self.file.WriteAt(block, p); err != nil {
 		fmt.Print("WriteBlock line 88: ")
 		fmt.Printf("%v ", n)
 		fmt.Println(err)
@@ -99,13 +140,9 @@ func (self *BlockFile) ReadBlock(p int64, length uint32) ([]byte, bool) {
 		return b, ok
 	}
 	block := make([]byte, length)
-	for pos, err := self.file.Seek(p, 0); pos != p; pos, err = self.file.Seek(p, 0) {
-		if err != nil {
-			fmt.Println(err)
-			return nil, false
-		}
-	}
-	if n, err := self.file.Read(block); err != nil {
+	// a short read at the end of the file is not an error, the rest of the
+	// block is zero
+	if n, err := self.file.ReadAt(block, p); err != nil && (err != io.EOF || n == 0) {
 		fmt.Print("ReadBlock line 105: ")
 		fmt.Printf("%v ", n)
 		fmt.Println(err)
@@ -0,0 +1,297 @@
+package file2
+
+import (
+	"fmt"
+	"sort"
+)
+
+import . "file-structures/block/byteslice"
+
+/*
+When BITMAP is set free blocks are tracked in a bitmap instead of the free
+list. The file is split into groups of BlockSize()*8 blocks, the first block of
+a group not taken by a checksum block holds one bit per block of the group. A
+set bit is a block in use, reserved blocks are always set. The bits of blocks
+past the end of the file are clear.
+
+Allocation takes the first run of n clear bits and only grows the file when
+there is none, so blocks freed next to each other are reused for multi block
+allocations. Freeing a block which is already free is an error. The bitmap
+blocks are not covered by checksums.
+
+hint is the lowest block which may be free, every block below it is in use.
+*/
+
+// FreeSpace describes the free blocks of a BlockFile.
+type FreeSpace struct {
+	Blocks  int64 // blocks in the file including the control and reserved blocks
+	Free    int64 // blocks which may be allocated without growing the file
+	Largest int64 // the longest run of contiguous free blocks
+}
+
+func (self *BlockFile) Bitmap() bool { return self.ctrl.flags&BITMAP != 0 }
+
+func (self *BlockFile) bits_per_block() int64 {
+	return int64(self.ctrl.blksize) * 8
+}
+
+// bitmap_offset is the position of the bitmap block in its group, it comes
+// after the checksum block when there is one.
+func (self *BlockFile) bitmap_offset() int64 {
+	if self.Checksums() {
+		return 1
+	}
+	return 0
+}
+
+func (self *BlockFile) is_bitmap(i int64) bool {
+	return self.Bitmap() && i > 0 && (i-1)%self.bits_per_block() == self.bitmap_offset()
+}
+
+func (self *BlockFile) bit_location(i int64) (key int64, byte_ int64, mask byte) {
+	bits := self.bits_per_block()
+	group := (i - 1) / bits
+	j := (i - 1) % bits
+	key = (1 + group*bits + self.bitmap_offset()) * int64(self.ctrl.blksize)
+	return key, j / 8, 1 << uint(j%8)
+}
+
+func (self *BlockFile) bitmap_block(key int64) (ByteSlice, error) {
+	if blk, has := self.maps[key]; has {
+		return blk, nil
+	}
+	blk := make(ByteSlice, self.ctrl.blksize)
+	if err := self.read_at(blk, key); err != nil {
+		return nil, err
+	}
+	self.maps[key] = blk
+	return blk, nil
+}
+
+// build_bitmap writes the bitmap block for the group of block i from scratch.
+func (self *BlockFile) build_bitmap(key int64, used func(i int64) bool) error {
+	blksize := int64(self.ctrl.blksize)
+	bits := self.bits_per_block()
+	first := 1 + ((key/blksize-1)/bits)*bits
+	blk := make(ByteSlice, blksize)
+	for j := int64(0); j < bits; j++ {
+		if i := first + j; self.reserved(i*blksize) || used(i) {
+			blk[j/8] |= 1 << uint(j%8)
+		}
+	}
+	if _, err := self.file.WriteAt(blk, key); err != nil {
+		return err
+	}
+	self.maps[key] = blk
+	return nil
+}
+
+// init_bitmaps starts the bitmap blocks the file grew over, the blocks new to
+// the file are free until they are handed out.
+func (self *BlockFile) init_bitmaps(start, end int64) error {
+	blksize := int64(self.ctrl.blksize)
+	for p := start; p < end; p += blksize {
+		if self.is_bitmap(p / blksize) {
+			if err := self.build_bitmap(p, func(int64) bool { return false }); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *BlockFile) bit(i int64) (bool, error) {
+	key, b, mask := self.bit_location(i)
+	blk, err := self.bitmap_block(key)
+	if err != nil {
+		return false, err
+	}
+	return blk[b]&mask != 0, nil
+}
+
+func (self *BlockFile) set_bits(p int64, n int, used bool) error {
+	blksize := int64(self.ctrl.blksize)
+	dirty := make(map[int64]ByteSlice)
+	for i := p / blksize; i < p/blksize+int64(n); i++ {
+		if i == 0 {
+			// the control block has no bit
+			continue
+		}
+		key, b, mask := self.bit_location(i)
+		blk, err := self.bitmap_block(key)
+		if err != nil {
+			return err
+		}
+		if used {
+			blk[b] |= mask
+		} else {
+			blk[b] &^= mask
+		}
+		dirty[key] = blk
+	}
+	for key, blk := range dirty {
+		if _, err := self.file.WriteAt(blk, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *BlockFile) blocks() (int64, error) {
+	size, err := self.Size()
+	if err != nil {
+		return 0, err
+	}
+	return int64(size) / int64(self.ctrl.blksize), nil
+}
+
+// find_run returns the first block of the first run of n free blocks at or
+// after the hint.
+func (self *BlockFile) find_run(n int) (i int64, found bool, err error) {
+	blocks, err := self.blocks()
+	if err != nil {
+		return 0, false, err
+	}
+	run := int64(0)
+	for i = self.hint; i < blocks; i++ {
+		key, b, _ := self.bit_location(i)
+		blk, err := self.bitmap_block(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if (i-1)%8 == 0 && blk[b] == 0xff && i+8 <= blocks {
+			run = 0
+			i += 7
+			continue
+		}
+		if used, err := self.bit(i); err != nil {
+			return 0, false, err
+		} else if used {
+			run = 0
+			continue
+		}
+		run += 1
+		if run == int64(n) {
+			return i - run + 1, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (self *BlockFile) bitmap_alloc(n int) (pos int64, err error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("Cannot allocate %d blocks", n)
+	}
+	if n > self.max_run() {
+		return 0, fmt.Errorf("Cannot allocate %d contiguous blocks, at most %d fit between reserved blocks",
+			n, self.max_run())
+	}
+	i, found, err := self.find_run(n)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return self.alloc(n)
+	}
+	if i == self.hint {
+		self.hint = i + int64(n)
+	}
+	pos = i * int64(self.ctrl.blksize)
+	return pos, self.set_bits(pos, n, true)
+}
+
+func (self *BlockFile) bitmap_free(pos int64) error {
+	blksize := int64(self.ctrl.blksize)
+	blocks, err := self.blocks()
+	if err != nil {
+		return err
+	}
+	i := pos / blksize
+	if pos%blksize != 0 || i <= 0 || i >= blocks || self.reserved(pos) {
+		return fmt.Errorf("Cannot free block %d", pos)
+	}
+	if used, err := self.bit(i); err != nil {
+		return err
+	} else if !used {
+		return fmt.Errorf("Block %d is already free", pos)
+	}
+	if i < self.hint {
+		self.hint = i
+	}
+	return self.set_bits(pos, 1, false)
+}
+
+func (self *BlockFile) bitmap_free_blocks() (free []int64, err error) {
+	blocks, err := self.blocks()
+	if err != nil {
+		return nil, err
+	}
+	blksize := int64(self.ctrl.blksize)
+	for i := int64(1); i < blocks; i++ {
+		if used, err := self.bit(i); err != nil {
+			return nil, err
+		} else if !used {
+			free = append(free, i*blksize)
+		}
+	}
+	return free, nil
+}
+
+// bitmap_set_free rewrites every bitmap block so exactly the given blocks are
+// free.
+func (self *BlockFile) bitmap_set_free(free []int64) error {
+	blocks, err := self.blocks()
+	if err != nil {
+		return err
+	}
+	blksize := int64(self.ctrl.blksize)
+	is_free := make(map[int64]bool)
+	for _, pos := range free {
+		is_free[pos/blksize] = true
+	}
+	used := func(i int64) bool {
+		return i < blocks && !is_free[i]
+	}
+	for i := int64(1); i < blocks; i += self.bits_per_block() {
+		key, _, _ := self.bit_location(i)
+		if key/blksize >= blocks {
+			break
+		}
+		if err := self.build_bitmap(key, used); err != nil {
+			return err
+		}
+	}
+	self.hint = 1
+	return nil
+}
+
+// FreeSpace reports how many blocks are free and the longest run of them. With
+// the free list the list is walked, with the bitmap the bitmap is scanned.
+func (self *BlockFile) FreeSpace() (stats *FreeSpace, err error) {
+	if !self.opened {
+		return nil, fmt.Errorf("File is not open")
+	}
+	blocks, err := self.blocks()
+	if err != nil {
+		return nil, err
+	}
+	free, err := self.free_blocks()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(int64s(free))
+	stats = &FreeSpace{Blocks: blocks, Free: int64(len(free))}
+	blksize := int64(self.ctrl.blksize)
+	run := int64(0)
+	for i, pos := range free {
+		if i > 0 && free[i-1]+blksize == pos {
+			run += 1
+		} else {
+			run = 1
+		}
+		if run > stats.Largest {
+			stats.Largest = run
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,154 @@
+package file2
+
+import "testing"
+
+func testbitmap(t *testing.T, flags uint32) *MemBlockFile {
+	mf := NewMemBlockFileWithFlags(BLOCKSIZE, flags|BITMAP)
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return mf
+}
+
+func TestBitmapAllocate(t *testing.T) {
+	for _, flags := range []uint32{0, CHECKSUMS} {
+		mf := testbitmap(t, flags)
+		seen := make(map[int64]bool)
+		var keys []int64
+		for i := 0; i < 2000; i++ {
+			key, err := mf.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seen[key] || mf.reserved(key) || key == 0 {
+				t.Fatalf("Allocate handed out block %d twice or a reserved block", key)
+			}
+			seen[key] = true
+			keys = append(keys, key)
+			if err := mf.WriteBlock(key, filled(mf, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := mf.FreeSpace()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Free != 0 {
+			t.Fatalf("Expected no free blocks got %d", stats.Free)
+		}
+
+		// free three blocks next to each other and one on its own
+		for _, key := range []int64{keys[100], keys[101], keys[102], keys[500]} {
+			if err := mf.Free(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := mf.Free(keys[100]); err == nil {
+			t.Fatal("Expected a double free to fail")
+		}
+		if stats, err = mf.FreeSpace(); err != nil {
+			t.Fatal(err)
+		} else if stats.Free != 4 || stats.Largest != 3 {
+			t.Fatalf("Expected 4 free blocks with a run of 3 got %+v", stats)
+		}
+		size, err := mf.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key, err := mf.AllocateBlocks(3); err != nil {
+			t.Fatal(err)
+		} else if key != keys[100] {
+			t.Fatalf("Expected the run of freed blocks to be reused got %d", key)
+		}
+		if key, err := mf.Allocate(); err != nil {
+			t.Fatal(err)
+		} else if key != keys[500] {
+			t.Fatalf("Expected the freed block to be reused got %d", key)
+		}
+		if after, err := mf.Size(); err != nil {
+			t.Fatal(err)
+		} else if after != size {
+			t.Fatalf("Expected the file not to grow %d != %d", size, after)
+		}
+		for i, key := range keys {
+			if i < 100 || (i > 102 && i != 500) {
+				expect_block(t, mf, key, byte(i))
+			}
+		}
+	}
+}
+
+func TestBitmapPersists(t *testing.T) {
+	mf := testbitmap(t, 0)
+	A, err := mf.AllocateBlocks(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Free(A + BLOCKSIZE); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mf, err = LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if !mf.Bitmap() {
+		t.Fatal("Expected the allocator to be read from the control block")
+	}
+	if err := mf.Free(A + BLOCKSIZE); err == nil {
+		t.Fatal("Expected a double free to fail after reopening")
+	}
+	if key, err := mf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if key != A+BLOCKSIZE {
+		t.Fatalf("Expected the freed block to be reused got %d", key)
+	}
+}
+
+func TestBitmapCompact(t *testing.T) {
+	mf := testbitmap(t, CHECKSUMS)
+	var keys []int64
+	for i := 0; i < 50; i++ {
+		key, err := mf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if err := mf.WriteBlock(key, filled(mf, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range keys[:25] {
+		if err := mf.Free(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	moves := make(map[int64]int64)
+	if err := mf.Compact(func(m map[int64]int64) error {
+		moves = m
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys[25:] {
+		if to, has := moves[key]; has {
+			key = to
+		}
+		expect_block(t, mf, key, byte(i+25))
+	}
+	if stats, err := mf.FreeSpace(); err != nil {
+		t.Fatal(err)
+	} else if stats.Free != 0 {
+		t.Fatalf("Expected compaction to leave no free blocks got %+v", stats)
+	}
+	if key, err := mf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if _, err := mf.ReadBlock(key); err != nil {
+		t.Fatal(err)
+	}
+}
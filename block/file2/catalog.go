@@ -0,0 +1,320 @@
+package file2
+
+import (
+	"fmt"
+	"sort"
+)
+
+import bs "file-structures/block/byteslice"
+
+// CATALOG_TYPE tags the devices holding a Catalog.
+var CATALOG_TYPE = Tag("CTLG")
+
+const CATALOG_HEADER = 12
+const MAX_ROOT_NAME = 255
+
+/*
+Catalog keeps many named roots in one device so several structures can share
+its blocks and allocator. Each root is a BlockDevice of its own which passes
+every call through to the shared device except for the control data and the
+structure type, those belong to the root. A structure is built on a root just
+as it would be on a whole device and opened again through the root of the same
+name.
+
+The control data of a root lives in a block of its own. The catalog is a list
+of name, structure type and control data block entries stored in a chain of
+blocks, each starting with the key of the next block and the number of bytes of
+the list it holds. The control data of the device points at the first block.
+
+Closing a root does nothing, the device is closed with the Catalog.
+*/
+type Catalog struct {
+	file  BlockDevice
+	head  int64
+	roots map[string]*catalog_entry
+}
+
+type catalog_entry struct {
+	name  string
+	stype uint32
+	key   int64
+}
+
+func NewCatalog(file BlockDevice) (self *Catalog, err error) {
+	if err := CheckStructureType(file, CATALOG_TYPE); err != nil {
+		return nil, err
+	}
+	self = &Catalog{
+		file:  file,
+		roots: make(map[string]*catalog_entry),
+	}
+	if self.head, err = self.allocate(); err != nil {
+		return nil, err
+	}
+	if err := self.write(); err != nil {
+		return nil, err
+	}
+	if err := file.SetStructureType(CATALOG_TYPE); err != nil {
+		return nil, err
+	}
+	return self, file.SetControlData(bs.ByteSlice64(uint64(self.head)))
+}
+
+func OpenCatalog(file BlockDevice) (self *Catalog, err error) {
+	if err := CheckStructureType(file, CATALOG_TYPE); err != nil {
+		return nil, err
+	}
+	data, err := file.ControlData()
+	if err != nil {
+		return nil, err
+	}
+	self = &Catalog{
+		file:  file,
+		head:  int64(data[0:8].Int64()),
+		roots: make(map[string]*catalog_entry),
+	}
+	if self.head == 0 {
+		return nil, fmt.Errorf("The device does not hold a catalog")
+	}
+	if err := self.read(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *Catalog) Close() error {
+	return self.file.Close()
+}
+
+// Names lists the roots in the catalog in order.
+func (self *Catalog) Names() []string {
+	names := make([]string, 0, len(self.roots))
+	for name := range self.roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *Catalog) Has(name string) bool {
+	_, has := self.roots[name]
+	return has
+}
+
+// Create adds an empty root, its control data reads as zeros and it has no
+// structure type until the structure built on it sets one.
+func (self *Catalog) Create(name string) (BlockDevice, error) {
+	if len(name) == 0 || len(name) > MAX_ROOT_NAME {
+		return nil, fmt.Errorf("A root name must be 1 to %d bytes long got %q", MAX_ROOT_NAME, name)
+	}
+	if self.Has(name) {
+		return nil, fmt.Errorf("The catalog already has a root named %q", name)
+	}
+	key, err := self.allocate()
+	if err != nil {
+		return nil, err
+	}
+	self.roots[name] = &catalog_entry{name: name, key: key}
+	if err := self.write(); err != nil {
+		return nil, err
+	}
+	return &catalog_root{self.file, self, name}, nil
+}
+
+func (self *Catalog) Root(name string) (BlockDevice, error) {
+	if !self.Has(name) {
+		return nil, fmt.Errorf("The catalog has no root named %q", name)
+	}
+	return &catalog_root{self.file, self, name}, nil
+}
+
+// Drop removes a root from the catalog and frees its control data block. The
+// blocks of the structure built on it are not touched, free them first.
+func (self *Catalog) Drop(name string) error {
+	e, has := self.roots[name]
+	if !has {
+		return fmt.Errorf("The catalog has no root named %q", name)
+	}
+	delete(self.roots, name)
+	if err := self.write(); err != nil {
+		return err
+	}
+	return self.file.Free(e.key)
+}
+
+func (self *Catalog) entry(name string) (*catalog_entry, error) {
+	e, has := self.roots[name]
+	if !has {
+		return nil, fmt.Errorf("The root %q has been dropped", name)
+	}
+	return e, nil
+}
+
+func (self *Catalog) bytes() []byte {
+	var bytes []byte
+	for _, name := range self.Names() {
+		e := self.roots[name]
+		bytes = append(bytes, uint8(len(name)))
+		bytes = append(bytes, name...)
+		bytes = append(bytes, bs.ByteSlice32(e.stype)...)
+		bytes = append(bytes, bs.ByteSlice64(uint64(e.key))...)
+	}
+	return bytes
+}
+
+func (self *Catalog) load(bytes bs.ByteSlice) error {
+	for len(bytes) > 0 {
+		n := int(bytes[0])
+		if len(bytes) < 1+n+12 {
+			return fmt.Errorf("The catalog is corrupt, an entry runs off its end")
+		}
+		e := &catalog_entry{
+			name:  string(bytes[1 : 1+n]),
+			stype: bytes[1+n : 5+n].Int32(),
+			key:   int64(bytes[5+n : 13+n].Int64()),
+		}
+		self.roots[e.name] = e
+		bytes = bytes[13+n:]
+	}
+	return nil
+}
+
+// write stores the entries in the chain of blocks starting at head, the chain
+// grows and shrinks to fit.
+func (self *Catalog) write() error {
+	blk_size := int(self.file.BlockSize())
+	room := blk_size - CATALOG_HEADER
+	bytes := self.bytes()
+	key := self.head
+	for {
+		blk, err := self.file.ReadBlock(key)
+		if err != nil {
+			return err
+		}
+		next := int64(bs.ByteSlice(blk[0:8]).Int64())
+		n := len(bytes)
+		if n > room {
+			n = room
+		}
+		rest := bytes[n:]
+		if len(rest) > 0 && next == 0 {
+			if next, err = self.allocate(); err != nil {
+				return err
+			}
+		} else if len(rest) == 0 && next != 0 {
+			if err := self.free_chain(next); err != nil {
+				return err
+			}
+			next = 0
+		}
+		out := make(bs.ByteSlice, blk_size)
+		copy(out[0:8], bs.ByteSlice64(uint64(next)))
+		copy(out[8:12], bs.ByteSlice32(uint32(n)))
+		copy(out[CATALOG_HEADER:], bytes[:n])
+		if err := self.file.WriteBlock(key, out); err != nil {
+			return err
+		}
+		if len(rest) == 0 {
+			return nil
+		}
+		bytes = rest
+		key = next
+	}
+}
+
+// allocate hands out a zeroed block, a freed block still holds whatever was
+// last written to it.
+func (self *Catalog) allocate() (int64, error) {
+	key, err := self.file.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	if err := self.file.WriteBlock(key, make(bs.ByteSlice, self.file.BlockSize())); err != nil {
+		return 0, err
+	}
+	return key, nil
+}
+
+func (self *Catalog) free_chain(key int64) error {
+	for key != 0 {
+		blk, err := self.file.ReadBlock(key)
+		if err != nil {
+			return err
+		}
+		if err := self.file.Free(key); err != nil {
+			return err
+		}
+		key = int64(bs.ByteSlice(blk[0:8]).Int64())
+	}
+	return nil
+}
+
+func (self *Catalog) read() error {
+	var bytes bs.ByteSlice
+	for key := self.head; key != 0; {
+		blk, err := self.file.ReadBlock(key)
+		if err != nil {
+			return err
+		}
+		n := int(bs.ByteSlice(blk[8:12]).Int32())
+		if n > len(blk)-CATALOG_HEADER {
+			return fmt.Errorf("The catalog is corrupt, block %d holds %d bytes", key, n)
+		}
+		bytes = append(bytes, blk[CATALOG_HEADER:CATALOG_HEADER+n]...)
+		key = int64(bs.ByteSlice(blk[0:8]).Int64())
+	}
+	return self.load(bytes)
+}
+
+// catalog_root is the BlockDevice a structure in the catalog is built on.
+type catalog_root struct {
+	BlockDevice
+	catalog *Catalog
+	name    string
+}
+
+func (self *catalog_root) Close() error { return nil }
+
+func (self *catalog_root) ControlData() (data bs.ByteSlice, err error) {
+	e, err := self.catalog.entry(self.name)
+	if err != nil {
+		return nil, err
+	}
+	blk, err := self.BlockDevice.ReadBlock(e.key)
+	if err != nil {
+		return nil, err
+	}
+	data = make(bs.ByteSlice, self.BlockSize()-CONTROLSIZE)
+	copy(data, blk)
+	return data, nil
+}
+
+func (self *catalog_root) SetControlData(data bs.ByteSlice) (err error) {
+	if len(data) > int(self.BlockSize()-CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	e, err := self.catalog.entry(self.name)
+	if err != nil {
+		return err
+	}
+	blk := make(bs.ByteSlice, self.BlockSize())
+	copy(blk, data)
+	return self.BlockDevice.WriteBlock(e.key, blk)
+}
+
+func (self *catalog_root) StructureType() (stype uint32, err error) {
+	e, err := self.catalog.entry(self.name)
+	if err != nil {
+		return 0, err
+	}
+	return e.stype, nil
+}
+
+func (self *catalog_root) SetStructureType(stype uint32) error {
+	e, err := self.catalog.entry(self.name)
+	if err != nil {
+		return err
+	}
+	e.stype = stype
+	return self.catalog.write()
+}
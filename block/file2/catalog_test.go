@@ -0,0 +1,160 @@
+package file2
+
+import "testing"
+
+import (
+	"fmt"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+)
+
+func reopen_catalog(t *testing.T, mf *MemBlockFile) (*Catalog, *MemBlockFile) {
+	reopened, err := LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := OpenCatalog(reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, reopened
+}
+
+func TestCatalog(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCatalog(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enough roots that the catalog needs a chain of blocks
+	const ROOTS = 300
+	for i := 0; i < ROOTS; i++ {
+		name := fmt.Sprintf("root-%03d", i)
+		root, err := c.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := root.ControlData(); err != nil {
+			t.Fatal(err)
+		} else if !data[:8].Eq(make(bs.ByteSlice, 8)) {
+			t.Fatal("Expected a new root to have zeroed control data")
+		}
+		if err := root.SetControlData(bs.ByteSlice64(uint64(i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.SetStructureType(Tag("TEST")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Create("root-007"); err == nil {
+		t.Fatal("Expected a duplicate name to be refused")
+	}
+	if _, err := c.Root("missing"); err == nil {
+		t.Fatal("Expected a missing root to be an error")
+	}
+	empty := NewMemBlockFile()
+	if err := empty.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCatalog(empty); err == nil {
+		t.Fatal("Expected an empty device not to open as a catalog")
+	}
+
+	c, mf = reopen_catalog(t, mf)
+	if names := c.Names(); len(names) != ROOTS || names[0] != "root-000" {
+		t.Fatalf("Expected %d roots in order got %d", ROOTS, len(names))
+	}
+	for i := 0; i < ROOTS; i++ {
+		root, err := c.Root(fmt.Sprintf("root-%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := root.ControlData(); err != nil {
+			t.Fatal(err)
+		} else if data[:8].Int64() != uint64(i) {
+			t.Fatalf("Expected root %d to keep its control data got %d", i, data[:8].Int64())
+		}
+		if err := CheckStructureType(root, Tag("TEST")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// dropping most of the roots shrinks the chain back and frees the blocks
+	root, err := c.Root("root-000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < ROOTS; i++ {
+		if err := c.Drop(fmt.Sprintf("root-%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Drop("root-001"); err == nil {
+		t.Fatal("Expected dropping a missing root to be an error")
+	}
+	if key, err := mf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if key > int64(ROOTS+8)*BLOCKSIZE {
+		t.Fatalf("Expected the dropped blocks to be reused got %d", key)
+	}
+	if data, err := root.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if data[:8].Int64() != 0 {
+		t.Fatal("Expected the remaining root to be untouched")
+	}
+	c, _ = reopen_catalog(t, mf)
+	if names := c.Names(); len(names) != 1 || names[0] != "root-000" {
+		t.Fatalf("Expected one root after dropping got %v", names)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The blocks a catalog allocates may have been freed before, their stale
+// contents must not be taken for the next block of the chain.
+func TestCatalogReusedBlocks(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int64, 3)
+	for i := range keys {
+		key, err := mf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+	}
+	for _, key := range keys {
+		if err := mf.Free(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := NewCatalog(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Create("a"); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for i := 0; i < 4; i++ {
+		key, err := mf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[key] {
+			t.Fatalf("Block %d was allocated twice", key)
+		}
+		seen[key] = true
+	}
+}
@@ -0,0 +1,180 @@
+package file2
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+import . "file-structures/block/byteslice"
+
+/*
+Flags are kept in the low bits of the block size word of the control block.
+Block sizes are multiples of 4096 so files written before the flags existed
+read back with no flags set.
+*/
+const (
+	CHECKSUMS = 1 << iota
+	BITMAP
+)
+
+const FLAGMASK = 0xfff
+
+/*
+When CHECKSUMS is set the file is split into groups of BlockSize()/4 blocks.
+The first block of every group is reserved and holds the CRC32 of each block in
+the group, the reserved block itself and the control block (which carries its
+own checksum) are not covered. The allocator never hands out reserved blocks.
+*/
+
+type CorruptBlockError struct {
+	Key      int64
+	Expected uint32
+	Actual   uint32
+}
+
+func (self *CorruptBlockError) Error() string {
+	return fmt.Sprintf("Block %d is corrupt, checksum %x != %x", self.Key, self.Actual, self.Expected)
+}
+
+func (self *BlockFile) Flags() uint32 { return self.ctrl.flags }
+
+func (self *BlockFile) Checksums() bool { return self.ctrl.flags&CHECKSUMS != 0 }
+
+func (self *BlockFile) sums_per_block() int64 {
+	return int64(self.ctrl.blksize / 4)
+}
+
+func (self *BlockFile) reserved(p int64) bool {
+	i := p / int64(self.ctrl.blksize)
+	if self.Checksums() && i > 0 && (i-1)%self.sums_per_block() == 0 {
+		return true
+	}
+	return self.is_bitmap(i)
+}
+
+func (self *BlockFile) reserved_in(p int64, n int) (int64, bool) {
+	blksize := int64(self.ctrl.blksize)
+	for i := int64(0); i < int64(n); i++ {
+		if self.reserved(p + i*blksize) {
+			return p + i*blksize, true
+		}
+	}
+	return 0, false
+}
+
+func (self *BlockFile) max_run() int {
+	if self.Checksums() && self.Bitmap() {
+		return int(self.sums_per_block()) - 2
+	} else if self.Checksums() {
+		return int(self.sums_per_block()) - 1
+	} else if self.Bitmap() {
+		return int(self.bits_per_block()) - 1
+	}
+	return int(^uint(0) >> 1)
+}
+
+func (self *BlockFile) check_reserved(p int64, length int) error {
+	if p%int64(self.ctrl.blksize) != 0 {
+		return nil
+	}
+	if r, has := self.reserved_in(p, length/int(self.ctrl.blksize)); has {
+		return fmt.Errorf("Block %d is reserved", r)
+	}
+	return nil
+}
+
+func (self *BlockFile) sum_location(p int64) (key int64, offset int) {
+	blksize := int64(self.ctrl.blksize)
+	per := self.sums_per_block()
+	i := p/blksize - 1
+	return ((i/per)*per + 1) * blksize, int(i%per) * 4
+}
+
+func (self *BlockFile) sum_block(key int64) (ByteSlice, error) {
+	if blk, has := self.sums[key]; has {
+		return blk, nil
+	}
+	blk := make(ByteSlice, self.ctrl.blksize)
+	if err := self.read_at(blk, key); err != nil {
+		return nil, err
+	}
+	self.sums[key] = blk
+	return blk, nil
+}
+
+// set_sums and verify_sums hold slock so that blocks which share a checksum
+// block may be written and read at the same time.
+func (self *BlockFile) set_sums(p int64, sums []uint32) error {
+	self.slock.Lock()
+	defer self.slock.Unlock()
+	blksize := int64(self.ctrl.blksize)
+	dirty := make(map[int64]ByteSlice)
+	for i, sum := range sums {
+		key := p + int64(i)*blksize
+		if key < blksize || self.reserved(key) {
+			continue
+		}
+		skey, offset := self.sum_location(key)
+		sblk, err := self.sum_block(skey)
+		if err != nil {
+			return err
+		}
+		copy(sblk[offset:offset+4], ByteSlice32(sum))
+		dirty[skey] = sblk
+	}
+	for skey, sblk := range dirty {
+		if _, err := self.file.WriteAt(sblk, skey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *BlockFile) init_sums(start, end int64) error {
+	if !self.Checksums() || start >= end {
+		return nil
+	}
+	zero := crc32.ChecksumIEEE(make([]byte, self.ctrl.blksize))
+	sums := make([]uint32, (end-start)/int64(self.ctrl.blksize))
+	for i := range sums {
+		sums[i] = zero
+	}
+	return self.set_sums(start, sums)
+}
+
+func (self *BlockFile) write_sums(p int64, blocks []byte) error {
+	if !self.Checksums() {
+		return nil
+	}
+	blksize := int(self.ctrl.blksize)
+	sums := make([]uint32, 0, len(blocks)/blksize)
+	for i := 0; i+blksize <= len(blocks); i += blksize {
+		sums = append(sums, crc32.ChecksumIEEE(blocks[i:i+blksize]))
+	}
+	return self.set_sums(p, sums)
+}
+
+func (self *BlockFile) verify_sums(p int64, blocks []byte) error {
+	if !self.Checksums() {
+		return nil
+	}
+	self.slock.Lock()
+	defer self.slock.Unlock()
+	blksize := int(self.ctrl.blksize)
+	for i := 0; i+blksize <= len(blocks); i += blksize {
+		key := p + int64(i)
+		if key < int64(blksize) {
+			continue
+		}
+		skey, offset := self.sum_location(key)
+		sblk, err := self.sum_block(skey)
+		if err != nil {
+			return err
+		}
+		expected := sblk[offset : offset+4].Int32()
+		if actual := crc32.ChecksumIEEE(blocks[i : i+blksize]); actual != expected {
+			return &CorruptBlockError{Key: key, Expected: expected, Actual: actual}
+		}
+	}
+	return nil
+}
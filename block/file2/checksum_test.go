@@ -0,0 +1,133 @@
+package file2
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	buf "../buffers"
+)
+
+func TestChecksumAllocate(t *testing.T) {
+	mf := NewMemBlockFileWithFlags(BLOCKSIZE, CHECKSUMS)
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	per := int(mf.sums_per_block())
+	var keys []int64
+	for i := 0; i < 2*per+10; i++ {
+		key, err := mf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mf.reserved(key) {
+			t.Fatalf("Allocate handed out the reserved block %d", key)
+		}
+		keys = append(keys, key)
+		if err := mf.WriteBlock(key, filled(mf, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range keys {
+		expect_block(t, mf, key, byte(i))
+	}
+
+	if _, err := mf.AllocateBlocks(per); err == nil {
+		t.Fatal("Expected a run spanning a reserved block to be refused")
+	}
+	run, err := mf.AllocateBlocks(per - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, has := mf.reserved_in(run, per-1); has {
+		t.Fatalf("AllocateBlocks handed out the reserved block %d", r)
+	}
+	if blks, err := mf.ReadBlocks(run, per-1); err != nil {
+		t.Fatal(err)
+	} else if !blks.Zero() {
+		t.Fatal("Expected freshly allocated blocks to read back as zeros")
+	}
+	if _, err := mf.ReadBlock(BLOCKSIZE); err == nil {
+		t.Fatal("Expected reading a reserved block to fail")
+	}
+	if err := mf.WriteBlock(BLOCKSIZE, filled(mf, 1)); err == nil {
+		t.Fatal("Expected writing a reserved block to fail")
+	}
+}
+
+func TestChecksumCorruption(t *testing.T) {
+	cleanup(PATH)
+	defer cleanup(PATH)
+	bf := NewBlockFileWithFlags(PATH, &buf.NoBuffer{}, BLOCKSIZE, CHECKSUMS)
+	if err := bf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	A, err := bf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := bf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bf.WriteBlock(A, filled(bf, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bf.WriteBlock(B, filled(bf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err := os.OpenFile(PATH, os.O_RDWR, 0666); err != nil {
+		t.Fatal(err)
+	} else {
+		if _, err := f.WriteAt([]byte{0xff}, B+100); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	// the flag is read from the control block, not the constructor
+	bf = NewBlockFile(PATH, &buf.NoBuffer{})
+	if err := bf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+	if !bf.Checksums() {
+		t.Fatal("Expected the checksum flag to be read from the control block")
+	}
+	expect_block(t, bf, A, 1)
+	if _, err := bf.ReadBlock(B); err == nil {
+		t.Fatal("Expected the corrupt block to be detected")
+	} else if cerr, ok := err.(*CorruptBlockError); !ok {
+		t.Fatalf("Expected a *CorruptBlockError got %v", err)
+	} else if cerr.Key != B {
+		t.Fatalf("Expected the error to name block %d got %d", B, cerr.Key)
+	}
+	if _, err := bf.ReadBlocks(A, 2); err == nil {
+		t.Fatal("Expected ReadBlocks to detect the corrupt block")
+	}
+	if err := bf.WriteBlock(B, filled(bf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, bf, B, 3)
+}
+
+func TestChecksumOldFiles(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if mf.Checksums() {
+		t.Fatal("Expected checksums to be off by default")
+	}
+	if key, err := mf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if key != BLOCKSIZE {
+		t.Fatalf("Expected key == BLOCKSIZE got %d", key)
+	}
+}
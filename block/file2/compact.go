@@ -0,0 +1,153 @@
+package file2
+
+import (
+	"fmt"
+	"sort"
+)
+
+import . "file-structures/block/byteslice"
+
+/*
+A Relocator is handed every block moved by Compact as old key -> new key. It
+must rewrite all pointers the structure keeps to the old keys. The old copies
+are still readable while it runs. If it returns an error the compaction is
+abandoned and the file is left as it was.
+*/
+type Relocator func(moves map[int64]int64) error
+
+type int64s []int64
+
+func (self int64s) Len() int           { return len(self) }
+func (self int64s) Less(i, j int) bool { return self[i] < self[j] }
+func (self int64s) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+func (self *BlockFile) free_blocks() (free []int64, err error) {
+	if self.Bitmap() {
+		return self.bitmap_free_blocks()
+	}
+	pos := int64(self.ctrl.free_head)
+	for i := uint32(0); i < self.ctrl.free_len; i++ {
+		free = append(free, pos)
+		bytes, err := self.ReadBlock(pos)
+		if err != nil {
+			return nil, err
+		}
+		pos = int64(bytes[0:8].Int64())
+	}
+	return free, nil
+}
+
+func (self *BlockFile) set_free(free []int64) error {
+	if self.Bitmap() {
+		return self.bitmap_set_free(free)
+	}
+	sort.Sort(sort.Reverse(int64s(free)))
+	self.ctrl.free_head = 0
+	self.ctrl.free_len = 0
+	for _, pos := range free {
+		blk := make(ByteSlice, self.ctrl.blksize)
+		copy(blk, ByteSlice64(self.ctrl.free_head))
+		if err := self.WriteBlock(pos, blk); err != nil {
+			return err
+		}
+		self.ctrl.free_head = uint64(pos)
+		self.ctrl.free_len += 1
+	}
+	return self.write_ctrlblk()
+}
+
+// Compact moves the live blocks at the end of the file into the free blocks at
+// the front and truncates the file after the last live block. BlockFile has no
+// notion of which blocks point at which so relocate must fix up the pointers.
+// Nothing may cache blocks of the file while it is being compacted.
+func (self *BlockFile) Compact(relocate Relocator) error {
+	if !self.opened {
+		return fmt.Errorf("File is not open")
+	}
+	if self.dead.Count() > 0 {
+		return fmt.Errorf("Cannot compact while %d blocks are dead, Reclaim them first", self.dead.Count())
+	}
+	free, err := self.free_blocks()
+	if err != nil {
+		return err
+	}
+	size, err := self.Size()
+	if err != nil {
+		return err
+	}
+	blksize := int64(self.ctrl.blksize)
+	is_free := make(map[int64]bool)
+	for _, pos := range free {
+		is_free[pos] = true
+	}
+	live := func(pos int64) bool {
+		return pos > 0 && !is_free[pos] && !self.reserved(pos)
+	}
+
+	sort.Sort(int64s(free))
+	moves := make(map[int64]int64)
+	used := 0
+	hi := int64(size) - blksize
+	for _, hole := range free {
+		for hi > hole && !live(hi) {
+			hi -= blksize
+		}
+		if hi <= hole {
+			break
+		}
+		moves[hi] = hole
+		used += 1
+		hi -= blksize
+	}
+	// everything at or below hi stayed where it was
+	for hi > 0 && !live(hi) {
+		hi -= blksize
+	}
+	if used > 0 && free[used-1] > hi {
+		hi = free[used-1]
+	}
+	end := hi + blksize
+	var remaining []int64
+	for _, pos := range free[used:] {
+		if pos < end {
+			remaining = append(remaining, pos)
+		}
+	}
+	if len(moves) == 0 && end == int64(size) {
+		return nil
+	}
+
+	// Until the compaction finishes the free list is empty, a crash leaks the
+	// free blocks rather than leaving a free list that runs through moved
+	// blocks.
+	if err := self.set_free(nil); err != nil {
+		return err
+	}
+	for from, to := range moves {
+		blk, err := self.ReadBlock(from)
+		if err != nil {
+			return err
+		}
+		if err := self.WriteBlock(to, blk); err != nil {
+			return err
+		}
+	}
+	if len(moves) > 0 && relocate != nil {
+		if err := relocate(moves); err != nil {
+			if ferr := self.set_free(free); ferr != nil {
+				return fmt.Errorf("%v, while restoring the free list: %v", err, ferr)
+			}
+			return err
+		}
+	}
+
+	for pos := end; pos < int64(size); pos += blksize {
+		self.buf.Remove(pos)
+		delete(self.sums, pos)
+		delete(self.maps, pos)
+	}
+	if err := self.resize(end); err != nil {
+		return err
+	}
+	return self.set_free(remaining)
+}
@@ -0,0 +1,184 @@
+package file2
+
+import "testing"
+
+import (
+	"fmt"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+)
+
+// a linked list of blocks, each block holds the key of the next block followed
+// by its payload byte. The head is kept in the control data.
+func build_chain(t *testing.T, f BlockDevice, n int) {
+	var keys []int64
+	for i := 0; i < n; i++ {
+		key, err := f.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	var live []int64
+	for i, key := range keys {
+		if i%3 == 0 {
+			live = append(live, key)
+		} else if err := f.Free(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, key := range live {
+		blk := filled(f, byte(i+1))
+		next := int64(0)
+		if i+1 < len(live) {
+			next = live[i+1]
+		}
+		copy(blk[0:8], bs.ByteSlice64(uint64(next)))
+		if err := f.WriteBlock(key, blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.SetControlData(bs.ByteSlice64(uint64(live[0]))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func walk_chain(f BlockDevice, visit func(key int64, blk bs.ByteSlice) error) error {
+	data, err := f.ControlData()
+	if err != nil {
+		return err
+	}
+	for key := int64(data[0:8].Int64()); key != 0; {
+		blk, err := f.ReadBlock(key)
+		if err != nil {
+			return err
+		}
+		if err := visit(key, blk); err != nil {
+			return err
+		}
+		key = int64(blk[0:8].Int64())
+	}
+	return nil
+}
+
+func check_chain(t *testing.T, f BlockDevice, n int) {
+	i := 0
+	err := walk_chain(f, func(key int64, blk bs.ByteSlice) error {
+		i += 1
+		if !blk[8:].Eq(filled(f, byte(i))[8:]) {
+			return fmt.Errorf("block %d of the chain has the wrong payload %v", i, blk[8:16])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Fatalf("Expected a chain of %d blocks got %d", n, i)
+	}
+}
+
+func relocate_chain(f BlockDevice) Relocator {
+	return func(moves map[int64]int64) error {
+		data, err := f.ControlData()
+		if err != nil {
+			return err
+		}
+		if to, has := moves[int64(data[0:8].Int64())]; has {
+			if err := f.SetControlData(bs.ByteSlice64(uint64(to))); err != nil {
+				return err
+			}
+		}
+		return walk_chain(f, func(key int64, blk bs.ByteSlice) error {
+			if to, has := moves[int64(blk[0:8].Int64())]; has {
+				copy(blk[0:8], bs.ByteSlice64(uint64(to)))
+				return f.WriteBlock(key, blk)
+			}
+			return nil
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	const ITEMS = 90
+	for _, flags := range []uint32{0, CHECKSUMS} {
+		mf := NewMemBlockFileWithFlags(BLOCKSIZE, flags)
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		build_chain(t, mf, ITEMS)
+		check_chain(t, mf, ITEMS/3)
+		before, err := mf.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := mf.Compact(relocate_chain(mf)); err != nil {
+			t.Fatal(err)
+		}
+		check_chain(t, mf, ITEMS/3)
+		after, err := mf.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reserved := uint64(0)
+		if flags&CHECKSUMS != 0 {
+			reserved = 1
+		}
+		if expected := (ITEMS/3 + 1 + reserved) * BLOCKSIZE; after != expected {
+			t.Fatalf("Expected the file to shrink from %d to %d got %d", before, expected, after)
+		}
+		if mf.ctrl.free_len != 0 {
+			t.Fatalf("Expected an empty free list got %d", mf.ctrl.free_len)
+		}
+
+		// a second compaction has nothing to do
+		if err := mf.Compact(func(moves map[int64]int64) error {
+			return fmt.Errorf("unexpected moves %v", moves)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if key, err := mf.Allocate(); err != nil {
+			t.Fatal(err)
+		} else if uint64(key) != after {
+			t.Fatalf("Expected the next block to come from the end %d got %d", after, key)
+		}
+	}
+}
+
+func TestCompactRelocateFails(t *testing.T) {
+	const ITEMS = 30
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	build_chain(t, mf, ITEMS)
+	free := mf.ctrl.free_len
+	before, err := mf.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Compact(func(moves map[int64]int64) error {
+		return fmt.Errorf("cannot relocate")
+	}); err == nil {
+		t.Fatal("Expected the relocator error to be returned")
+	}
+	check_chain(t, mf, ITEMS/3)
+	if after, err := mf.Size(); err != nil {
+		t.Fatal(err)
+	} else if after != before {
+		t.Fatalf("Expected the file size to be unchanged %d != %d", before, after)
+	}
+	if mf.ctrl.free_len != free {
+		t.Fatalf("Expected the free list to be restored %d != %d", free, mf.ctrl.free_len)
+	}
+	for i := uint32(0); i < free; i++ {
+		if key, err := mf.Allocate(); err != nil {
+			t.Fatal(err)
+		} else if uint64(key) >= before {
+			t.Fatalf("Expected a block from the restored free list got %d", key)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package file2
+
+import (
+	"fmt"
+	"sync"
+)
+
+import buf "file-structures/block/buffers"
+import bs "file-structures/block/byteslice"
+
+/*
+ConcurrentFile is a BlockDevice which may be shared between goroutines. It sits
+on an unbuffered BlockFile, whose reads and writes are positional and so need
+no lock of their own.
+
+Blocks are cached in an LRU split into stripes by key, each stripe behind its
+own lock, so goroutines working on different blocks rarely wait on each other.
+Every read and write of a block, including paging it in and out, happens under
+its stripe's lock. The cache keeps its own copies, ReadBlock hands out a fresh
+copy and WriteBlock copies the block it is given, so no two goroutines ever
+share a slice.
+
+Allocate, AllocateBlocks, Free, the control data and the dead list are
+serialised behind a single allocator lock, they are atomic with respect to each
+other but do not block reads and writes of other blocks.
+*/
+type ConcurrentFile struct {
+	file    *BlockFile
+	stripes []*lru_stripe
+	alloc   sync.Mutex
+	dead    DeadList
+}
+
+type lru_stripe struct {
+	lock sync.Mutex
+	lru  *lru
+}
+
+const STRIPES = 16
+
+func NewConcurrentFile(file *BlockFile, size uint64) (cf *ConcurrentFile, err error) {
+	return NewConcurrentFileStripes(file, size, STRIPES)
+}
+
+// NewConcurrentFileStripes caches size bytes of blocks spread evenly across n
+// stripes.
+func NewConcurrentFileStripes(file *BlockFile, size uint64, n int) (cf *ConcurrentFile, err error) {
+	if _, ok := file.buf.(*buf.NoBuffer); !ok {
+		return nil, fmt.Errorf("ConcurrentFile needs a BlockFile without a buffer")
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("Need at least one stripe got %d", n)
+	}
+	cache_size := 0
+	if size > 0 {
+		cache_size = 1 + int(size/uint64(file.BlockSize()))/n
+	}
+	cf = &ConcurrentFile{
+		file:    file,
+		stripes: make([]*lru_stripe, n),
+	}
+	for i := range cf.stripes {
+		cf.stripes[i] = &lru_stripe{lru: newLRU(cache_size, cf.pageout)}
+	}
+	return cf, nil
+}
+
+func (self *ConcurrentFile) pageout(key int64, block []byte) error {
+	return self.file.WriteBlock(key, block)
+}
+
+func (self *ConcurrentFile) stripe(key int64) *lru_stripe {
+	i := (key / int64(self.file.BlockSize())) % int64(len(self.stripes))
+	return self.stripes[i]
+}
+
+// Sync writes every dirty block in the cache to the file and syncs it. The
+// blocks stay cached.
+func (self *ConcurrentFile) Sync() error {
+	for _, s := range self.stripes {
+		s.lock.Lock()
+		err := s.lru.Flush()
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return self.file.Sync()
+}
+
+func (self *ConcurrentFile) Close() error {
+	self.alloc.Lock()
+	err := self.dead.ReleaseAll(self.free)
+	self.alloc.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, s := range self.stripes {
+		s.lock.Lock()
+		err := s.lru.Persist()
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return self.file.Close()
+}
+
+func (self *ConcurrentFile) Remove() error {
+	return self.file.Remove()
+}
+
+func (self *ConcurrentFile) BlockSize() uint32 { return self.file.BlockSize() }
+
+func (self *ConcurrentFile) ControlData() (data bs.ByteSlice, err error) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.ControlData()
+}
+
+func (self *ConcurrentFile) SetControlData(data bs.ByteSlice) (err error) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.SetControlData(data)
+}
+
+func (self *ConcurrentFile) StructureType() (stype uint32, err error) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.StructureType()
+}
+
+func (self *ConcurrentFile) SetStructureType(stype uint32) error {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.SetStructureType(stype)
+}
+
+func (self *ConcurrentFile) Allocate() (key int64, err error) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.Allocate()
+}
+
+func (self *ConcurrentFile) AllocateBlocks(n int) (key int64, err error) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.file.AllocateBlocks(n)
+}
+
+func (self *ConcurrentFile) Free(key int64) error {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	return self.free(key)
+}
+
+func (self *ConcurrentFile) free(key int64) error {
+	s := self.stripe(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lru.Remove(key)
+	return self.file.Free(key)
+}
+
+func (self *ConcurrentFile) MarkDead(key int64) error {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.dead.Mark(key)
+}
+
+func (self *ConcurrentFile) Enter() (epoch int64) {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.dead.Enter()
+}
+
+func (self *ConcurrentFile) Exit(epoch int64) error {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.dead.Exit(epoch)
+}
+
+func (self *ConcurrentFile) Reclaim() error {
+	self.alloc.Lock()
+	defer self.alloc.Unlock()
+	return self.dead.Reclaim(self.free)
+}
+
+func (self *ConcurrentFile) WriteBlock(key int64, block bs.ByteSlice) error {
+	if len(block) != int(self.BlockSize()) {
+		return fmt.Errorf("Expected a block of %d bytes got %d", self.BlockSize(), len(block))
+	}
+	s := self.stripe(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lru.Update(key, block.Copy(), false)
+}
+
+func (self *ConcurrentFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	s := self.stripe(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cached, has := s.lru.Read(key, self.BlockSize()); has {
+		return bs.ByteSlice(cached).Copy(), nil
+	}
+	block, err = self.file.ReadBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.lru.Update(key, block.Copy(), true); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// ReadBlocks takes the blocks which are cached from the cache and reads the
+// rest from the file without caching them, like LRUCacheFile.
+func (self *ConcurrentFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	blk_size := int64(self.BlockSize())
+	blocks = make(bs.ByteSlice, int64(n)*blk_size)
+	for i := int64(0); i < int64(n); i++ {
+		ckey := key + i*blk_size
+		s := self.stripe(ckey)
+		s.lock.Lock()
+		block, has := s.lru.Read(ckey, self.BlockSize())
+		if !has {
+			block, err = self.file.ReadBlock(ckey)
+		}
+		copy(blocks[i*blk_size:(i+1)*blk_size], block)
+		s.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
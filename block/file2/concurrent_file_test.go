@@ -0,0 +1,91 @@
+package file2
+
+import "testing"
+
+import (
+	"sync"
+)
+
+import (
+	buf "../buffers"
+)
+
+func TestConcurrentFile(t *testing.T) {
+	const WORKERS = 8
+	const BLOCKS = 40
+	for _, flags := range []uint32{0, CHECKSUMS} {
+		mf := NewMemBlockFileWithFlags(BLOCKSIZE, flags)
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		cf, err := NewConcurrentFileStripes(mf.BlockFile, BLOCKSIZE*16, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := make([][]int64, WORKERS)
+		errs := make(chan error, WORKERS)
+		var wg sync.WaitGroup
+		for w := 0; w < WORKERS; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				var keys []int64
+				for i := 0; i < BLOCKS; i++ {
+					key, err := cf.Allocate()
+					if err != nil {
+						errs <- err
+						return
+					}
+					keys = append(keys, key)
+					if err := cf.WriteBlock(key, filled(cf, byte(w))); err != nil {
+						errs <- err
+						return
+					}
+				}
+				for round := 0; round < 3; round++ {
+					for _, key := range keys {
+						if blk, err := cf.ReadBlock(key); err != nil {
+							errs <- err
+							return
+						} else if !blk.Eq(filled(cf, byte(w))) {
+							t.Errorf("worker %d read someone else's block %d", w, key)
+							return
+						}
+					}
+				}
+				for _, key := range keys[:BLOCKS/2] {
+					if err := cf.Free(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+				kept[w] = keys[BLOCKS/2:]
+			}(w)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+		owner := make(map[int64]int)
+		for w, keys := range kept {
+			for _, key := range keys {
+				if o, has := owner[key]; has {
+					t.Fatalf("Block %d was handed to both worker %d and %d", key, o, w)
+				}
+				owner[key] = w
+				expect_block(t, cf, key, byte(w))
+			}
+		}
+		if err := cf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentFileNeedsNoBuffer(t *testing.T) {
+	bf := NewBlockFile(PATH, buf.NewLRU(10))
+	if _, err := NewConcurrentFile(bf, CACHESIZE); err == nil {
+		t.Fatal("Expected a buffered BlockFile to be refused")
+	}
+}
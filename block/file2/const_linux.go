@@ -12,15 +12,23 @@ flag REALLY lowers performance.
 // var OPENFLAG = os.O_RDWR | os.O_CREATE | syscall.O_DIRECT | syscall.O_NOATIME // | os.O_SYNC
 
 var OPENFLAG = os.O_RDWR | os.O_CREATE | syscall.O_NOATIME
+var READONLYFLAG = os.O_RDONLY | syscall.O_NOATIME
 
-func (self *BlockFile) open() error {
+func open_file(path string, readonly bool) (storage, error) {
 	// the O_DIRECT flag turns off os buffering of pages allow us to do it manually
 	// when using the O_DIRECT block size must be a multiple of 2048
-	if f, err := os.OpenFile(self.path, OPENFLAG, 0666); err != nil {
-		return err
-	} else {
-		self.file = f
-		self.opened = true
+	flag := open_flag(readonly)
+	f, err := os.OpenFile(path, flag, 0666)
+	if os.IsPermission(err) {
+		// O_NOATIME is refused with EPERM on files the caller does not own
+		f, err = os.OpenFile(path, flag&^syscall.O_NOATIME, 0666)
 	}
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	if err := lock_file(f, readonly); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &os_file{f}, nil
 }
@@ -0,0 +1,137 @@
+package file2
+
+import "fmt"
+
+/*
+A dead block is one the structure built on a device no longer points at but
+which a reader that started before the structure changed may still follow.
+MarkDead records the block against the current epoch instead of freeing it, it
+stays readable until it is reclaimed. Readers bracket each traversal with Enter
+and Exit. Reclaim frees every dead block marked before the oldest epoch a
+reader is still in and then starts a new epoch.
+
+The dead list is only held in memory. A crash leaks the dead blocks rather than
+letting a reader follow a block that has been reused. Close frees them since no
+reader can outlive the device.
+
+DeadList is exported so devices outside this package can keep their own, its
+zero value is ready to use.
+*/
+type DeadList struct {
+	epoch   int64
+	readers map[int64]int
+	blocks  []dead_block
+	marked  map[int64]bool
+}
+
+type dead_block struct {
+	key   int64
+	epoch int64
+}
+
+func (self *DeadList) init() {
+	if self.marked == nil {
+		self.readers = make(map[int64]int)
+		self.marked = make(map[int64]bool)
+	}
+}
+
+func (self *DeadList) Has(key int64) bool {
+	return self.marked[key]
+}
+
+func (self *DeadList) Count() int {
+	return len(self.blocks)
+}
+
+func (self *DeadList) Mark(key int64) error {
+	self.init()
+	if self.marked[key] {
+		return fmt.Errorf("Block %d is already dead", key)
+	}
+	self.marked[key] = true
+	self.blocks = append(self.blocks, dead_block{key: key, epoch: self.epoch})
+	return nil
+}
+
+func (self *DeadList) Enter() int64 {
+	self.init()
+	self.readers[self.epoch] += 1
+	return self.epoch
+}
+
+func (self *DeadList) Exit(epoch int64) error {
+	if self.readers[epoch] <= 0 {
+		return fmt.Errorf("No reader entered epoch %d", epoch)
+	}
+	self.readers[epoch] -= 1
+	if self.readers[epoch] == 0 {
+		delete(self.readers, epoch)
+	}
+	return nil
+}
+
+// oldest is the earliest epoch a reader is still in, blocks marked dead before
+// it can no longer be reached.
+func (self *DeadList) oldest() int64 {
+	oldest := self.epoch + 1
+	for epoch := range self.readers {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+	return oldest
+}
+
+func (self *DeadList) Reclaim(free func(key int64) error) error {
+	err := self.release(self.oldest(), free)
+	self.epoch += 1
+	return err
+}
+
+// release hands every block marked before epoch to free. If free fails the
+// blocks not yet freed stay on the list.
+func (self *DeadList) release(epoch int64, free func(key int64) error) error {
+	var kept []dead_block
+	for i, blk := range self.blocks {
+		if blk.epoch >= epoch {
+			kept = append(kept, blk)
+			continue
+		}
+		delete(self.marked, blk.key)
+		if err := free(blk.key); err != nil {
+			self.marked[blk.key] = true
+			self.blocks = append(kept, self.blocks[i:]...)
+			return err
+		}
+	}
+	self.blocks = kept
+	return nil
+}
+
+// ReleaseAll frees every dead block regardless of the readers, used when the
+// device is closed.
+func (self *DeadList) ReleaseAll(free func(key int64) error) error {
+	return self.release(self.epoch+1, free)
+}
+
+func (self *BlockFile) MarkDead(key int64) error {
+	if !self.opened {
+		return fmt.Errorf("File is not open")
+	}
+	if err := check_writable(self); err != nil {
+		return err
+	}
+	if key <= 0 || self.reserved(key) {
+		return fmt.Errorf("Cannot mark block %d as dead", key)
+	}
+	return self.dead.Mark(key)
+}
+
+func (self *BlockFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *BlockFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *BlockFile) Reclaim() error {
+	return self.dead.Reclaim(self.Free)
+}
@@ -0,0 +1,156 @@
+package file2
+
+import "testing"
+
+func dead_devices(t *testing.T) map[string]BlockDevice {
+	open := func() *MemBlockFile {
+		mf := NewMemBlockFile()
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return mf
+	}
+	lru, err := NewLRUCacheFile(open(), BLOCKSIZE*4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfu, err := NewLFUCacheFile(open(), BLOCKSIZE*4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal := testwal(t)
+	return map[string]BlockDevice{
+		"mem": open(),
+		"lru": lru,
+		"lfu": lfu,
+		"wal": wal,
+	}
+}
+
+func TestMarkDead(t *testing.T) {
+	for name, f := range dead_devices(t) {
+		A, err := f.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteBlock(A, filled(f, 0xd)); err != nil {
+			t.Fatal(err)
+		}
+		reader := f.Enter()
+		if err := f.MarkDead(A); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.MarkDead(A); err == nil {
+			t.Fatalf("%v: expected marking a dead block dead to fail", name)
+		}
+		if err := f.Free(A); err == nil {
+			t.Fatalf("%v: expected freeing a dead block to fail", name)
+		}
+		// a reader entering in the epoch the block died in holds it back, it
+		// may have read the old pointer.
+		late := f.Enter()
+		if err := f.Reclaim(); err != nil {
+			t.Fatal(err)
+		}
+		expect_block(t, f, A, 0xd)
+		after := f.Enter()
+		if err := f.Exit(reader); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Reclaim(); err != nil {
+			t.Fatal(err)
+		}
+		expect_block(t, f, A, 0xd)
+		if err := f.Exit(late); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Exit(reader); err == nil {
+			t.Fatalf("%v: expected a second Exit to fail", name)
+		}
+		// readers that entered after the epoch ended cannot reach the block
+		if err := f.Reclaim(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Exit(after); err != nil {
+			t.Fatal(err)
+		}
+		if B, err := f.Allocate(); err != nil {
+			t.Fatal(err)
+		} else if A != B {
+			t.Fatalf("%v: expected the reclaimed block to be reused %d != %d", name, A, B)
+		}
+		if wal, ok := f.(*WALFile); ok {
+			cleanupwal(wal)
+		}
+	}
+}
+
+func TestMarkDeadClose(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	A, err := mf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mf.Enter()
+	if err := mf.MarkDead(A); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Compact(func(map[int64]int64) error { return nil }); err == nil {
+		t.Fatal("Expected Compact to refuse to run with dead blocks")
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mf, err = LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if B, err := mf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if A != B {
+		t.Fatalf("Expected Close to free the dead block %d != %d", A, B)
+	}
+}
+
+func TestWALMarkDead(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.MarkDead(A); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Free(A); err != nil {
+		t.Fatalf("Expected the aborted MarkDead to be discarded got %v", err)
+	}
+	if A, err = wf.Allocate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.MarkDead(A); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Free(A); err == nil {
+		t.Fatal("Expected the committed MarkDead to hold the block")
+	}
+}
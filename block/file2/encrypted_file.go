@@ -0,0 +1,455 @@
+package file2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"math"
+)
+
+import bs "file-structures/block/byteslice"
+
+/*
+EncryptedFile seals every block with AES-GCM before it reaches the device
+underneath. Keys are handed straight through to the device so the blocks keep
+their keys and sizes, only their contents change.
+
+A block is sealed with a 12 byte nonce made of its index (its key divided by
+the block size) and a counter bumped on every write, so no nonce is ever used
+twice under the same key. The block key is the additional data, a block copied
+to a different key does not open. The counter and the 16 byte tag of every
+block live in a table kept in a chain of blocks, each a pointer to the next and
+a MAC followed by a 24 byte entry per block index. The entry is written before
+the block, a crash in between leaves a block which fails to open rather than
+one whose nonce is reused. Allocate seals a block of zeros, so every block in
+use has a counter and one of 0 fails like any other tampering.
+
+The table pages are rewritten in place with no counter of their own to make a
+nonce from, so rather than sealed they carry an HMAC-SHA256, cut to 16 bytes,
+of their key and contents under a key derived from the encryption key.
+
+The control data of the device underneath holds the parameters below, a key
+check, a tag sealed under the key, so opening with the wrong key fails at once,
+and a MAC of them all made like the ones of the table pages. The control data
+callers see is sealed in a block of its own.
+
+Tampering is caught block by block. Rolling a block and its table entry back
+together to an older version is not.
+*/
+type EncryptedFile struct {
+	file   RemovableBlockDevice
+	aead   cipher.AEAD
+	mackey []byte
+	ctrl   enc_ctrlblk
+	pages  []int64
+}
+
+type enc_ctrlblk struct {
+	magic    uint64
+	keysize  uint8
+	table    int64
+	userdata int64
+	check    bs.ByteSlice
+	mac      bs.ByteSlice
+}
+
+const ENC_MAGIC = 0x6165732d67636d31 // "aes-gcm1"
+const ENC_CONTROLSIZE = 8 + 1 + 8 + 8 + ENC_TAGSIZE + ENC_TAGSIZE
+const ENC_TAGSIZE = 16
+const ENC_NONCESIZE = 12
+const ENC_ENTRYSIZE = 8 + ENC_TAGSIZE
+const ENC_PAGEHEADER = 8 + ENC_TAGSIZE
+
+// TamperedBlockError is returned when a block does not open under the key, its
+// contents, its table entry or both have been changed.
+type TamperedBlockError struct {
+	Key int64
+}
+
+func (self *TamperedBlockError) Error() string {
+	return fmt.Sprintf("Block %d failed authentication", self.Key)
+}
+
+func (self *enc_ctrlblk) Bytes() []byte {
+	bytes := make([]byte, ENC_CONTROLSIZE)
+	copy(bytes[0:8], bs.ByteSlice64(self.magic))
+	bytes[8] = self.keysize
+	copy(bytes[9:17], bs.ByteSlice64(uint64(self.table)))
+	copy(bytes[17:25], bs.ByteSlice64(uint64(self.userdata)))
+	copy(bytes[25:25+ENC_TAGSIZE], self.check)
+	copy(bytes[25+ENC_TAGSIZE:], self.mac)
+	return bytes
+}
+
+func load_enc_ctrlblk(bytes bs.ByteSlice) (cb *enc_ctrlblk, err error) {
+	if len(bytes) < ENC_CONTROLSIZE {
+		return nil, fmt.Errorf("len(bytes) < %d", ENC_CONTROLSIZE)
+	}
+	cb = &enc_ctrlblk{
+		magic:    bytes[0:8].Int64(),
+		keysize:  bytes[8],
+		table:    int64(bytes[9:17].Int64()),
+		userdata: int64(bytes[17:25].Int64()),
+		check:    bytes[25 : 25+ENC_TAGSIZE].Copy(),
+		mac:      bytes[25+ENC_TAGSIZE : ENC_CONTROLSIZE].Copy(),
+	}
+	if cb.magic != ENC_MAGIC {
+		return nil, fmt.Errorf("The device is not encrypted")
+	}
+	return cb, nil
+}
+
+func new_aead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// mac_key derives the key the table pages and control parameters are signed
+// with, it is never used for sealing.
+func mac_key(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("table mac"))
+	return mac.Sum(nil)
+}
+
+// key_check seals nothing under the all zero nonce. Block 0 is the control
+// block and is never sealed so the nonce is not used for anything else.
+func key_check(aead cipher.AEAD) bs.ByteSlice {
+	return aead.Seal(nil, make([]byte, ENC_NONCESIZE), nil, []byte("key check"))
+}
+
+// NewEncryptedFile sets up encryption on a freshly opened device. The key must
+// be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+func NewEncryptedFile(file RemovableBlockDevice, key []byte) (self *EncryptedFile, err error) {
+	aead, err := new_aead(key)
+	if err != nil {
+		return nil, err
+	}
+	self = &EncryptedFile{
+		file:   file,
+		aead:   aead,
+		mackey: mac_key(key),
+		ctrl: enc_ctrlblk{
+			magic:   ENC_MAGIC,
+			keysize: uint8(len(key)),
+			check:   key_check(aead),
+		},
+	}
+	if self.ctrl.userdata, err = file.Allocate(); err != nil {
+		return nil, err
+	}
+	if err := self.write_ctrlblk(); err != nil {
+		return nil, err
+	}
+	return self, self.SetControlData(nil)
+}
+
+func OpenEncryptedFile(file RemovableBlockDevice, key []byte) (self *EncryptedFile, err error) {
+	data, err := file.ControlData()
+	if err != nil {
+		return nil, err
+	}
+	cb, err := load_enc_ctrlblk(data)
+	if err != nil {
+		return nil, err
+	}
+	if int(cb.keysize) != len(key) {
+		return nil, fmt.Errorf("Expected a %d byte key got %d bytes", cb.keysize, len(key))
+	}
+	aead, err := new_aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if !key_check(aead).Eq(cb.check) {
+		return nil, fmt.Errorf("Wrong key")
+	}
+	self = &EncryptedFile{
+		file:   file,
+		aead:   aead,
+		mackey: mac_key(key),
+		ctrl:   *cb,
+	}
+	// the control block is key 0, no block of the table has that key
+	if !hmac.Equal(self.sum(0, data[:ENC_CONTROLSIZE-ENC_TAGSIZE]), cb.mac) {
+		return nil, fmt.Errorf("The encryption parameters failed authentication")
+	}
+	for page := self.ctrl.table; page != 0; {
+		self.pages = append(self.pages, page)
+		blk, err := self.read_page(page)
+		if err != nil {
+			return nil, err
+		}
+		page = int64(blk[0:8].Int64())
+	}
+	return self, nil
+}
+
+func (self *EncryptedFile) write_ctrlblk() error {
+	bytes := self.ctrl.Bytes()
+	self.ctrl.mac = self.sum(0, bytes[:ENC_CONTROLSIZE-ENC_TAGSIZE])
+	return self.file.SetControlData(self.ctrl.Bytes())
+}
+
+// sum is the MAC of the parts of the block at key.
+func (self *EncryptedFile) sum(key int64, parts ...[]byte) bs.ByteSlice {
+	mac := hmac.New(sha256.New, self.mackey)
+	mac.Write(bs.ByteSlice64(uint64(key)))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)[:ENC_TAGSIZE]
+}
+
+func (self *EncryptedFile) Close() error {
+	return self.file.Close()
+}
+
+func (self *EncryptedFile) Remove() error {
+	return self.file.Remove()
+}
+
+func (self *EncryptedFile) Sync() error {
+	if syncer, ok := self.file.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (self *EncryptedFile) BlockSize() uint32 { return self.file.BlockSize() }
+
+func (self *EncryptedFile) ControlData() (data bs.ByteSlice, err error) {
+	blk, err := self.ReadBlock(self.ctrl.userdata)
+	if err != nil {
+		return nil, err
+	}
+	return blk[:self.BlockSize()-CONTROLSIZE], nil
+}
+
+func (self *EncryptedFile) SetControlData(data bs.ByteSlice) (err error) {
+	if len(data) > int(self.BlockSize()-CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	blk := make(bs.ByteSlice, self.BlockSize())
+	copy(blk, data)
+	return self.WriteBlock(self.ctrl.userdata, blk)
+}
+
+func (self *EncryptedFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+func (self *EncryptedFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
+func (self *EncryptedFile) Allocate() (key int64, err error) {
+	if key, err = self.file.Allocate(); err != nil {
+		return 0, err
+	}
+	return key, self.seal_zeros(key, 1)
+}
+
+func (self *EncryptedFile) AllocateBlocks(n int) (key int64, err error) {
+	if key, err = self.file.AllocateBlocks(n); err != nil {
+		return 0, err
+	}
+	return key, self.seal_zeros(key, n)
+}
+
+// new blocks are sealed as zeros so reading one before it is written is told
+// apart from reading one whose table entry was wiped
+func (self *EncryptedFile) seal_zeros(key int64, n int) error {
+	zero := make(bs.ByteSlice, self.BlockSize())
+	for i := 0; i < n; i++ {
+		if err := self.WriteBlock(key+int64(i)*int64(self.BlockSize()), zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The counters of freed blocks are kept so their nonces are not reused when
+// the blocks are allocated again.
+func (self *EncryptedFile) Free(key int64) error {
+	return self.file.Free(key)
+}
+
+// Keys are not remapped so the dead list of the device underneath is used.
+func (self *EncryptedFile) MarkDead(key int64) error { return self.file.MarkDead(key) }
+
+func (self *EncryptedFile) Enter() (epoch int64) { return self.file.Enter() }
+
+func (self *EncryptedFile) Exit(epoch int64) error { return self.file.Exit(epoch) }
+
+func (self *EncryptedFile) Reclaim() error { return self.file.Reclaim() }
+
+// ----------------------------------------------------------------------------
+// the counter and tag table
+
+func (self *EncryptedFile) per_page() int64 {
+	return (int64(self.BlockSize()) - ENC_PAGEHEADER) / ENC_ENTRYSIZE
+}
+
+func (self *EncryptedFile) read_page(page int64) (bs.ByteSlice, error) {
+	blk, err := self.file.ReadBlock(page)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(self.sum(page, blk[0:8], blk[ENC_PAGEHEADER:]), blk[8:ENC_PAGEHEADER]) {
+		return nil, &TamperedBlockError{Key: page}
+	}
+	return blk.Copy(), nil
+}
+
+func (self *EncryptedFile) write_page(page int64, blk bs.ByteSlice) error {
+	copy(blk[8:ENC_PAGEHEADER], self.sum(page, blk[0:8], blk[ENC_PAGEHEADER:]))
+	return self.file.WriteBlock(page, blk)
+}
+
+func (self *EncryptedFile) index(key int64) (int64, error) {
+	blksize := int64(self.BlockSize())
+	if key < blksize || key%blksize != 0 {
+		return 0, fmt.Errorf("Bad block key %d", key)
+	}
+	if key/blksize > math.MaxUint32 {
+		return 0, fmt.Errorf("Block %d is past the last block a nonce can name", key)
+	}
+	return key / blksize, nil
+}
+
+func (self *EncryptedFile) grow(n int64) error {
+	for int64(len(self.pages))*self.per_page() < n {
+		page, err := self.file.Allocate()
+		if err != nil {
+			return err
+		}
+		if err := self.write_page(page, make(bs.ByteSlice, self.BlockSize())); err != nil {
+			return err
+		}
+		if len(self.pages) == 0 {
+			self.ctrl.table = page
+			if err := self.write_ctrlblk(); err != nil {
+				return err
+			}
+		} else {
+			last := self.pages[len(self.pages)-1]
+			blk, err := self.read_page(last)
+			if err != nil {
+				return err
+			}
+			copy(blk[0:8], bs.ByteSlice64(uint64(page)))
+			if err := self.write_page(last, blk); err != nil {
+				return err
+			}
+		}
+		self.pages = append(self.pages, page)
+	}
+	return nil
+}
+
+func (self *EncryptedFile) location(idx int64) (page int64, offset int64) {
+	return self.pages[idx/self.per_page()], ENC_PAGEHEADER + (idx%self.per_page())*ENC_ENTRYSIZE
+}
+
+// entry returns the counter and tag of a block, a block past the end of the
+// table has never been written.
+func (self *EncryptedFile) entry(idx int64) (counter uint64, tag bs.ByteSlice, err error) {
+	if idx >= int64(len(self.pages))*self.per_page() {
+		return 0, nil, nil
+	}
+	page, offset := self.location(idx)
+	blk, err := self.read_page(page)
+	if err != nil {
+		return 0, nil, err
+	}
+	entry := blk[offset : offset+ENC_ENTRYSIZE]
+	return entry[0:8].Int64(), entry[8:].Copy(), nil
+}
+
+func (self *EncryptedFile) set_entry(idx int64, counter uint64, tag bs.ByteSlice) error {
+	if err := self.grow(idx + 1); err != nil {
+		return err
+	}
+	page, offset := self.location(idx)
+	blk, err := self.read_page(page)
+	if err != nil {
+		return err
+	}
+	copy(blk[offset:offset+8], bs.ByteSlice64(counter))
+	copy(blk[offset+8:offset+ENC_ENTRYSIZE], tag)
+	return self.write_page(page, blk)
+}
+
+func nonce(idx int64, counter uint64) []byte {
+	n := make([]byte, ENC_NONCESIZE)
+	copy(n[0:4], bs.ByteSlice32(uint32(idx)))
+	copy(n[4:12], bs.ByteSlice64(counter))
+	return n
+}
+
+// ----------------------------------------------------------------------------
+// reading and writing
+
+func (self *EncryptedFile) WriteBlock(key int64, block bs.ByteSlice) error {
+	if len(block) != int(self.BlockSize()) {
+		return fmt.Errorf("Expected a block of %d bytes got %d", self.BlockSize(), len(block))
+	}
+	idx, err := self.index(key)
+	if err != nil {
+		return err
+	}
+	counter, _, err := self.entry(idx)
+	if err != nil {
+		return err
+	}
+	counter += 1
+	sealed := self.aead.Seal(nil, nonce(idx, counter), block, bs.ByteSlice64(uint64(key)))
+	split := len(sealed) - ENC_TAGSIZE
+	if err := self.set_entry(idx, counter, sealed[split:]); err != nil {
+		return err
+	}
+	return self.file.WriteBlock(key, sealed[:split])
+}
+
+func (self *EncryptedFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	idx, err := self.index(key)
+	if err != nil {
+		return nil, err
+	}
+	counter, tag, err := self.entry(idx)
+	if err != nil {
+		return nil, err
+	}
+	if counter == 0 {
+		// allocated blocks are always sealed, this one's entry is gone
+		return nil, &TamperedBlockError{Key: key}
+	}
+	sealed, err := self.file.ReadBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed = append(sealed.Copy(), tag...)
+	block, err = self.aead.Open(nil, nonce(idx, counter), sealed, bs.ByteSlice64(uint64(key)))
+	if err != nil {
+		return nil, &TamperedBlockError{Key: key}
+	}
+	return block, nil
+}
+
+func (self *EncryptedFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	blksize := int64(self.BlockSize())
+	blocks = make(bs.ByteSlice, int64(n)*blksize)
+	for i := int64(0); i < int64(n); i++ {
+		block, err := self.ReadBlock(key + i*blksize)
+		if err != nil {
+			return nil, err
+		}
+		copy(blocks[i*blksize:(i+1)*blksize], block)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,235 @@
+package file2
+
+import "testing"
+
+import (
+	"bytes"
+)
+
+var enckey = []byte("0123456789abcdef0123456789abcdef")
+
+func testenc(t *testing.T) (*EncryptedFile, *MemBlockFile) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ef, err := NewEncryptedFile(mf, enckey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ef, mf
+}
+
+func reopenenc(t *testing.T, mf *MemBlockFile, key []byte) (*EncryptedFile, *MemBlockFile, error) {
+	mf, err := LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	ef, err := OpenEncryptedFile(mf, key)
+	return ef, mf, err
+}
+
+func TestEncryptedWriteRead(t *testing.T) {
+	ef, mf := testenc(t)
+	secret := []byte("the launch codes are 0000")
+	blk := make([]byte, ef.BlockSize())
+	copy(blk, secret)
+	var keys []int64
+	for i := 0; i < 600; i++ {
+		key, err := ef.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		expect_block(t, ef, key, 0)
+		copy(blk[len(secret):], []byte{byte(i), byte(i >> 8)})
+		if err := ef.WriteBlock(key, blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := mf.ReadBlock(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	before = before.Copy()
+	copy(blk[len(secret):], []byte{0, 0})
+	if err := ef.WriteBlock(keys[0], blk); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := mf.ReadBlock(keys[0]); err != nil {
+		t.Fatal(err)
+	} else if after.Eq(before) {
+		t.Fatal("Expected rewriting a block to use a fresh nonce")
+	}
+	if err := ef.SetControlData(secret); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(mf.Bytes(), secret) {
+		t.Fatal("Found the plaintext in the device")
+	}
+
+	if _, _, err := reopenenc(t, mf, []byte("fedcba9876543210fedcba9876543210")); err == nil {
+		t.Fatal("Expected opening with the wrong key to fail")
+	}
+	ef, mf, err = reopenenc(t, mf, enckey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		copy(blk[len(secret):], []byte{byte(i), byte(i >> 8)})
+		if got, err := ef.ReadBlock(key); err != nil {
+			t.Fatal(err)
+		} else if !got.Eq(blk) {
+			t.Fatalf("Block %d was not as written", key)
+		}
+	}
+	if data, err := ef.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !bytes.HasPrefix(data, secret) {
+		t.Fatal("Expected the control data to survive")
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	ef, mf := testenc(t)
+	A, err := ef.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := ef.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.WriteBlock(A, filled(ef, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.WriteBlock(B, filled(ef, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// flip a bit
+	sealed, err := mf.ReadBlock(A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed = sealed.Copy()
+	sealed[100] ^= 1
+	if err := mf.WriteBlock(A, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ef.ReadBlock(A); err == nil {
+		t.Fatal("Expected a tampered block to fail")
+	} else if _, ok := err.(*TamperedBlockError); !ok {
+		t.Fatalf("Expected a TamperedBlockError got %v", err)
+	}
+	sealed[100] ^= 1
+	if err := mf.WriteBlock(A, sealed); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, ef, A, 1)
+
+	// move a block to another key along with its table entry
+	idxA, _ := ef.index(A)
+	idxB, _ := ef.index(B)
+	counter, tag, err := ef.entry(idxA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.set_entry(idxB, counter, tag); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.WriteBlock(B, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ef.ReadBlock(B); err == nil {
+		t.Fatal("Expected a block copied to another key to fail")
+	}
+}
+
+func TestEncryptedTableTampering(t *testing.T) {
+	ef, mf := testenc(t)
+	var keys []int64
+	for i := int64(0); i < ef.per_page()+10; i++ {
+		key, err := ef.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	A, C := keys[0], keys[len(keys)-1]
+	if err := ef.WriteBlock(A, filled(ef, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ef.pages) < 2 {
+		t.Fatalf("Expected the table to take more than one page got %d", len(ef.pages))
+	}
+	idxA, _ := ef.index(A)
+	first, offset := ef.location(idxA)
+	image := mf.Bytes()
+
+	load := func(tamper func(mf *MemBlockFile)) (*EncryptedFile, error) {
+		mf, err := LoadMemBlockFile(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		tamper(mf)
+		return OpenEncryptedFile(mf, enckey)
+	}
+	zero := func(mf *MemBlockFile, key int64, from, to int64) {
+		blk, err := mf.ReadBlock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk = blk.Copy()
+		copy(blk[from:to], make([]byte, to-from))
+		if err := mf.WriteBlock(key, blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a wiped entry does not read back as zeros, the page it is in fails
+	if _, err := load(func(mf *MemBlockFile) { zero(mf, first, offset, offset+ENC_ENTRYSIZE) }); err == nil {
+		t.Fatal("Expected a table page whose entry was wiped to fail")
+	} else if _, ok := err.(*TamperedBlockError); !ok {
+		t.Fatalf("Expected a TamperedBlockError got %v", err)
+	}
+	// nor does one which passes the page's MAC
+	if err := ef.set_entry(idxA, 0, make([]byte, ENC_TAGSIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ef.ReadBlock(A); err == nil {
+		t.Fatal("Expected a block with a counter of 0 to fail")
+	}
+	// cutting the table short
+	if _, err := load(func(mf *MemBlockFile) { zero(mf, first, 0, 8) }); err == nil {
+		t.Fatal("Expected a table page whose next pointer was wiped to fail")
+	}
+	if _, err := load(func(mf *MemBlockFile) {
+		data, err := mf.ControlData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(data[9:17], make([]byte, 8))
+		if err := mf.SetControlData(data); err != nil {
+			t.Fatal(err)
+		}
+	}); err == nil {
+		t.Fatal("Expected wiping the table pointer to fail")
+	}
+
+	ef, err := load(func(mf *MemBlockFile) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, ef, A, 1)
+	expect_block(t, ef, C, 0)
+}
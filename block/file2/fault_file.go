@@ -0,0 +1,224 @@
+package file2
+
+import (
+	"fmt"
+	"sync"
+)
+
+import buf "file-structures/block/buffers"
+
+var ErrInjected = fmt.Errorf("Injected fault")
+var ErrCrashed = fmt.Errorf("The device has crashed")
+
+/*
+FaultFile is a MemBlockFile whose storage can be told to misbehave, it is for
+testing what a structure leaves behind when the process dies part way through
+an operation. Faults are counted in writes and reads of the underlying storage,
+which includes the control block, checksum and bitmap blocks.
+
+FailWrite and TearWrite crash the device at a write, after which every call
+fails with ErrCrashed. Bytes is the image a process crash leaves behind, every
+write which returned made it to the file. SyncedBytes is the image a power loss
+leaves behind, only the writes covered by a Sync survived. Either image is
+reopened with LoadFaultFile or LoadMemBlockFile. FailRead and RefuseWrite make a
+single read or write fail without crashing the device.
+*/
+type FaultFile struct {
+	*BlockFile
+	disk *fault_storage
+}
+
+type fault_storage struct {
+	lock         sync.Mutex
+	mem          *mem_storage
+	synced       []byte
+	writes       int
+	reads        int
+	fail_write   int
+	tear         bool
+	refuse_write int
+	fail_read    int
+	crashed      bool
+}
+
+func (self *fault_storage) ReadAt(bytes []byte, off int64) (int, error) {
+	self.lock.Lock()
+	if self.crashed {
+		self.lock.Unlock()
+		return 0, ErrCrashed
+	}
+	self.reads += 1
+	if self.reads == self.fail_read {
+		self.lock.Unlock()
+		return 0, ErrInjected
+	}
+	self.lock.Unlock()
+	return self.mem.ReadAt(bytes, off)
+}
+
+func (self *fault_storage) WriteAt(bytes []byte, off int64) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.crashed {
+		return 0, ErrCrashed
+	}
+	self.writes += 1
+	if self.writes == self.refuse_write {
+		return 0, ErrInjected
+	}
+	if self.writes == self.fail_write {
+		self.crashed = true
+		if self.tear {
+			n, _ := self.mem.WriteAt(bytes[:len(bytes)/2], off)
+			return n, ErrInjected
+		}
+		return 0, ErrInjected
+	}
+	return self.mem.WriteAt(bytes, off)
+}
+
+func (self *fault_storage) Truncate(size int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.crashed {
+		return ErrCrashed
+	}
+	return self.mem.Truncate(size)
+}
+
+func (self *fault_storage) Size() (int64, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.crashed {
+		return 0, ErrCrashed
+	}
+	return self.mem.Size()
+}
+
+func (self *fault_storage) Sync() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.crashed {
+		return ErrCrashed
+	}
+	self.synced = self.mem.bytes_copy()
+	return nil
+}
+
+// a crashed device may still be closed so the wrappers around it can be torn
+// down
+func (self *fault_storage) Close() error { return nil }
+
+func (self *mem_storage) bytes_copy() []byte {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	bytes := make([]byte, len(self.bytes))
+	copy(bytes, self.bytes)
+	return bytes
+}
+
+func NewFaultFile() *FaultFile {
+	return NewFaultFileWithFlags(BLOCKSIZE, 0)
+}
+
+func NewFaultFileWithFlags(size uint32, flags uint32) *FaultFile {
+	disk := &fault_storage{mem: &mem_storage{}}
+	self := &FaultFile{
+		BlockFile: NewBlockFileWithFlags("", &buf.NoBuffer{}, size, flags),
+		disk:      disk,
+	}
+	self.opener = func() (storage, error) {
+		if self.disk == nil {
+			return nil, fmt.Errorf("FaultFile has been removed")
+		}
+		return self.disk, nil
+	}
+	return self
+}
+
+// LoadFaultFile makes a FaultFile from an image, the image counts as synced.
+func LoadFaultFile(image []byte) (*FaultFile, error) {
+	size, err := image_blocksize(image)
+	if err != nil {
+		return nil, err
+	}
+	self := NewFaultFileWithFlags(size, 0)
+	self.disk.mem.bytes = make([]byte, len(image))
+	copy(self.disk.mem.bytes, image)
+	self.disk.synced = self.disk.mem.bytes_copy()
+	return self, nil
+}
+
+// FailWrite crashes the device at the n'th write from now, the write does not
+// happen.
+func (self *FaultFile) FailWrite(n int) {
+	self.arm_write(n, false)
+}
+
+// TearWrite crashes the device at the n'th write from now, the first half of
+// the write happens.
+func (self *FaultFile) TearWrite(n int) {
+	self.arm_write(n, true)
+}
+
+func (self *FaultFile) arm_write(n int, tear bool) {
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	self.disk.fail_write = self.disk.writes + n
+	self.disk.tear = tear
+}
+
+// RefuseWrite makes the n'th write from now fail with ErrInjected, the write
+// does not happen but the device carries on.
+func (self *FaultFile) RefuseWrite(n int) {
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	self.disk.refuse_write = self.disk.writes + n
+}
+
+// FailRead makes the n'th read from now fail with ErrInjected.
+func (self *FaultFile) FailRead(n int) {
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	self.disk.fail_read = self.disk.reads + n
+}
+
+// Writes is the number of writes the storage has seen, including the one which
+// crashed it.
+func (self *FaultFile) Writes() int {
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	return self.disk.writes
+}
+
+func (self *FaultFile) Crashed() bool {
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	return self.disk.crashed
+}
+
+func (self *FaultFile) Bytes() []byte {
+	if self.disk == nil {
+		return nil
+	}
+	return self.disk.mem.bytes_copy()
+}
+
+func (self *FaultFile) SyncedBytes() []byte {
+	if self.disk == nil {
+		return nil
+	}
+	self.disk.lock.Lock()
+	defer self.disk.lock.Unlock()
+	bytes := make([]byte, len(self.disk.synced))
+	copy(bytes, self.disk.synced)
+	return bytes
+}
+
+func (self *FaultFile) Remove() error {
+	if self.opened {
+		return fmt.Errorf("Expected file to be closed")
+	}
+	self.disk = nil
+	return nil
+}
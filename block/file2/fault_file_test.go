@@ -0,0 +1,186 @@
+package file2
+
+import "testing"
+
+import (
+	"os"
+)
+
+func loadfault(t *testing.T, image []byte) *FaultFile {
+	ff, err := LoadFaultFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return ff
+}
+
+func TestFaultFile(t *testing.T) {
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	a, err := ff.AllocateBlocks(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, c := a+BLOCKSIZE, a+2*BLOCKSIZE
+	if err := ff.WriteBlock(a, filled(ff, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.WriteBlock(b, filled(ff, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	ff.FailRead(1)
+	if _, err := ff.ReadBlock(a); err != ErrInjected {
+		t.Fatalf("Expected the read to fail got %v", err)
+	}
+	expect_block(t, ff, a, 1)
+
+	ff.TearWrite(1)
+	if err := ff.WriteBlock(c, filled(ff, 3)); err != ErrInjected {
+		t.Fatalf("Expected the write to fail got %v", err)
+	}
+	if !ff.Crashed() {
+		t.Fatal("Expected the device to have crashed")
+	}
+	if _, err := ff.ReadBlock(a); err != ErrCrashed {
+		t.Fatalf("Expected reads to fail after the crash got %v", err)
+	}
+	if err := ff.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := loadfault(t, ff.Bytes())
+	expect_block(t, after, a, 1)
+	expect_block(t, after, b, 2)
+	if blk, err := after.ReadBlock(c); err != nil {
+		t.Fatal(err)
+	} else if !blk[:BLOCKSIZE/2].Eq(filled(ff, 3)[:BLOCKSIZE/2]) || !blk[BLOCKSIZE/2:].Eq(filled(ff, 0)[BLOCKSIZE/2:]) {
+		t.Fatal("Expected only the first half of the torn write to land")
+	}
+
+	synced := loadfault(t, ff.SyncedBytes())
+	expect_block(t, synced, a, 1)
+	expect_block(t, synced, b, 0)
+	expect_block(t, synced, c, 0)
+}
+
+// A power loss while a transaction is applied must not leave the blocks it
+// allocated on the free list once the log has been replayed.
+func TestWALFaultRecover(t *testing.T) {
+	defer os.Remove(WALPATH)
+	openfault := func(image []byte) (*FaultFile, *WALFile) {
+		ff := loadfault(t, image)
+		wf := NewWALFile(ff, WALPATH)
+		if err := wf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return ff, wf
+	}
+
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(WALPATH)
+	wf := NewWALFile(ff, WALPATH)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]int64, 8)
+	for i := range keys {
+		key, err := wf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		if err := wf.WriteBlock(key, filled(wf, byte(i+1))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{2, 5} {
+		if err := wf.Free(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wf.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base := ff.Bytes()
+
+	for n := 1; ; n++ {
+		ff, wf := openfault(base)
+		ff.FailWrite(n)
+		var x, y int64
+		err := func() (err error) {
+			if err := wf.Begin(); err != nil {
+				return err
+			}
+			if x, err = wf.Allocate(); err != nil {
+				return err
+			}
+			if y, err = wf.Allocate(); err != nil {
+				return err
+			}
+			if err := wf.WriteBlock(x, filled(wf, 0xa)); err != nil {
+				return err
+			}
+			if err := wf.WriteBlock(y, filled(wf, 0xb)); err != nil {
+				return err
+			}
+			if err := wf.WriteBlock(keys[0], filled(wf, 0x10)); err != nil {
+				return err
+			}
+			return wf.Commit()
+		}()
+		if err == nil && !ff.Crashed() {
+			break
+		} else if !ff.Crashed() {
+			t.Fatal(err)
+		}
+		wf.Close()
+
+		ff, wf = openfault(ff.SyncedBytes())
+		live := make(map[int64]bool)
+		for i, key := range keys {
+			if i != 2 && i != 5 && i != 0 {
+				expect_block(t, wf, key, byte(i+1))
+				live[key] = true
+			}
+		}
+		live[keys[0]] = true
+		if blk, err := wf.ReadBlock(keys[0]); err != nil {
+			t.Fatal(err)
+		} else if blk.Eq(filled(wf, 0x10)) {
+			expect_block(t, wf, x, 0xa)
+			expect_block(t, wf, y, 0xb)
+			live[x] = true
+			live[y] = true
+		} else {
+			expect_block(t, wf, keys[0], 1)
+		}
+		for i := 0; i < 3; i++ {
+			if key, err := wf.Allocate(); err != nil {
+				t.Fatal(err)
+			} else if live[key] {
+				t.Fatalf("Crash at write %d, Allocate returned the live block %d", n, key)
+			}
+		}
+		if err := wf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package file2
 import (
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
+	"sync"
 )
 
 import buf "file-structures/block/buffers"
@@ -13,19 +15,24 @@ const BLOCKSIZE = 4096
 
 type ctrlblk struct {
 	blksize   uint32
+	flags     uint32
 	free_head uint64
 	free_len  uint32
+	stype     uint32
 	userdata  ByteSlice
 }
 
-const CONTROLSIZE = 20
+const CONTROLSIZE = 32
 
 func (self *ctrlblk) Bytes() []byte {
 	bytes := make([]byte, self.blksize)
-	copy(bytes[4:8], ByteSlice32(self.blksize))
+	copy(bytes[4:8], ByteSlice32(self.blksize|self.flags))
 	copy(bytes[8:16], ByteSlice64(self.free_head))
 	copy(bytes[16:20], ByteSlice32(self.free_len))
-	copy(bytes[20:], self.userdata)
+	copy(bytes[20:24], ByteSlice32(MAGIC))
+	copy(bytes[24:28], ByteSlice32(FORMAT_VERSION))
+	copy(bytes[28:32], ByteSlice32(self.stype))
+	copy(bytes[32:], self.userdata)
 	copy(bytes[0:4], ByteSlice32(crc32.ChecksumIEEE(bytes[4:])))
 	return bytes[:]
 }
@@ -36,27 +43,68 @@ func (self *ctrlblk) Block() []byte {
 	return blk
 }
 
-func load_ctrlblk(bytes []byte) (cb *ctrlblk, err error) {
+func check_ctrlblk(bytes []byte) error {
 	chksum := ByteSlice(bytes[0:4]).Int32()
 	new_chksum := crc32.ChecksumIEEE(bytes[4:])
 	if new_chksum != chksum {
-		return nil, fmt.Errorf("Bad control block checksum %x != %x", new_chksum, chksum)
+		return fmt.Errorf("Bad control block checksum %x != %x, this is not a file2 file or its control block is corrupt",
+			new_chksum, chksum)
+	}
+	return nil
+}
+
+func load_ctrlblk(bytes []byte) (cb *ctrlblk, err error) {
+	if err := check_ctrlblk(bytes); err != nil {
+		return nil, err
+	}
+	if version := ctrlblk_version(bytes); version != FORMAT_VERSION {
+		return nil, fmt.Errorf("Expected format version %d got %d", FORMAT_VERSION, version)
 	}
 	cb = &ctrlblk{
-		blksize:   ByteSlice(bytes[4:8]).Int32(),
+		blksize:   ByteSlice(bytes[4:8]).Int32() &^ FLAGMASK,
+		flags:     ByteSlice(bytes[4:8]).Int32() & FLAGMASK,
 		free_head: ByteSlice(bytes[8:16]).Int64(),
 		free_len:  ByteSlice(bytes[16:20]).Int32(),
-		userdata:  ByteSlice(bytes[20:]),
+		stype:     ByteSlice(bytes[28:32]).Int32(),
+		userdata:  ByteSlice(bytes[32:]),
 	}
 	return cb, nil
 }
 
+type storage interface {
+	ReadAt(bytes []byte, off int64) (int, error)
+	WriteAt(bytes []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Size() (int64, error)
+	Sync() error
+	Close() error
+}
+
+type os_file struct {
+	*os.File
+}
+
+func (self *os_file) Size() (int64, error) {
+	dir, err := self.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return dir.Size(), nil
+}
+
 type BlockFile struct {
-	path   string
-	opened bool
-	buf    buf.Buffer
-	file   *os.File
-	ctrl   ctrlblk
+	path     string
+	opened   bool
+	readonly bool
+	buf      buf.Buffer
+	file     storage
+	opener   func() (storage, error)
+	ctrl     ctrlblk
+	sums     map[int64]ByteSlice
+	slock    sync.Mutex
+	maps     map[int64]ByteSlice
+	hint     int64
+	dead     DeadList
 }
 
 func NewBlockFile(path string, buf buf.Buffer) *BlockFile {
@@ -64,27 +112,79 @@ func NewBlockFile(path string, buf buf.Buffer) *BlockFile {
 }
 
 func NewBlockFileCustomBlockSize(path string, buf buf.Buffer, size uint32) *BlockFile {
+	return NewBlockFileWithFlags(path, buf, size, 0)
+}
+
+func NewBlockFileWithFlags(path string, buf buf.Buffer, size uint32, flags uint32) *BlockFile {
 	if size%4096 != 0 {
 		panic(fmt.Errorf("blocksize must be divisible by 4096"))
 	}
-	return &BlockFile{
+	if flags&^FLAGMASK != 0 {
+		panic(fmt.Errorf("unknown flags %x", flags))
+	}
+	self := &BlockFile{
 		path: path,
 		buf:  buf,
 		ctrl: ctrlblk{
 			blksize:  size,
+			flags:    flags,
 			userdata: make([]byte, size-CONTROLSIZE),
 		},
 	}
+	self.opener = func() (storage, error) {
+		return open_file(path, self.readonly)
+	}
+	return self
+}
+
+func (self *BlockFile) open() error {
+	if f, err := self.opener(); err != nil {
+		return err
+	} else {
+		self.file = f
+		self.opened = true
+		self.sums = make(map[int64]ByteSlice)
+		self.maps = make(map[int64]ByteSlice)
+		self.hint = 1
+	}
+	return nil
 }
 
+// Open opens the file read write, creating it if it is empty. It fails if
+// another process has the file open.
 func (self *BlockFile) Open() error {
+	return self.open_as(false)
+}
+
+// OpenReadOnly opens an existing file which can be read but not changed.
+// Other processes may open it read only at the same time but not read write.
+func (self *BlockFile) OpenReadOnly() error {
+	return self.open_as(true)
+}
+
+func (self *BlockFile) open_as(readonly bool) error {
+	self.readonly = readonly
 	if err := self.open(); err != nil {
 		return err
 	}
+	if err := self.load(); err != nil {
+		// do not keep the file, or its lock, when it can not be used
+		self.file.Close()
+		self.file = nil
+		self.opened = false
+		return err
+	}
+	return nil
+}
+
+func (self *BlockFile) load() error {
 	if size, err := self.Size(); err != nil {
 		return err
 	} else if size == 0 {
-		if _, err := self.Allocate(); err != nil {
+		if self.readonly {
+			return fmt.Errorf("%s is empty, it can not be created read only", self.path)
+		}
+		if _, err := self.alloc(1); err != nil {
 			return err
 		} else {
 			if err := self.write_ctrlblk(); err != nil {
@@ -99,7 +199,14 @@ func (self *BlockFile) Open() error {
 	return nil
 }
 
+func (self *BlockFile) ReadOnly() bool { return self.readonly }
+
 func (self *BlockFile) Close() error {
+	if self.opened {
+		if err := self.dead.ReleaseAll(self.Free); err != nil {
+			return err
+		}
+	}
 	if err := self.file.Close(); err != nil {
 		return err
 	} else {
@@ -109,6 +216,13 @@ func (self *BlockFile) Close() error {
 	return nil
 }
 
+func (self *BlockFile) Sync() error {
+	if !self.opened {
+		return fmt.Errorf("File is not open")
+	}
+	return self.file.Sync()
+}
+
 func (self *BlockFile) Remove() error {
 	if self.opened {
 		return fmt.Errorf("Expected file to be closed")
@@ -121,14 +235,27 @@ func (self *BlockFile) write_ctrlblk() error {
 }
 
 func (self *BlockFile) read_ctrlblk() error {
-	if bytes, err := self.ReadBlock(0); err != nil {
+	bytes, err := self.ReadBlock(0)
+	if err != nil {
+		return err
+	}
+	if err := check_ctrlblk(bytes); err != nil {
+		return err
+	}
+	old := ctrlblk_version(bytes)
+	if old != FORMAT_VERSION && self.readonly {
+		return fmt.Errorf("%s is in format version %d, open it read write to upgrade it", self.path, old)
+	}
+	if bytes, err = self.migrate(bytes); err != nil {
+		return err
+	}
+	if cb, err := load_ctrlblk(bytes); err != nil {
 		return err
 	} else {
-		if cb, err := load_ctrlblk(bytes); err != nil {
-			return err
-		} else {
-			self.ctrl = *cb
-		}
+		self.ctrl = *cb
+	}
+	if old != FORMAT_VERSION {
+		return self.write_ctrlblk()
 	}
 	return nil
 }
@@ -143,6 +270,9 @@ func (self *BlockFile) ControlData() (data ByteSlice, err error) {
 }
 
 func (self *BlockFile) SetControlData(data ByteSlice) (err error) {
+	if err := check_writable(self); err != nil {
+		return err
+	}
 	if len(data) > int(self.ctrl.blksize-CONTROLSIZE) {
 		return fmt.Errorf("control data was too large")
 	}
@@ -151,6 +281,26 @@ func (self *BlockFile) SetControlData(data ByteSlice) (err error) {
 	return self.write_ctrlblk()
 }
 
+// StructureType is the tag of the structure kept in the file, 0 if none has
+// claimed it.
+func (self *BlockFile) StructureType() (uint32, error) {
+	if !self.opened {
+		return 0, fmt.Errorf("File is not open")
+	}
+	return self.ctrl.stype, nil
+}
+
+func (self *BlockFile) SetStructureType(stype uint32) error {
+	if !self.opened {
+		return fmt.Errorf("File is not open")
+	}
+	if err := check_writable(self); err != nil {
+		return err
+	}
+	self.ctrl.stype = stype
+	return self.write_ctrlblk()
+}
+
 func (self *BlockFile) Path() string { return self.path }
 
 func (self *BlockFile) BlockSize() uint32 { return self.ctrl.blksize }
@@ -159,11 +309,11 @@ func (self *BlockFile) Size() (uint64, error) {
 	if !self.opened {
 		return 0, fmt.Errorf("File is not open")
 	}
-	dir, err := os.Stat(self.path)
+	size, err := self.file.Size()
 	if err != nil {
 		return 0, err
 	}
-	return uint64(dir.Size()), nil
+	return uint64(size), nil
 }
 
 func (self *BlockFile) resize(size int64) error {
@@ -171,6 +321,15 @@ func (self *BlockFile) resize(size int64) error {
 }
 
 func (self *BlockFile) Free(pos int64) error {
+	if err := check_writable(self); err != nil {
+		return err
+	}
+	if self.dead.Has(pos) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", pos)
+	}
+	if self.Bitmap() {
+		return self.bitmap_free(pos)
+	}
 	head := ByteSlice64(self.ctrl.free_head)
 	blk := make(ByteSlice, self.ctrl.blksize)
 	copy(blk, head)
@@ -201,17 +360,58 @@ func (self *BlockFile) pop_free() (pos int64, err error) {
 
 func (self *BlockFile) alloc(n int) (pos int64, err error) {
 	var size uint64
-	amt := uint64(self.ctrl.blksize) * uint64(n)
 	if size, err = self.Size(); err != nil {
 		return 0, err
 	}
-	if err := self.resize(int64(size + amt)); err != nil {
+	blksize := int64(self.ctrl.blksize)
+	start := int64(size)
+	pos = start
+	if n > self.max_run() {
+		return 0, fmt.Errorf("Cannot allocate %d contiguous blocks, at most %d fit between reserved blocks",
+			n, self.max_run())
+	}
+	var skipped []int64
+	for {
+		// a run never straddles a reserved block, the blocks skipped in front
+		// of it are put on the free list
+		r, has := self.reserved_in(pos, n)
+		if !has {
+			break
+		}
+		for skip := pos; skip < r; skip += blksize {
+			skipped = append(skipped, skip)
+		}
+		pos = r + blksize
+	}
+	end := pos + int64(n)*blksize
+	if err := self.resize(end); err != nil {
+		return 0, err
+	}
+	if err := self.init_sums(start, end); err != nil {
 		return 0, err
 	}
-	return int64(size), nil
+	if self.Bitmap() {
+		// the skipped blocks are left clear in the bitmap, they are free
+		if err := self.init_bitmaps(start, end); err != nil {
+			return 0, err
+		}
+		return pos, self.set_bits(pos, n, true)
+	}
+	for _, skip := range skipped {
+		if err := self.Free(skip); err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
 }
 
 func (self *BlockFile) Allocate() (pos int64, err error) {
+	if err := check_writable(self); err != nil {
+		return 0, err
+	}
+	if self.Bitmap() {
+		return self.bitmap_alloc(1)
+	}
 	if self.ctrl.free_len == 0 {
 		return self.alloc(1)
 	}
@@ -219,6 +419,12 @@ func (self *BlockFile) Allocate() (pos int64, err error) {
 }
 
 func (self *BlockFile) AllocateBlocks(n int) (pos int64, err error) {
+	if err := check_writable(self); err != nil {
+		return 0, err
+	}
+	if self.Bitmap() {
+		return self.bitmap_alloc(n)
+	}
 	return self.alloc(n)
 }
 
@@ -226,24 +432,36 @@ func (self *BlockFile) WriteBlock(p int64, block ByteSlice) error {
 	if !self.opened {
 		return fmt.Errorf("File is not open")
 	}
+	if err := check_writable(self); err != nil {
+		return err
+	}
+	if err := self.check_reserved(p, len(block)); err != nil {
+		return err
+	}
 	if b, ok := self.buf.Read(p, uint32(len(block))); ok {
 		if ByteSlice(b).Eq(block) {
 			// skip write no change in block from what is in cache
 			return nil
 		}
 	}
-	for pos, err := self.file.Seek(p, 0); pos != p; pos, err = self.file.Seek(p, 0) {
-		if err != nil {
-			return err
-		}
+	if _, err := self.file.WriteAt(block, p); err != nil {
+		return err
 	}
-	if _, err := self.file.Write(block); err != nil {
+	if err := self.write_sums(p, block); err != nil {
 		return err
 	}
 	self.buf.Update(p, block)
 	return nil
 }
 
+func (self *BlockFile) read_at(block []byte, p int64) error {
+	n, err := self.file.ReadAt(block, p)
+	if err == io.EOF && n == len(block) {
+		return nil
+	}
+	return err
+}
+
 func (self *BlockFile) ReadBlock(p int64) (ByteSlice, error) {
 	if !self.opened {
 		return nil, fmt.Errorf("File is not open")
@@ -251,13 +469,14 @@ func (self *BlockFile) ReadBlock(p int64) (ByteSlice, error) {
 	if b, ok := self.buf.Read(p, self.ctrl.blksize); ok {
 		return b, nil
 	}
+	if err := self.check_reserved(p, int(self.ctrl.blksize)); err != nil {
+		return nil, err
+	}
 	block := make([]byte, self.ctrl.blksize)
-	for pos, err := self.file.Seek(p, 0); pos != p; pos, err = self.file.Seek(p, 0) {
-		if err != nil {
-			return nil, err
-		}
+	if err := self.read_at(block, p); err != nil {
+		return nil, err
 	}
-	if _, err := self.file.Read(block); err != nil {
+	if err := self.verify_sums(p, block); err != nil {
 		return nil, err
 	}
 	self.buf.Update(p, block)
@@ -271,13 +490,14 @@ func (self *BlockFile) ReadBlocks(p int64, n int) (ByteSlice, error) {
 	if b, ok := self.buf.Read(p, self.ctrl.blksize); ok {
 		return b, nil
 	}
+	if err := self.check_reserved(p, int(self.ctrl.blksize)*n); err != nil {
+		return nil, err
+	}
 	block := make([]byte, int(self.ctrl.blksize)*n)
-	for pos, err := self.file.Seek(p, 0); pos != p; pos, err = self.file.Seek(p, 0) {
-		if err != nil {
-			return nil, err
-		}
+	if err := self.read_at(block, p); err != nil {
+		return nil, err
 	}
-	if _, err := self.file.Read(block); err != nil {
+	if err := self.verify_sums(p, block); err != nil {
 		return nil, err
 	}
 	self.buf.Update(p, block)
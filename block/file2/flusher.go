@@ -0,0 +1,142 @@
+package file2
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+FlushPolicy says when the background flusher of a LRUCacheFile writes dirty
+pages back to the file under it. Every Interval it writes out the pages which
+have been dirty for longer than MaxAge, and every dirty page once more than
+DirtyRatio of the cache is dirty. A zero MaxAge or DirtyRatio turns that
+threshold off. Whenever the flusher has written something it syncs the file so
+what it wrote survives a power loss.
+*/
+type FlushPolicy struct {
+	DirtyRatio float64
+	MaxAge     time.Duration
+	Interval   time.Duration
+}
+
+// DefaultFlushPolicy bounds what a crash loses to about a second of writes.
+var DefaultFlushPolicy = FlushPolicy{
+	DirtyRatio: .5,
+	MaxAge:     time.Second,
+	Interval:   250 * time.Millisecond,
+}
+
+type flusher struct {
+	policy FlushPolicy
+	stop   chan bool
+	done   chan bool
+	err    error
+}
+
+// StartFlusher starts a goroutine writing back dirty pages according to
+// policy. It runs until StopFlusher or Close, the first error it hits stops it
+// and is returned by the next Sync, StopFlusher or Close.
+func (self *LRUCacheFile) StartFlusher(policy FlushPolicy) error {
+	if policy.Interval <= 0 {
+		return fmt.Errorf("The flush interval must be positive got %v", policy.Interval)
+	}
+	if policy.DirtyRatio < 0 || policy.DirtyRatio > 1 {
+		return fmt.Errorf("The dirty ratio must be between 0 and 1 got %v", policy.DirtyRatio)
+	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	if self.flusher != nil {
+		return fmt.Errorf("The flusher is already running")
+	}
+	self.flusher = &flusher{
+		policy: policy,
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	go self.flush_loop(self.flusher)
+	return nil
+}
+
+// StopFlusher waits for the flusher to finish its current pass and stops it.
+// It does nothing if no flusher is running.
+func (self *LRUCacheFile) StopFlusher() error {
+	self.cache_lock.Lock()
+	f := self.flusher
+	self.flusher = nil
+	self.cache_lock.Unlock()
+	if f == nil {
+		return nil
+	}
+	close(f.stop)
+	<-f.done
+	return f.err
+}
+
+func (self *LRUCacheFile) flush_loop(f *flusher) {
+	defer close(f.done)
+	ticker := time.NewTicker(f.policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := self.flush(f.policy); err != nil {
+				self.cache_lock.Lock()
+				f.err = err
+				self.cache_lock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+func (self *LRUCacheFile) flush(policy FlushPolicy) error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	dirty := self.lru.Dirty()
+	if dirty == 0 {
+		return nil
+	}
+	var err error
+	if policy.DirtyRatio > 0 && float64(dirty) > policy.DirtyRatio*float64(self.lru.Size()+1) {
+		err = self.lru.Flush()
+	} else if policy.MaxAge > 0 {
+		err = self.lru.FlushBefore(time.Now().Add(-policy.MaxAge))
+	}
+	if err != nil {
+		return err
+	}
+	if self.lru.Dirty() == dirty {
+		return nil
+	}
+	return self.sync_file()
+}
+
+// Sync writes every dirty page and the control data to the file under the
+// cache and syncs it, once it returns a crash loses nothing written before
+// it. The pages stay cached.
+func (self *LRUCacheFile) Sync() error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	if self.flusher != nil && self.flusher.err != nil {
+		return self.flusher.err
+	}
+	if err := self.lru.Flush(); err != nil {
+		return err
+	}
+	if read_only(self.file) {
+		return nil
+	}
+	if err := self.file.SetControlData(self.userdata); err != nil {
+		return err
+	}
+	return self.sync_file()
+}
+
+func (self *LRUCacheFile) sync_file() error {
+	if syncer, ok := self.file.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
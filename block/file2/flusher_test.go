@@ -0,0 +1,184 @@
+package file2
+
+import "testing"
+
+import (
+	"time"
+)
+
+// eventually polls cond until it holds or a second has passed.
+func eventually(t *testing.T, what string, cond func() bool) {
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected %s", what)
+		}
+	}
+}
+
+// written checks the block made it into the image a power loss leaves behind.
+func written(t *testing.T, ff *FaultFile, key int64, b byte) bool {
+	image := loadfault(t, ff.SyncedBytes())
+	blk, err := image.ReadBlock(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blk.Eq(filled(image, b))
+}
+
+func TestFlusherAge(t *testing.T) {
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewLRUCacheFile(ff, 64*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.StartFlusher(FlushPolicy{MaxAge: 20 * time.Millisecond, Interval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.StartFlusher(DefaultFlushPolicy); err == nil {
+		t.Fatal("Expected starting a second flusher to fail")
+	}
+	A, err := cf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.WriteBlock(A, filled(cf, 1)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the flusher to write out the old page", func() bool {
+		return cf.Stats().PageOuts == 1
+	})
+	// stopping waits for the pass which wrote the page to sync it
+	if err := cf.StopFlusher(); err != nil {
+		t.Fatal(err)
+	}
+	if !written(t, ff, A, 1) {
+		t.Fatal("Expected the flusher to sync the page")
+	}
+	if stats := cf.Stats(); stats.Evictions != 0 {
+		t.Fatalf("Expected the page to stay cached got %+v", stats)
+	}
+	expect_block(t, cf, A, 1)
+	if err := cf.StopFlusher(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlusherDirtyRatio(t *testing.T) {
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewLRUCacheFile(ff, 9*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.StartFlusher(FlushPolicy{DirtyRatio: .5, Interval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	var keys []int64
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			key, err := cf.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := cf.WriteBlock(key, filled(cf, 2)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(3)
+	time.Sleep(20 * time.Millisecond)
+	if stats := cf.Stats(); stats.PageOuts != 0 {
+		t.Fatalf("Expected a mostly clean cache to be left alone got %+v", stats)
+	}
+	write(3)
+	eventually(t, "the flusher to write out every dirty page", func() bool {
+		return cf.Stats().PageOuts == 6
+	})
+	if err := cf.StopFlusher(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if !written(t, ff, key, 2) {
+			t.Fatalf("Expected block %d to be synced", key)
+		}
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlusherError(t *testing.T) {
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewLRUCacheFile(ff, 64*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	A, err := cf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.StartFlusher(FlushPolicy{MaxAge: time.Nanosecond, Interval: time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	ff.FailWrite(1)
+	if err := cf.WriteBlock(A, filled(cf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the flusher to hit the fault", ff.Crashed)
+	if err := cf.StopFlusher(); err != ErrInjected {
+		t.Fatalf("Expected the flusher to report the injected fault got %v", err)
+	}
+	if err := cf.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLRUSync(t *testing.T) {
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewLRUCacheFile(ff, 64*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	A, err := cf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.WriteBlock(A, filled(cf, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.SetControlData(filled(cf, 5)[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.WriteBlock(A, filled(cf, 6)); err != nil {
+		t.Fatal(err)
+	}
+	image := loadfault(t, ff.SyncedBytes())
+	expect_block(t, image, A, 4)
+	if data, err := image.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data[:10].Eq(filled(cf, 5)[:10]) {
+		t.Fatal("Expected Sync to write the control data")
+	}
+	if stats := cf.Stats(); stats.Evictions != 0 {
+		t.Fatalf("Expected the pages to stay cached got %+v", stats)
+	}
+	expect_block(t, cf, A, 6)
+}
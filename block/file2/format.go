@@ -0,0 +1,191 @@
+package file2
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync"
+)
+
+import bs "file-structures/block/byteslice"
+
+/*
+The control block of a file2 file starts with its checksum, block size, flags
+and free list, followed by MAGIC, the FORMAT_VERSION it was written in and the
+tag of the structure kept in the file. The rest of the block is the control
+data of that structure.
+
+Files written before the magic was introduced are version 0. Version 2 lets a
+varchar keep its slack, the bytes it took from the free list past its length,
+in the top byte of its length word, which older versions read as part of the
+length. Open upgrades an older file in place by running the registered
+migrations one version at a time and refuses files written by a newer version.
+*/
+const MAGIC = 0x66326266 // "f2bf"
+const FORMAT_VERSION = 2
+
+// A Migration upgrades the control block of a file from one format version to
+// the next. It may rewrite any block of the file, the control block it returns
+// is checked and written back by Open.
+type Migration func(file *BlockFile, ctrl []byte) ([]byte, error)
+
+var migrations = map[uint32]Migration{
+	0: migrate_v0,
+	1: migrate_v1,
+}
+var migrations_lock sync.Mutex
+
+// RegisterMigration sets the migration which upgrades files from version from
+// to version from+1.
+func RegisterMigration(from uint32, m Migration) {
+	migrations_lock.Lock()
+	defer migrations_lock.Unlock()
+	migrations[from] = m
+}
+
+func ctrlblk_version(bytes []byte) uint32 {
+	if bs.ByteSlice(bytes[20:24]).Int32() != MAGIC {
+		return 0
+	}
+	return bs.ByteSlice(bytes[24:28]).Int32()
+}
+
+func (self *BlockFile) migrate(bytes []byte) ([]byte, error) {
+	for version := ctrlblk_version(bytes); version != FORMAT_VERSION; {
+		if version > FORMAT_VERSION {
+			return nil, fmt.Errorf("%s was written in format version %d, this version only reads up to %d",
+				self.path, version, FORMAT_VERSION)
+		}
+		migrations_lock.Lock()
+		m, has := migrations[version]
+		migrations_lock.Unlock()
+		if !has {
+			return nil, fmt.Errorf("%s is in format version %d and there is no migration from it", self.path, version)
+		}
+		var err error
+		if bytes, err = m(self, bytes); err != nil {
+			return nil, err
+		}
+		if err := check_ctrlblk(bytes); err != nil {
+			return nil, err
+		}
+		next := ctrlblk_version(bytes)
+		if next != version+1 {
+			return nil, fmt.Errorf("The migration from format version %d produced version %d", version, next)
+		}
+		version = next
+	}
+	return bytes, nil
+}
+
+// migrate_v0 moves the control data up to make room for the magic, version and
+// structure type. Files whose control data used the bytes that no longer fit
+// can not be upgraded.
+func migrate_v0(file *BlockFile, bytes []byte) ([]byte, error) {
+	const V0_CONTROLSIZE = 20
+	for _, b := range bytes[len(bytes)-(CONTROLSIZE-V0_CONTROLSIZE):] {
+		if b != 0 {
+			return nil, fmt.Errorf("The control data of %s is too large to upgrade from format version 0", file.path)
+		}
+	}
+	cb := &ctrlblk{
+		blksize:   bs.ByteSlice(bytes[4:8]).Int32() &^ FLAGMASK,
+		flags:     bs.ByteSlice(bytes[4:8]).Int32() & FLAGMASK,
+		free_head: bs.ByteSlice(bytes[8:16]).Int64(),
+		free_len:  bs.ByteSlice(bytes[16:20]).Int32(),
+		userdata:  bs.ByteSlice(bytes[V0_CONTROLSIZE : len(bytes)-(CONTROLSIZE-V0_CONTROLSIZE)]),
+	}
+	return with_version(cb.Bytes(), 1), nil
+}
+
+// migrate_v1 only changes the version, the varchars of version 1 files have no
+// slack and their length words read the same in version 2.
+func migrate_v1(file *BlockFile, bytes []byte) ([]byte, error) {
+	return with_version(bytes, 2), nil
+}
+
+// with_version stamps a control block with version and sums it again.
+func with_version(bytes []byte, version uint32) []byte {
+	bytes = bs.ByteSlice(bytes).Copy()
+	copy(bytes[24:28], bs.ByteSlice32(version))
+	copy(bytes[0:4], bs.ByteSlice32(crc32.ChecksumIEEE(bytes[4:])))
+	return bytes
+}
+
+// Tag packs a name of up to four bytes, such as "LINH", into a structure type.
+func Tag(name string) uint32 {
+	var tag [4]byte
+	copy(tag[:], name)
+	return bs.ByteSlice(tag[:]).Int32()
+}
+
+func TagName(stype uint32) string {
+	if stype == 0 {
+		return "untagged"
+	}
+	return fmt.Sprintf("%q", string(bs.ByteSlice32(stype)))
+}
+
+// CheckStructureType makes sure the device holds a structure of type stype,
+// devices nothing has claimed yet pass.
+func CheckStructureType(file RootController, stype uint32) error {
+	got, err := file.StructureType()
+	if err != nil {
+		return err
+	}
+	if got != 0 && got != stype {
+		return fmt.Errorf("The file holds a %s structure, not a %s one", TagName(got), TagName(stype))
+	}
+	return nil
+}
+
+/*
+AdoptBlockFile makes a file written by the old block/file code into a file2
+file of blksize byte blocks. Those files kept their control data in their first
+block and have no control block for a migration to start from. convert is given
+the first block and returns the control data of the structure, which is tagged
+stype. The control block takes the place of the first block in one write and
+the other blocks keep their positions.
+*/
+func AdoptBlockFile(path string, blksize uint32, stype uint32, convert func(first bs.ByteSlice) (bs.ByteSlice, error)) error {
+	if blksize%4096 != 0 {
+		return fmt.Errorf("blocksize must be divisible by 4096")
+	}
+	f, err := open_file(path, false)
+	if err != nil {
+		return err
+	}
+	if err := adopt(f, path, blksize, stype, convert); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func adopt(f storage, path string, blksize uint32, stype uint32, convert func(first bs.ByteSlice) (bs.ByteSlice, error)) error {
+	size, err := f.Size()
+	if err != nil {
+		return err
+	}
+	if size == 0 || size%int64(blksize) != 0 {
+		return fmt.Errorf("%s is %d bytes, not a whole number of %d byte blocks", path, size, blksize)
+	}
+	first := make(bs.ByteSlice, blksize)
+	if _, err := f.ReadAt(first, 0); err != nil {
+		return err
+	}
+	if check_ctrlblk(first) == nil {
+		return fmt.Errorf("%s is already a file2 file", path)
+	}
+	data, err := convert(first)
+	if err != nil {
+		return err
+	}
+	if len(data) > int(blksize-CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	cb := &ctrlblk{blksize: blksize, stype: stype, userdata: data}
+	if _, err := f.WriteAt(cb.Block(), 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
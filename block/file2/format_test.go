@@ -0,0 +1,237 @@
+package file2
+
+import "testing"
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+import (
+	buf "../buffers"
+	bs "file-structures/block/byteslice"
+)
+
+// v0image rewrites the control block of a file in the layout used before the
+// format was versioned.
+func v0image(t *testing.T, mf *MemBlockFile) []byte {
+	image := mf.Bytes()
+	data, err := mf.ControlData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := image[:BLOCKSIZE]
+	copy(ctrl[20:], make([]byte, BLOCKSIZE-20))
+	copy(ctrl[20:], data)
+	copy(ctrl[0:4], bs.ByteSlice32(crc32.ChecksumIEEE(ctrl[4:])))
+	return image
+}
+
+func resum(image []byte) {
+	copy(image[0:4], bs.ByteSlice32(crc32.ChecksumIEEE(image[4:BLOCKSIZE])))
+}
+
+func TestFormatVersion(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	image := bs.ByteSlice(mf.Bytes())
+	if image[20:24].Int32() != MAGIC || image[24:28].Int32() != FORMAT_VERSION {
+		t.Fatal("Expected the control block to carry the magic and version")
+	}
+	if stype, err := mf.StructureType(); err != nil || stype != 0 {
+		t.Fatalf("Expected a new file to be untagged got %d %v", stype, err)
+	}
+	// the tags already written to files must not change
+	if Tag("LINH") != 0x4c494e48 || CATALOG_TYPE != 0x43544c47 {
+		t.Fatalf("Expected Tag to pack the name big endian got %x", Tag("LINH"))
+	}
+	if err := mf.SetStructureType(Tag("TEST")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckStructureType(mf, Tag("TEST")); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckStructureType(mf, Tag("LINH")); err == nil || !strings.Contains(err.Error(), `"TEST"`) {
+		t.Fatalf("Expected a descriptive error got %v", err)
+	}
+
+	reopened, err := LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if stype, err := reopened.StructureType(); err != nil || stype != Tag("TEST") {
+		t.Fatalf("Expected the tag to survive a reopen got %s %v", TagName(stype), err)
+	}
+
+	newer := mf.Bytes()
+	copy(newer[24:28], bs.ByteSlice32(FORMAT_VERSION+1))
+	resum(newer)
+	if future, err := LoadMemBlockFile(newer); err != nil {
+		t.Fatal(err)
+	} else if err := future.Open(); err == nil || !strings.Contains(err.Error(), "format version") {
+		t.Fatalf("Expected a file from a newer version to be refused got %v", err)
+	}
+}
+
+func TestMigrateV0(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	A, err := mf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.WriteBlock(A, filled(mf, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.SetControlData(filled(mf, 2)[:100]); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	RegisterMigration(0, func(file *BlockFile, ctrl []byte) ([]byte, error) {
+		calls++
+		return migrate_v0(file, ctrl)
+	})
+	defer RegisterMigration(0, migrate_v0)
+
+	old, err := LoadMemBlockFile(v0image(t, mf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected the migration hook to run once got %d", calls)
+	}
+	if data, err := old.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data[:100].Eq(filled(mf, 2)[:100]) || !data[100:].Eq(make(bs.ByteSlice, len(data)-100)) {
+		t.Fatal("Expected the control data to survive the upgrade")
+	}
+	expect_block(t, old, A, 1)
+	if image := bs.ByteSlice(old.Bytes()); image[24:28].Int32() != FORMAT_VERSION {
+		t.Fatal("Expected the upgraded control block to be written back")
+	}
+
+	// control data running into the bytes the header took over can not move
+	full := v0image(t, mf)
+	full[BLOCKSIZE-1] = 0xff
+	resum(full)
+	if tight, err := LoadMemBlockFile(full); err != nil {
+		t.Fatal(err)
+	} else if err := tight.Open(); err == nil {
+		t.Fatal("Expected the upgrade to refuse control data which does not fit")
+	}
+}
+
+func TestMigrateV1(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	A, err := mf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.WriteBlock(A, filled(mf, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.SetControlData(filled(mf, 2)[:100]); err != nil {
+		t.Fatal(err)
+	}
+	image := mf.Bytes()
+	copy(image[24:28], bs.ByteSlice32(1))
+	resum(image)
+
+	if old, err := LoadMemBlockFile(image); err != nil {
+		t.Fatal(err)
+	} else if err := old.OpenReadOnly(); err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Fatalf("Expected a version 1 file to need upgrading got %v", err)
+	}
+	old, err := LoadMemBlockFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := old.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data[:100].Eq(filled(mf, 2)[:100]) {
+		t.Fatal("Expected the control data to survive the upgrade")
+	}
+	expect_block(t, old, A, 1)
+	if image := bs.ByteSlice(old.Bytes()); image[24:28].Int32() != 2 {
+		t.Fatal("Expected the upgraded control block to be written back")
+	}
+}
+
+func TestOpenForeignFile(t *testing.T) {
+	path := PATH + "_foreign"
+	defer os.Remove(path)
+	// a block of the old block/file format holds no control block
+	if err := ioutil.WriteFile(path, []byte(strings.Repeat("btree node", BLOCKSIZE/10+1))[:BLOCKSIZE], 0666); err != nil {
+		t.Fatal(err)
+	}
+	f := NewBlockFile(path, &buf.NoBuffer{})
+	if err := f.Open(); err == nil || !strings.Contains(err.Error(), "not a file2 file") {
+		t.Fatalf("Expected a file without a control block to be refused got %v", err)
+	}
+}
+
+func TestAdoptBlockFile(t *testing.T) {
+	path := PATH + "_adopt"
+	defer os.Remove(path)
+	image := make([]byte, 3*BLOCKSIZE)
+	copy(image, "old control data")
+	copy(image[BLOCKSIZE:], "a block")
+	if err := ioutil.WriteFile(path, image[:BLOCKSIZE+10], 0666); err != nil {
+		t.Fatal(err)
+	}
+	convert := func(first bs.ByteSlice) (bs.ByteSlice, error) {
+		return first[:16], nil
+	}
+	if err := AdoptBlockFile(path, BLOCKSIZE, Tag("TEST"), convert); err == nil {
+		t.Fatal("Expected a file of part of a block to be refused")
+	}
+	if err := ioutil.WriteFile(path, image, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := AdoptBlockFile(path, BLOCKSIZE, Tag("TEST"), convert); err != nil {
+		t.Fatal(err)
+	}
+
+	f := NewBlockFile(path, &buf.NoBuffer{})
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if stype, err := f.StructureType(); err != nil || stype != Tag("TEST") {
+		t.Fatalf("Expected the structure type to be set got %v, %v", TagName(stype), err)
+	}
+	if data, err := f.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if string(data[:16]) != "old control data" {
+		t.Fatalf("Expected the converted control data got %q", data[:16])
+	}
+	if block, err := f.ReadBlock(BLOCKSIZE); err != nil {
+		t.Fatal(err)
+	} else if string(block[:7]) != "a block" {
+		t.Fatal("Expected the other blocks to keep their positions")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := AdoptBlockFile(path, BLOCKSIZE, Tag("TEST"), convert); err == nil {
+		t.Fatal("Expected a file2 file to be refused")
+	}
+}
@@ -26,14 +26,34 @@ type BlockReadWriter interface {
 
 type BlockAllocator interface {
 	Free(key int64) error
+	MarkDead(key int64) error
 	Allocate() (key int64, err error)
 	AllocateBlocks(n int) (key int64, err error)
 }
 
+type Reclaimer interface {
+	Enter() (epoch int64)
+	Exit(epoch int64) error
+	Reclaim() error
+}
+
 type Closer interface {
 	Close() error
 }
 
+type Pinner interface {
+	Pin(key int64) error
+	Unpin(key int64) error
+}
+
+type Syncer interface {
+	Sync() error
+}
+
+type ReadOnlyer interface {
+	ReadOnly() bool
+}
+
 type Removable interface {
 	Remove() error
 }
@@ -41,11 +61,14 @@ type Removable interface {
 type RootController interface {
 	ControlData() (block ByteSlice, err error)
 	SetControlData(block ByteSlice) (err error)
+	StructureType() (stype uint32, err error)
+	SetStructureType(stype uint32) error
 }
 
 type BlockDevice interface {
 	BlockReadWriter
 	BlockAllocator
+	Reclaimer
 	Closer
 	RootController
 }
@@ -10,7 +10,10 @@ import bs "file-structures/block/byteslice"
 const MIN_HEAP = true
 const MAX_HEAP = false
 
+// LFUCacheFile keeps the most often read blocks in memory, it does not read
+// ahead.
 type LFUCacheFile struct {
+	counters
 	file       RemovableBlockDevice
 	cache      map[int64]bs.ByteSlice
 	cache_size int
@@ -19,7 +22,9 @@ type LFUCacheFile struct {
 	disk_keys  *priorityQueue
 	nextkey    int64
 	free_keys  []int64
+	pinned     map[int64]int
 	userdata   []byte
+	dead       DeadList
 }
 
 func NewLFUCacheFile(file RemovableBlockDevice, size uint64) (cf *LFUCacheFile, err error) {
@@ -36,12 +41,19 @@ func NewLFUCacheFile(file RemovableBlockDevice, size uint64) (cf *LFUCacheFile,
 		disk_keys:  newPriorityQueue(cache_size, MAX_HEAP),
 		nextkey:    int64(file.BlockSize()),
 		free_keys:  make([]int64, 0, 100),
+		pinned:     make(map[int64]int),
 		userdata:   make([]byte, file.BlockSize()-CONTROLSIZE),
 	}
+	// pinned pages sort behind every other page in the cache so they are
+	// never the ones paged out
+	cf.cache_keys.pinned = cf.pinned
 	return cf, nil
 }
 
 func (self *LFUCacheFile) Close() error {
+	if err := self.dead.ReleaseAll(self.Free); err != nil {
+		return err
+	}
 	if err := self.file.Close(); err != nil {
 		return err
 	}
@@ -59,6 +71,9 @@ func (self *LFUCacheFile) ControlData() (data bs.ByteSlice, err error) {
 }
 
 func (self *LFUCacheFile) SetControlData(data bs.ByteSlice) (err error) {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
 	if len(data) > int(self.file.BlockSize()-CONTROLSIZE) {
 		return fmt.Errorf("control data was too large")
 	}
@@ -67,9 +82,28 @@ func (self *LFUCacheFile) SetControlData(data bs.ByteSlice) (err error) {
 	return nil
 }
 
+func (self *LFUCacheFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+func (self *LFUCacheFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
 func (self *LFUCacheFile) BlockSize() uint32 { return self.file.BlockSize() }
 
+func (self *LFUCacheFile) ReadOnly() bool { return read_only(self.file) }
+
 func (self *LFUCacheFile) Free(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	if self.pinned[key] > 0 {
+		return fmt.Errorf("Cannot free pinned block %d", key)
+	}
 	disk_has := self.disk_keys.HasKey(key)
 	cache_has := self.cache_keys.HasKey(key)
 	if disk_has && cache_has {
@@ -86,10 +120,81 @@ func (self *LFUCacheFile) Free(key int64) error {
 		return fmt.Errorf("Unknown key!")
 	}
 	self.free_keys = append(self.free_keys, key)
+	self.count(func(stats *Stats) { stats.Frees += 1 })
+	return self.balance()
+}
+
+// MarkDead keeps the block readable, it is freed by the first Reclaim after
+// every reader that might still reach it has exited.
+func (self *LFUCacheFile) MarkDead(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	return self.dead.Mark(key)
+}
+
+func (self *LFUCacheFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *LFUCacheFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *LFUCacheFile) Reclaim() error {
+	return self.dead.Reclaim(self.Free)
+}
+
+// Pin keeps the block in the cache until it has been unpinned as many times as
+// it was pinned.
+func (self *LFUCacheFile) Pin(key int64) error {
+	if self.pinned[key] > 0 {
+		self.pinned[key] += 1
+		return nil
+	}
+	var count int
+	var err error
+	if self.cache_keys.HasKey(key) {
+		if count, err = self.cache_keys.GetCount(key); err != nil {
+			return err
+		}
+	} else if self.disk_keys.HasKey(key) {
+		if len(self.pinned)+1 >= self.cache_size {
+			return ErrCacheFull
+		}
+		var block bs.ByteSlice
+		if block, count, err = self.readFile(key); err != nil {
+			return err
+		}
+		self.writeCache(key, count, block)
+		if err := self.removeFile(key); err != nil {
+			return err
+		}
+	} else {
+		return fmt.Errorf("Unknown key! %d", key)
+	}
+	self.pinned[key] = 1
+	self.cache_keys.Update(key, count)
+	return self.balance()
+}
+
+func (self *LFUCacheFile) Unpin(key int64) error {
+	if self.pinned[key] <= 0 {
+		return fmt.Errorf("Block %d is not pinned", key)
+	}
+	self.pinned[key] -= 1
+	if self.pinned[key] > 0 {
+		return nil
+	}
+	delete(self.pinned, key)
+	count, err := self.cache_keys.GetCount(key)
+	if err != nil {
+		return err
+	}
+	self.cache_keys.Update(key, count)
 	return self.balance()
 }
 
 func (self *LFUCacheFile) Allocate() (key int64, err error) {
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
 	if len(self.free_keys) > 0 {
 		key = self.free_keys[len(self.free_keys)-1]
 		self.free_keys = self.free_keys[:len(self.free_keys)-1]
@@ -97,12 +202,17 @@ func (self *LFUCacheFile) Allocate() (key int64, err error) {
 		key = self.nextkey
 		self.nextkey += int64(self.file.BlockSize())
 	}
+	self.count(func(stats *Stats) { stats.Allocations += 1 })
 	return key, self.WriteBlock(key, make(bs.ByteSlice, self.file.BlockSize()))
 }
 
 func (self *LFUCacheFile) AllocateBlocks(n int) (key int64, err error) {
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
 	key = self.nextkey
 	self.nextkey += int64(self.file.BlockSize()) * int64(n)
+	self.count(func(stats *Stats) { stats.Allocations += int64(n) })
 	for i := 0; i < n; i++ {
 		ckey := key + int64(self.file.BlockSize())*int64(i)
 		err = self.WriteBlock(ckey, make(bs.ByteSlice, self.file.BlockSize()))
@@ -186,10 +296,17 @@ func (self *LFUCacheFile) balance() error {
 		if item == nil {
 			return -1
 		}
+		if h.pinned[item.p] > 0 {
+			// only pinned pages are left, nothing can be swapped out
+			return int(^uint(0) >> 1)
+		}
 		return item.count
 	}
 	cache_to_disk := func() error {
 		key := self.cache_keys.Peek().p
+		if self.pinned[key] > 0 {
+			return ErrCacheFull
+		}
 		block, count, err := self.readCache(key)
 		if err != nil {
 			return err
@@ -200,6 +317,10 @@ func (self *LFUCacheFile) balance() error {
 		if err := self.removeCache(key); err != nil {
 			return err
 		}
+		self.count(func(stats *Stats) {
+			stats.Evictions += 1
+			stats.PageOuts += 1
+		})
 		return nil
 	}
 	disk_to_cache := func() error {
@@ -243,6 +364,10 @@ func (self *LFUCacheFile) balance() error {
 }
 
 func (self *LFUCacheFile) WriteBlock(key int64, block bs.ByteSlice) (err error) {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	self.write(len(block))
 	disk_has := self.disk_keys.HasKey(key)
 	cache_has := self.cache_keys.HasKey(key)
 	if disk_has && cache_has {
@@ -300,6 +425,8 @@ func (self *LFUCacheFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
 	} else {
 		return nil, fmt.Errorf("Unknown key! %d", key)
 	}
+	self.lookup(cache_has)
+	self.read(len(block))
 	return block, self.balance()
 }
 
@@ -322,6 +449,7 @@ type priorityQueue struct {
 	slice   []*priorityQueueItem
 	indices map[int64]int
 	min     bool
+	pinned  map[int64]int
 }
 
 type priorityQueueItem struct {
@@ -344,6 +472,9 @@ func (self *priorityQueue) Size() int { return cap(self.slice) }
 func (self *priorityQueue) Len() int { return len(self.slice) }
 
 func (self *priorityQueue) Less(i, j int) bool {
+	if ipin, jpin := self.pinned[self.slice[i].p] > 0, self.pinned[self.slice[j].p] > 0; ipin != jpin {
+		return jpin
+	}
 	if self.min == MIN_HEAP {
 		return self.slice[i].count < self.slice[j].count
 	} else { // max heap
@@ -0,0 +1,49 @@
+package file2
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrReadOnly is returned by the calls which would change a device opened with
+// OpenReadOnly.
+var ErrReadOnly = fmt.Errorf("The file is open read only")
+
+/*
+lock_file takes an advisory flock on f so two processes can not have the same
+file open and corrupt it. Opening read write takes the lock exclusively while
+read only opens share it, so any number of readers can inspect a file no one is
+writing. The lock goes when the file is closed.
+*/
+func lock_file(f *os.File, readonly bool) error {
+	how := syscall.LOCK_EX
+	if readonly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return fmt.Errorf("%s is locked by another process", f.Name())
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func open_flag(readonly bool) int {
+	if readonly {
+		return READONLYFLAG
+	}
+	return OPENFLAG
+}
+
+func read_only(file interface{}) bool {
+	ro, ok := file.(ReadOnlyer)
+	return ok && ro.ReadOnly()
+}
+
+func check_writable(file interface{}) error {
+	if read_only(file) {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package file2
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	buf "../buffers"
+)
+
+const LOCKPATH = "/tmp/__x_lock"
+
+func TestLock(t *testing.T) {
+	defer cleanup(LOCKPATH)
+	f := NewBlockFile(LOCKPATH, &buf.NoBuffer{})
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewBlockFile(LOCKPATH, &buf.NoBuffer{}).Open(); err == nil {
+		t.Fatal("Expected a second read write open to be refused")
+	}
+	if err := NewBlockFile(LOCKPATH, &buf.NoBuffer{}).OpenReadOnly(); err == nil {
+		t.Fatal("Expected a read only open of a file open read write to be refused")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r1 := NewBlockFile(LOCKPATH, &buf.NoBuffer{})
+	if err := r1.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	r2 := NewBlockFile(LOCKPATH, &buf.NoBuffer{})
+	if err := r2.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Open(); err == nil {
+		t.Fatal("Expected a read write open of a file open read only to be refused")
+	}
+	for _, r := range []*BlockFile{r1, r2} {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup(LOCKPATH)
+	if err := NewBlockFile(LOCKPATH, &buf.NoBuffer{}).OpenReadOnly(); err == nil {
+		t.Fatal("Expected a missing file not to be created read only")
+	}
+	if _, err := os.Stat(LOCKPATH); !os.IsNotExist(err) {
+		t.Fatal("Expected OpenReadOnly to leave the file missing")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	defer cleanup(LOCKPATH)
+	f := NewBlockFile(LOCKPATH, &buf.NoBuffer{})
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := f.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteBlock(key, filled(f, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetControlData(filled(f, 5)[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	lru, err := OpenLRUCacheFile(f, CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lfu, err := NewLFUCacheFile(f, CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoq, err := OpenTwoQCacheFile(f, CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, dev := range map[string]BlockDevice{"file": f, "lru": lru, "lfu": lfu, "2q": twoq} {
+		if !read_only(dev) {
+			t.Fatalf("Expected %s to be read only", name)
+		}
+		if err := dev.WriteBlock(key, filled(f, 4)); err != ErrReadOnly {
+			t.Fatalf("Expected %s WriteBlock to be refused got %v", name, err)
+		}
+		if _, err := dev.Allocate(); err != ErrReadOnly {
+			t.Fatalf("Expected %s Allocate to be refused got %v", name, err)
+		}
+		if _, err := dev.AllocateBlocks(2); err != ErrReadOnly {
+			t.Fatalf("Expected %s AllocateBlocks to be refused got %v", name, err)
+		}
+		if err := dev.Free(key); err != ErrReadOnly {
+			t.Fatalf("Expected %s Free to be refused got %v", name, err)
+		}
+		if err := dev.MarkDead(key); err != ErrReadOnly {
+			t.Fatalf("Expected %s MarkDead to be refused got %v", name, err)
+		}
+		if err := dev.SetControlData(filled(f, 6)[:10]); err != ErrReadOnly {
+			t.Fatalf("Expected %s SetControlData to be refused got %v", name, err)
+		}
+	}
+	for name, dev := range map[string]BlockDevice{"file": f, "lru": lru, "2q": twoq} {
+		expect_block(t, dev, key, 3)
+		if data, err := dev.ControlData(); err != nil {
+			t.Fatal(err)
+		} else if !data[:10].Eq(filled(f, 5)[:10]) {
+			t.Fatalf("Expected %s to read the control data", name)
+		}
+	}
+	if err := lru.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := twoq.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lru.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockSegments(t *testing.T) {
+	os.RemoveAll(SEGPATH)
+	defer os.RemoveAll(SEGPATH)
+	f := testsegments(t, SEGSIZE)
+	if err := NewSegmentedFileWithFlags(SEGPATH, &buf.NoBuffer{}, BLOCKSIZE, SEGSIZE, 0).OpenReadOnly(); err == nil {
+		t.Fatal("Expected the segments to be locked")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := NewSegmentedFileWithFlags(SEGPATH, &buf.NoBuffer{}, BLOCKSIZE, SEGSIZE, 0)
+	if err := r.OpenReadOnly(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Allocate(); err != ErrReadOnly {
+		t.Fatalf("Expected Allocate to be refused got %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove(); err != nil {
+		t.Fatal(err)
+	}
+}
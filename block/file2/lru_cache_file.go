@@ -3,23 +3,42 @@ package file2
 import (
 	"container/list"
 	"fmt"
+	"sync"
+	"time"
 )
 
 import bs "file-structures/block/byteslice"
 
+var ErrCacheFull = fmt.Errorf("The cache is full and every page in it is pinned")
+
 type lru struct {
 	buffer  map[int64]*list.Element
 	stack   *list.List
 	size    int
 	pageout func(int64, []byte) error
+	stats   *counters
 }
 
+/*
+LRUCacheFile is a write back cache which drops the least recently used page
+when it is full. Dirty pages are written when they are evicted, by Persist and
+Sync, and by the background flusher if one was started with StartFlusher. A
+miss while the blocks are read in order reads ahead, see SetReadahead.
+
+The cache is used from one goroutine at a time, cache_lock only keeps the
+flusher out of its way.
+*/
 type LRUCacheFile struct {
+	counters
 	file       RemovableBlockDevice
 	cache      map[int64]*lru_item
 	cache_size int
 	lru        *lru
 	userdata   []byte
+	dead       DeadList
+	ahead      readahead
+	cache_lock sync.Mutex
+	flusher    *flusher
 }
 
 func NewLRUCacheFile(file RemovableBlockDevice, size uint64) (cf *LRUCacheFile, err error) {
@@ -32,8 +51,10 @@ func NewLRUCacheFile(file RemovableBlockDevice, size uint64) (cf *LRUCacheFile,
 		cache:      make(map[int64]*lru_item),
 		cache_size: cache_size,
 		userdata:   make([]byte, file.BlockSize()-CONTROLSIZE),
+		ahead:      readahead{max: READAHEAD},
 	}
 	cf.lru = newLRU(cache_size, cf.pageout)
+	cf.lru.stats = &cf.counters
 	return cf, nil
 }
 
@@ -46,24 +67,27 @@ func OpenLRUCacheFile(file RemovableBlockDevice, size uint64) (cf *LRUCacheFile,
 		file:       file,
 		cache:      make(map[int64]*lru_item),
 		cache_size: cache_size,
+		ahead:      readahead{max: READAHEAD},
 	}
 	cf.lru = newLRU(cache_size, cf.pageout)
-	data, err := cf.file.ControlData()
-	if err != nil {
-		return nil, err
-	}
-	err = cf.SetControlData(data)
-	if err != nil {
+	cf.lru.stats = &cf.counters
+	if cf.userdata, err = cf.file.ControlData(); err != nil {
 		return nil, err
 	}
 	return cf, nil
 }
 
+// Close stops the flusher and closes the file, an error the flusher hit is
+// returned once the file is closed.
 func (self *LRUCacheFile) Close() error {
+	flush_err := self.StopFlusher()
+	if err := self.dead.ReleaseAll(self.Free); err != nil {
+		return err
+	}
 	if err := self.file.Close(); err != nil {
 		return err
 	}
-	return nil
+	return flush_err
 }
 
 func (self *LRUCacheFile) Remove() error {
@@ -71,72 +95,213 @@ func (self *LRUCacheFile) Remove() error {
 }
 
 func (self *LRUCacheFile) Persist() error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
 	err := self.lru.Persist()
 	if err != nil {
 		return err
 	}
+	if read_only(self.file) {
+		return nil
+	}
 	return self.file.SetControlData(self.userdata)
 }
 
 func (self *LRUCacheFile) ControlData() (data bs.ByteSlice, err error) {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
 	data = make(bs.ByteSlice, self.file.BlockSize()-CONTROLSIZE)
 	copy(data, self.userdata)
 	return data, nil
 }
 
 func (self *LRUCacheFile) SetControlData(data bs.ByteSlice) (err error) {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
 	if len(data) > int(self.file.BlockSize()-CONTROLSIZE) {
 		return fmt.Errorf("control data was too large")
 	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
 	self.userdata = make([]byte, self.file.BlockSize()-CONTROLSIZE)
 	copy(self.userdata, data)
 	return nil
 }
 
+func (self *LRUCacheFile) StructureType() (stype uint32, err error) {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	return self.file.StructureType()
+}
+
+func (self *LRUCacheFile) SetStructureType(stype uint32) error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	return self.file.SetStructureType(stype)
+}
+
 func (self *LRUCacheFile) BlockSize() uint32 { return self.file.BlockSize() }
 
+// ReadOnly is true when the file under the cache was opened read only, the
+// cache then refuses every change as the file would.
+func (self *LRUCacheFile) ReadOnly() bool { return read_only(self.file) }
+
 func (self *LRUCacheFile) Free(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	if self.lru.Pinned(key) {
+		return fmt.Errorf("Cannot free pinned block %d", key)
+	}
 	self.lru.Remove(key)
 	if err := self.file.Free(key); err != nil {
 		return err
 	}
+	self.count(func(stats *Stats) { stats.Frees += 1 })
 	return nil
 }
 
 func (self *LRUCacheFile) Allocate() (key int64, err error) {
-	return self.file.Allocate()
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	key, err = self.file.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += 1 })
+	return key, nil
 }
 
 func (self *LRUCacheFile) AllocateBlocks(n int) (key int64, err error) {
-	return self.file.AllocateBlocks(n)
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	key, err = self.file.AllocateBlocks(n)
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += int64(n) })
+	return key, nil
+}
+
+// MarkDead keeps the block readable, it is freed by the first Reclaim after
+// every reader that might still reach it has exited.
+func (self *LRUCacheFile) MarkDead(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	return self.dead.Mark(key)
+}
+
+func (self *LRUCacheFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *LRUCacheFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *LRUCacheFile) Reclaim() error {
+	return self.dead.Reclaim(self.Free)
+}
+
+// Pin keeps the block in the cache until it has been unpinned as many times as
+// it was pinned.
+func (self *LRUCacheFile) Pin(key int64) error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	if !self.lru.Has(key) {
+		if _, err := self.read_block(key); err != nil {
+			return err
+		}
+	}
+	return self.lru.Pin(key)
+}
+
+func (self *LRUCacheFile) Unpin(key int64) error {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	return self.lru.Unpin(key)
+}
+
+// SetReadahead sets the most blocks a miss during a sequential scan reads in
+// one go, 0 turns readahead off. It never reads more than a quarter of the
+// cache.
+func (self *LRUCacheFile) SetReadahead(max int) {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	self.ahead = readahead{max: max}
 }
 
 func (self *LRUCacheFile) pageout(key int64, block []byte) error {
-	return self.file.WriteBlock(key, block)
+	if err := self.file.WriteBlock(key, block); err != nil {
+		return err
+	}
+	self.count(func(stats *Stats) { stats.PageOuts += 1 })
+	return nil
 }
 
 func (self *LRUCacheFile) WriteBlock(key int64, block bs.ByteSlice) (err error) {
-	return self.lru.Update(key, block, false)
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	if err := self.lru.Update(key, block, false); err != nil {
+		return err
+	}
+	self.write(len(block))
+	return nil
 }
 
 func (self *LRUCacheFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
+	return self.read_block(key)
+}
+
+func (self *LRUCacheFile) read_block(key int64) (block bs.ByteSlice, err error) {
+	blk_size := int64(self.BlockSize())
+	seq := self.ahead.sequential(key, blk_size)
 	block, has := self.lru.Read(key, self.BlockSize())
+	self.lookup(has)
 	if !has {
-		block, err := self.file.ReadBlock(key)
+		n := 1
+		if seq {
+			n = self.ahead.grow(self.cache_size / 4)
+		}
+		blocks, err := prefetch(self.file, key, n, self.lru.Has)
 		if err != nil {
 			return nil, err
 		}
-		err = self.lru.Update(key, block, true)
-		if err != nil {
+		block = blocks[0]
+		if err := self.lru.Update(key, block, true); err != nil {
 			return nil, err
 		}
-		return block, nil
-	} else {
-		return block, nil
+		for i := 1; i < len(blocks); i++ {
+			err := self.lru.Update(key+int64(i)*blk_size, blocks[i], true)
+			if err == ErrCacheFull {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			self.count(func(stats *Stats) { stats.Prefetches += 1 })
+		}
 	}
+	self.read(len(block))
+	return block, nil
 }
 
 func (self *LRUCacheFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	self.cache_lock.Lock()
+	defer self.cache_lock.Unlock()
 	buffer_read := func() bool {
 		ckey := key
 		for i := 0; i < n; i++ {
@@ -152,7 +317,7 @@ func (self *LRUCacheFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err
 		blk_size := int64(self.BlockSize())
 		blocks = make(bs.ByteSlice, n*int(blk_size))
 		for i := int64(0); i < int64(n); i++ {
-			blk, err := self.ReadBlock(key + i*blk_size)
+			blk, err := self.read_block(key + i*blk_size)
 			if err != nil {
 				return nil, err
 			}
@@ -160,6 +325,8 @@ func (self *LRUCacheFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err
 		}
 		return blocks, nil
 	} else {
+		self.lookup(false)
+		self.read(int(self.BlockSize()) * n)
 		return self.file.ReadBlocks(key, n)
 		// we aren't saving it the cache on purpose. This could read a bunch of one use
 		// blocks
@@ -172,6 +339,8 @@ type lru_item struct {
 	bytes []byte
 	p     int64
 	dirty bool
+	since time.Time // when the page was last made dirty
+	pins  int
 }
 
 func new_lruitem(p int64, bytes []byte) *lru_item {
@@ -179,6 +348,7 @@ func new_lruitem(p int64, bytes []byte) *lru_item {
 		p:     p,
 		bytes: bytes,
 		dirty: true,
+		since: time.Now(),
 	}
 }
 
@@ -197,21 +367,83 @@ func (self *lru) Remove(p int64) {
 	self.Update(p, nil, false)
 }
 
-func (self *lru) Persist() error {
-	for self.stack.Len() > 0 {
-		e := self.stack.Back()
-		if e == nil {
-			return fmt.Errorf("Element unexpectedly nil %v", self.stack.Len())
-		}
+// Flush writes out the dirty pages and leaves them in the cache.
+func (self *lru) Flush() error {
+	return self.FlushBefore(time.Now())
+}
+
+// FlushBefore writes out the pages which have been dirty since before t.
+func (self *lru) FlushBefore(t time.Time) error {
+	for e := self.stack.Back(); e != nil; e = e.Prev() {
 		i := e.Value.(*lru_item)
-		if i.dirty {
+		if i.dirty && !i.since.After(t) {
 			err := self.pageout(i.p, i.bytes)
 			if err != nil {
 				return err
 			}
+			i.dirty = false
+		}
+	}
+	return nil
+}
+
+func (self *lru) Persist() error {
+	if err := self.Flush(); err != nil {
+		return err
+	}
+	for e := self.stack.Back(); e != nil; {
+		i := e.Value.(*lru_item)
+		prev := e.Prev()
+		if i.pins == 0 {
+			delete(self.buffer, i.p)
+			self.stack.Remove(e)
+		}
+		e = prev
+	}
+	return nil
+}
+
+// Dirty counts the dirty pages in the cache.
+func (self *lru) Dirty() (n int) {
+	for e := self.stack.Front(); e != nil; e = e.Next() {
+		if e.Value.(*lru_item).dirty {
+			n++
+		}
+	}
+	return n
+}
+
+func (self *lru) Pinned(p int64) bool {
+	if e, has := self.buffer[p]; has {
+		return e.Value.(*lru_item).pins > 0
+	}
+	return false
+}
+
+func (self *lru) Pin(p int64) error {
+	if e, has := self.buffer[p]; has {
+		e.Value.(*lru_item).pins += 1
+		return nil
+	}
+	return fmt.Errorf("Cannot pin block %d, it is not in the cache", p)
+}
+
+func (self *lru) Unpin(p int64) error {
+	if e, has := self.buffer[p]; has {
+		if i := e.Value.(*lru_item); i.pins > 0 {
+			i.pins -= 1
+			return nil
+		}
+	}
+	return fmt.Errorf("Block %d is not pinned", p)
+}
+
+// victim finds the least recently used page which is not pinned.
+func (self *lru) victim() *list.Element {
+	for e := self.stack.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*lru_item).pins == 0 {
+			return e
 		}
-		delete(self.buffer, i.p)
-		self.stack.Remove(e)
 	}
 	return nil
 }
@@ -229,7 +461,10 @@ func (self *lru) Update(p int64, block []byte, fromdisk bool) error {
 		} else {
 			item := e.Value.(*lru_item)
 			item.bytes = block
-			item.dirty = true
+			if !item.dirty {
+				item.dirty = true
+				item.since = time.Now()
+			}
 			self.stack.MoveToFront(e)
 		}
 	} else {
@@ -239,9 +474,9 @@ func (self *lru) Update(p int64, block []byte, fromdisk bool) error {
 			return nil
 		}
 		for self.size < self.stack.Len() && self.stack.Len() > 0 {
-			e = self.stack.Back()
+			e = self.victim()
 			if e == nil {
-				return fmt.Errorf("Element unexpectedly nil %v", self.stack.Len())
+				return ErrCacheFull
 			}
 			i := e.Value.(*lru_item)
 			if i.dirty {
@@ -252,6 +487,7 @@ func (self *lru) Update(p int64, block []byte, fromdisk bool) error {
 			}
 			delete(self.buffer, i.p)
 			self.stack.Remove(e)
+			self.stats.count(func(stats *Stats) { stats.Evictions += 1 })
 		}
 		item := new_lruitem(p, block)
 		if fromdisk {
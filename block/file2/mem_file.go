@@ -0,0 +1,147 @@
+package file2
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+import buf "file-structures/block/buffers"
+import bs "file-structures/block/byteslice"
+
+type mem_storage struct {
+	lock  sync.RWMutex
+	bytes []byte
+}
+
+func (self *mem_storage) ReadAt(bytes []byte, off int64) (int, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if off >= int64(len(self.bytes)) {
+		return 0, io.EOF
+	}
+	n := copy(bytes, self.bytes[off:])
+	if n < len(bytes) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (self *mem_storage) WriteAt(bytes []byte, off int64) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if end := off + int64(len(bytes)); end > int64(len(self.bytes)) {
+		if err := self.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	return copy(self.bytes[off:], bytes), nil
+}
+
+func (self *mem_storage) Truncate(size int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.truncate(size)
+}
+
+func (self *mem_storage) truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("Negative size %d", size)
+	}
+	if size <= int64(cap(self.bytes)) {
+		old := len(self.bytes)
+		self.bytes = self.bytes[:size]
+		for i := old; i < len(self.bytes); i++ {
+			self.bytes[i] = 0
+		}
+		return nil
+	}
+	bytes := make([]byte, size, 2*size)
+	copy(bytes, self.bytes)
+	self.bytes = bytes
+	return nil
+}
+
+func (self *mem_storage) Size() (int64, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return int64(len(self.bytes)), nil
+}
+
+func (self *mem_storage) Sync() error  { return nil }
+func (self *mem_storage) Close() error { return nil }
+
+/*
+MemBlockFile is a BlockFile whose image lives in a byte slice instead of on
+disk. It shares all of its code with BlockFile, so allocation, the free list and
+the control block behave exactly the same way. The image can be saved with
+Bytes and loaded again with LoadMemBlockFile.
+*/
+type MemBlockFile struct {
+	*BlockFile
+	mem *mem_storage
+}
+
+func NewMemBlockFile() *MemBlockFile {
+	return NewMemBlockFileCustomBlockSize(BLOCKSIZE)
+}
+
+func NewMemBlockFileCustomBlockSize(size uint32) *MemBlockFile {
+	return NewMemBlockFileWithFlags(size, 0)
+}
+
+func NewMemBlockFileWithFlags(size uint32, flags uint32) *MemBlockFile {
+	mem := &mem_storage{}
+	self := &MemBlockFile{
+		BlockFile: NewBlockFileWithFlags("", &buf.NoBuffer{}, size, flags),
+		mem:       mem,
+	}
+	self.opener = func() (storage, error) {
+		if self.mem == nil {
+			return nil, fmt.Errorf("MemBlockFile has been removed")
+		}
+		return self.mem, nil
+	}
+	return self
+}
+
+func image_blocksize(image []byte) (uint32, error) {
+	if len(image) < CONTROLSIZE {
+		return 0, fmt.Errorf("image is too small to hold a control block")
+	}
+	size := bs.ByteSlice(image[4:8]).Int32() &^ FLAGMASK
+	if size == 0 || size%4096 != 0 {
+		return 0, fmt.Errorf("image has a bad block size %d", size)
+	}
+	if len(image)%int(size) != 0 {
+		return 0, fmt.Errorf("image length %d is not a multiple of the block size %d",
+			len(image), size)
+	}
+	return size, nil
+}
+
+func LoadMemBlockFile(image []byte) (*MemBlockFile, error) {
+	size, err := image_blocksize(image)
+	if err != nil {
+		return nil, err
+	}
+	self := NewMemBlockFileCustomBlockSize(size)
+	self.mem.bytes = make([]byte, len(image))
+	copy(self.mem.bytes, image)
+	return self, nil
+}
+
+func (self *MemBlockFile) Bytes() []byte {
+	if self.mem == nil {
+		return nil
+	}
+	return self.mem.bytes_copy()
+}
+
+func (self *MemBlockFile) Remove() error {
+	if self.opened {
+		return fmt.Errorf("Expected file to be closed")
+	}
+	self.mem = nil
+	return nil
+}
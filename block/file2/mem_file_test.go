@@ -0,0 +1,179 @@
+package file2
+
+import "testing"
+
+import (
+	"io/ioutil"
+	"math/rand"
+)
+
+import (
+	buf "../buffers"
+	bs "file-structures/block/byteslice"
+)
+
+func TestMemBlockFileMatchesBlockFile(t *testing.T) {
+	const ITEMS = 200
+
+	bf := NewBlockFile(PATH, &buf.NoBuffer{})
+	cleanup(bf.Path())
+	defer cleanup(bf.Path())
+	mf := NewMemBlockFile()
+	if err := bf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := rand.Perm(ITEMS * 3)
+	var keys []int64
+	for _, op := range ops {
+		var bkey, mkey int64
+		var berr, merr error
+		switch {
+		case op%3 == 0 && len(keys) > 0:
+			key := keys[op%len(keys)]
+			keys = append(keys[:op%len(keys)], keys[op%len(keys)+1:]...)
+			berr, merr = bf.Free(key), mf.Free(key)
+		case op%5 == 0:
+			bkey, berr = bf.AllocateBlocks(3)
+			mkey, merr = mf.AllocateBlocks(3)
+		default:
+			bkey, berr = bf.Allocate()
+			mkey, merr = mf.Allocate()
+			if bkey == mkey {
+				keys = append(keys, bkey)
+				blk := filled(bf, byte(op))
+				if err := bf.WriteBlock(bkey, blk); err != nil {
+					t.Fatal(err)
+				}
+				if err := mf.WriteBlock(mkey, blk); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if berr != nil || merr != nil {
+			t.Fatal(berr, merr)
+		} else if bkey != mkey {
+			t.Fatalf("Expected the same key from both files %d != %d", bkey, mkey)
+		}
+	}
+	if err := bf.SetControlData([]byte("control")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.SetControlData([]byte("control")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if disk, err := ioutil.ReadFile(bf.Path()); err != nil {
+		t.Fatal(err)
+	} else if !bs.ByteSlice(disk).Eq(mf.Bytes()) {
+		t.Fatalf("Expected the memory image to match the file %d != %d",
+			len(disk), len(mf.Bytes()))
+	}
+}
+
+func TestMemBlockFileLoad(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	A, err := mf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := mf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.WriteBlock(A, filled(mf, 0xf)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Free(B); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.SetControlData([]byte("Hi there!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	image := mf.Bytes()
+	if err := mf.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err == nil {
+		t.Fatal("Expected a removed MemBlockFile to fail to open")
+	}
+
+	lf, err := LoadMemBlockFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, lf, A, 0xf)
+	if data, err := lf.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if string(data[:9]) != "Hi there!" {
+		t.Fatalf("Expected the control data to survive got %v", data[:9])
+	}
+	if C, err := lf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if C != B {
+		t.Fatalf("Expected the free list to survive %d != %d", B, C)
+	}
+
+	if _, err := LoadMemBlockFile(image[:100]); err == nil {
+		t.Fatal("Expected a truncated image to be rejected")
+	}
+	image[40] ^= 0xff
+	if bad, err := LoadMemBlockFile(image); err != nil {
+		t.Fatal(err)
+	} else if err := bad.Open(); err == nil {
+		t.Fatal("Expected a corrupt control block to be rejected")
+	}
+}
+
+func TestMemBlockFileCacheFiles(t *testing.T) {
+	imf := NewMemBlockFile()
+	if err := imf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	lfu, err := NewLFUCacheFile(imf, CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmf := NewMemBlockFile()
+	if err := rmf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	lru, err := NewLRUCacheFile(rmf, CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []BlockDevice{lfu, lru} {
+		var keys []int64
+		for i := 0; i < 100; i++ {
+			key, err := f.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := f.WriteBlock(key, filled(f, byte(key/BLOCKSIZE))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range keys {
+			expect_block(t, f, key, byte(key/BLOCKSIZE))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// +build linux darwin
+
+package file2
+
+import (
+	"fmt"
+	"syscall"
+)
+
+import . "file-structures/block/byteslice"
+
+/*
+MMapFile is a BlockFile whose reads are served from a private mapping of the
+file. ReadBlock and ReadBlocks return views into the mapping instead of fresh
+copies so a read costs neither an allocation nor a system call.
+
+Writes still go to the file with pwrite and are then copied into the mapping,
+so a view always shows the last block written. Changing a view in place is not
+a write, the change stays private to the process and never reaches the file
+unless the block is written back.
+
+When a read falls past the end of the mapping the file is mapped again with
+room to grow. The earlier mappings stay alive, and are kept up to date, until
+Close so views handed out before the remap remain valid. Views past the end of
+the file are not valid after Compact truncates it.
+*/
+type MMapFile struct {
+	*BlockFile
+	mapped []byte
+	old    [][]byte
+	size   int64
+}
+
+// mmap_sink sees every block BlockFile writes, including its own free list
+// and checksum blocks, and copies it into the mappings.
+type mmap_sink struct {
+	mf *MMapFile
+}
+
+func (self *mmap_sink) Update(p int64, block []byte)               { self.mf.update(p, block) }
+func (self *mmap_sink) Read(p int64, length uint32) ([]byte, bool) { return nil, false }
+func (self *mmap_sink) Remove(p int64)                             {}
+func (self *mmap_sink) Size() int                                  { return 0 }
+
+func NewMMapFile(path string) *MMapFile {
+	return NewMMapFileWithFlags(path, BLOCKSIZE, 0)
+}
+
+func NewMMapFileCustomBlockSize(path string, size uint32) *MMapFile {
+	return NewMMapFileWithFlags(path, size, 0)
+}
+
+func NewMMapFileWithFlags(path string, size uint32, flags uint32) *MMapFile {
+	self := &MMapFile{}
+	self.BlockFile = NewBlockFileWithFlags(path, &mmap_sink{self}, size, flags)
+	return self
+}
+
+func (self *MMapFile) Open() error {
+	if err := self.BlockFile.Open(); err != nil {
+		return err
+	}
+	return self.remap()
+}
+
+func (self *MMapFile) Close() error {
+	if err := self.BlockFile.Close(); err != nil {
+		return err
+	}
+	for _, mapping := range append(self.old, self.mapped) {
+		if mapping == nil {
+			continue
+		}
+		if err := syscall.Munmap(mapping); err != nil {
+			return err
+		}
+	}
+	self.mapped = nil
+	self.old = nil
+	self.size = 0
+	return nil
+}
+
+func (self *MMapFile) Compact(relocate Relocator) error {
+	if err := self.BlockFile.Compact(relocate); err != nil {
+		return err
+	}
+	size, err := self.Size()
+	if err != nil {
+		return err
+	}
+	self.size = int64(size)
+	return nil
+}
+
+func (self *MMapFile) fd() (int, error) {
+	if f, ok := self.file.(*os_file); ok {
+		return int(f.Fd()), nil
+	}
+	return 0, fmt.Errorf("MMapFile needs an os file to map")
+}
+
+// remap maps the file again if it has grown past the current mapping. The new
+// mapping is twice the size of the old one so growing the file a block at a
+// time does not remap on every read.
+func (self *MMapFile) remap() error {
+	size, err := self.Size()
+	if err != nil {
+		return err
+	}
+	self.size = int64(size)
+	if self.size <= int64(len(self.mapped)) {
+		return nil
+	}
+	length := 2 * int64(len(self.mapped))
+	if length < self.size {
+		length = self.size
+	}
+	fd, err := self.fd()
+	if err != nil {
+		return err
+	}
+	mapping, err := syscall.Mmap(fd, 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+	if err != nil {
+		return err
+	}
+	if self.mapped != nil {
+		self.old = append(self.old, self.mapped)
+	}
+	self.mapped = mapping
+	return nil
+}
+
+func (self *MMapFile) update(p int64, block []byte) {
+	end := p + int64(len(block))
+	for _, mapping := range append(self.old, self.mapped) {
+		if end <= int64(len(mapping)) {
+			copy(mapping[p:end], block)
+		}
+	}
+	if end > self.size {
+		self.size = end
+	}
+}
+
+func (self *MMapFile) view(p int64, length int) (ByteSlice, error) {
+	if !self.opened {
+		return nil, fmt.Errorf("File is not open")
+	}
+	if err := self.check_reserved(p, length); err != nil {
+		return nil, err
+	}
+	end := p + int64(length)
+	if end > self.size || end > int64(len(self.mapped)) {
+		if err := self.remap(); err != nil {
+			return nil, err
+		}
+		if end > self.size {
+			return nil, fmt.Errorf("Block %d is past the end of the file", p)
+		}
+	}
+	block := ByteSlice(self.mapped[p:end:end])
+	if err := self.verify_sums(p, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func (self *MMapFile) ReadBlock(p int64) (ByteSlice, error) {
+	return self.view(p, int(self.ctrl.blksize))
+}
+
+func (self *MMapFile) ReadBlocks(p int64, n int) (ByteSlice, error) {
+	return self.view(p, int(self.ctrl.blksize)*n)
+}
@@ -0,0 +1,121 @@
+// +build linux darwin
+
+package file2
+
+import "testing"
+
+import (
+	buf "../buffers"
+)
+
+func testmmap(t *testing.T, flags uint32) *MMapFile {
+	cleanup(PATH)
+	f := NewMMapFileWithFlags(PATH, BLOCKSIZE, flags)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func cleanupmmap(f *MMapFile) {
+	if f.opened {
+		f.Close()
+	}
+	cleanup(PATH)
+}
+
+func TestMMapWriteRead(t *testing.T) {
+	for _, flags := range []uint32{0, CHECKSUMS} {
+		f := testmmap(t, flags)
+		var keys []int64
+		for i := 0; i < 100; i++ {
+			key, err := f.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := f.WriteBlock(key, filled(f, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+			expect_block(t, f, key, byte(i))
+		}
+		if len(f.old) == 0 {
+			t.Fatal("Expected the file to have been mapped again as it grew")
+		}
+		for i, key := range keys {
+			expect_block(t, f, key, byte(i))
+		}
+		// the views are not copies and follow later writes
+		view, err := f.ReadBlock(keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteBlock(keys[0], filled(f, 0xee)); err != nil {
+			t.Fatal(err)
+		}
+		if !view.Eq(filled(f, 0xee)) {
+			t.Fatalf("Expected the view to show the write got %v", view[:8])
+		}
+		if err := f.Free(keys[1]); err != nil {
+			t.Fatal(err)
+		}
+		if blocks, err := f.ReadBlocks(keys[2], 2); err != nil {
+			t.Fatal(err)
+		} else if !blocks[:BLOCKSIZE].Eq(filled(f, 2)) || !blocks[BLOCKSIZE:].Eq(filled(f, 3)) {
+			t.Fatal("Expected ReadBlocks to return both blocks")
+		}
+		if _, err := f.ReadBlock(keys[len(keys)-1] + 16*BLOCKSIZE); err == nil {
+			t.Fatal("Expected a read past the end of the file to fail")
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		bf := NewBlockFileWithFlags(PATH, &buf.NoBuffer{}, BLOCKSIZE, flags)
+		if err := bf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		expect_block(t, bf, keys[0], 0xee)
+		for i, key := range keys[2:] {
+			expect_block(t, bf, key, byte(i+2))
+		}
+		if key, err := bf.Allocate(); err != nil {
+			t.Fatal(err)
+		} else if key != keys[1] {
+			t.Fatalf("Expected the freed block to be reused %d != %d", keys[1], key)
+		}
+		bf.Close()
+		cleanup(PATH)
+	}
+}
+
+func TestMMapPrivateChanges(t *testing.T) {
+	f := testmmap(t, 0)
+	defer cleanupmmap(f)
+	A, err := f.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteBlock(A, filled(f, 1)); err != nil {
+		t.Fatal(err)
+	}
+	view, err := f.ReadBlock(A)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view[0] = 2
+	block := make([]byte, BLOCKSIZE)
+	if err := f.read_at(block, A); err != nil {
+		t.Fatal(err)
+	} else if block[0] != 1 {
+		t.Fatal("Expected a change to a view not to reach the file")
+	}
+	if err := f.WriteBlock(A, view); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.read_at(block, A); err != nil {
+		t.Fatal(err)
+	} else if block[0] != 2 {
+		t.Fatal("Expected writing the view to reach the file")
+	}
+}
@@ -0,0 +1,158 @@
+package file2
+
+import "testing"
+
+func pin_testfile(t *testing.T, lfu bool) (Pinner, RemovableBlockDevice) {
+	const CACHESIZE = 4
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if lfu {
+		f, err := NewLFUCacheFile(mf, BLOCKSIZE*CACHESIZE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f, f
+	}
+	f, err := NewLRUCacheFile(mf, BLOCKSIZE*CACHESIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, f
+}
+
+func cached(f Pinner, key int64) bool {
+	switch c := f.(type) {
+	case *LRUCacheFile:
+		return c.lru.Has(key)
+	case *LFUCacheFile:
+		_, has := c.cache[key]
+		return has
+	}
+	return false
+}
+
+func TestPinSurvivesEviction(t *testing.T) {
+	for _, lfu := range []bool{false, true} {
+		p, f := pin_testfile(t, lfu)
+		A, err := f.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteBlock(A, filled(f, 0xa)); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Pin(A); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Pin(A); err != nil {
+			t.Fatal(err)
+		}
+		var keys []int64
+		for i := 0; i < 50; i++ {
+			key, err := f.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := f.WriteBlock(key, filled(f, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 3; j++ {
+				expect_block(t, f, key, byte(i))
+			}
+			if !cached(p, A) {
+				t.Fatalf("lfu=%v: pinned block was paged out after %d writes", lfu, i)
+			}
+		}
+		if err := f.Free(A); err == nil {
+			t.Fatalf("lfu=%v: expected freeing a pinned block to fail", lfu)
+		}
+		if err := p.Unpin(A); err != nil {
+			t.Fatal(err)
+		}
+		if !cached(p, A) {
+			t.Fatalf("lfu=%v: block was paged out while still pinned once", lfu)
+		}
+		if err := p.Unpin(A); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Unpin(A); err == nil {
+			t.Fatalf("lfu=%v: expected unpinning an unpinned block to fail", lfu)
+		}
+		for i, key := range keys {
+			expect_block(t, f, key, byte(i))
+		}
+		if cached(p, A) {
+			t.Fatalf("lfu=%v: expected the unpinned block to be paged out", lfu)
+		}
+		expect_block(t, f, A, 0xa)
+	}
+}
+
+func TestPinCacheFull(t *testing.T) {
+	for _, lfu := range []bool{false, true} {
+		p, f := pin_testfile(t, lfu)
+		var keys []int64
+		for i := 0; i < 20; i++ {
+			key, err := f.Allocate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := f.WriteBlock(key, filled(f, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var pinned []int64
+		var err error
+		for _, key := range keys {
+			if err = p.Pin(key); err != nil {
+				break
+			}
+			pinned = append(pinned, key)
+		}
+		if err != ErrCacheFull {
+			t.Fatalf("lfu=%v: expected ErrCacheFull once every page was pinned got %v", lfu, err)
+		}
+		for _, key := range pinned {
+			if !cached(p, key) {
+				t.Fatalf("lfu=%v: pinned block %d is not cached", lfu, key)
+			}
+		}
+		if !lfu {
+			if _, err := f.ReadBlock(keys[len(keys)-1]); err != ErrCacheFull {
+				t.Fatalf("expected ErrCacheFull reading through a fully pinned cache got %v", err)
+			}
+		}
+		if err := p.Unpin(pinned[0]); err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			expect_block(t, f, key, byte(i))
+		}
+	}
+}
+
+func TestPinPersist(t *testing.T) {
+	p, f := pin_testfile(t, false)
+	lru := f.(*LRUCacheFile)
+	A, err := f.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WriteBlock(A, filled(f, 0xa)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(A); err != nil {
+		t.Fatal(err)
+	}
+	if err := lru.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	if !cached(p, A) {
+		t.Fatal("Expected Persist to keep the pinned block cached")
+	}
+	expect_block(t, lru.file, A, 0xa)
+}
@@ -0,0 +1,85 @@
+package file2
+
+import bs "file-structures/block/byteslice"
+
+// READAHEAD is the default number of blocks a cache file reads in one go once
+// it has seen a sequential scan.
+const READAHEAD = 16
+
+/*
+readahead spots a cache file being read block after block, as LinearHash.Keys()
+reads its buckets or Varchar reads a long chain. While the reads carry on from
+the one before them every miss reads a window of the following blocks with one
+ReadBlocks call, the window doubling on each miss up to max. Any other read
+closes the window again.
+
+The LRU and 2Q cache files read ahead, LFUCacheFile does not. A block read
+ahead has not been read yet, it would join the cache with the lowest count and
+be the first one evicted, before the scan got to it.
+*/
+type readahead struct {
+	max    int
+	next   int64
+	window int
+}
+
+// sequential records a read of key and says whether it carried on from the
+// read before it.
+func (self *readahead) sequential(key int64, blk_size int64) bool {
+	seq := key == self.next
+	self.next = key + blk_size
+	if !seq {
+		self.window = 0
+	}
+	return seq
+}
+
+// grow opens the window for a sequential miss, it never reads more than
+// budget blocks so a scan can not push the rest of the cache out.
+func (self *readahead) grow(budget int) int {
+	if self.window == 0 {
+		self.window = 2
+	} else {
+		self.window *= 2
+	}
+	if self.window > self.max {
+		self.window = self.max
+	}
+	if self.window > budget {
+		self.window = budget
+	}
+	if self.window < 1 {
+		self.window = 1
+	}
+	return self.window
+}
+
+/*
+prefetch reads the n blocks starting at key. The run stops short of the first
+block the cache already holds since that copy may be newer than the one in the
+file. If the run can not be read in one go, it may run off the end of the file
+or into blocks which were never written, only key is read.
+*/
+func prefetch(file BlockReader, key int64, n int, cached func(key int64) bool) (blocks []bs.ByteSlice, err error) {
+	blk_size := int64(file.BlockSize())
+	for i := 1; i < n; i++ {
+		if cached(key + int64(i)*blk_size) {
+			n = i
+			break
+		}
+	}
+	if n > 1 {
+		run, err := file.ReadBlocks(key, n)
+		if err == nil && len(run) == n*int(blk_size) {
+			for i := int64(0); i < int64(n); i++ {
+				blocks = append(blocks, run[i*blk_size:(i+1)*blk_size:(i+1)*blk_size])
+			}
+			return blocks, nil
+		}
+	}
+	block, err := file.ReadBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	return []bs.ByteSlice{block}, nil
+}
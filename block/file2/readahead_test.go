@@ -0,0 +1,112 @@
+package file2
+
+import "testing"
+
+type readaheadfile interface {
+	BlockDevice
+	StatsSource
+	SetReadahead(max int)
+	Persist() error
+}
+
+func TestReadahead(t *testing.T) {
+	const BLOCKS = 100
+	makers := map[string]func(f RemovableBlockDevice) readaheadfile{
+		"lru": func(f RemovableBlockDevice) readaheadfile {
+			cf, _ := NewLRUCacheFile(f, 64*BLOCKSIZE)
+			return cf
+		},
+		"2q": func(f RemovableBlockDevice) readaheadfile {
+			cf, _ := NewTwoQCacheFile(f, 64*BLOCKSIZE)
+			return cf
+		},
+	}
+	for name, maker := range makers {
+		mf := NewMemBlockFile()
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		start, err := mf.AllocateBlocks(BLOCKS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := func(i int) int64 { return start + int64(i)*BLOCKSIZE }
+		for i := 0; i < BLOCKS; i++ {
+			if err := mf.WriteBlock(key(i), filled(mf, byte(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sf := NewStatsFile(mf)
+		cf := maker(sf)
+
+		// a page dirty in the cache is newer than the file, reading ahead
+		// must not replace it
+		if err := cf.WriteBlock(key(40), filled(cf, 0xff)); err != nil {
+			t.Fatal(err)
+		}
+		value := func(i int) byte {
+			if i == 40 {
+				return 0xff
+			}
+			return byte(i)
+		}
+		for i := 0; i < BLOCKS; i++ {
+			expect_block(t, cf, key(i), value(i))
+		}
+		if reads := sf.Stats().Reads; reads > BLOCKS/4 {
+			t.Fatalf("%s: Expected the scan to be read ahead got %d reads", name, reads)
+		}
+		if cf.Stats().Prefetches == 0 {
+			t.Fatalf("%s: Expected pages to be read ahead", name)
+		}
+		if err := cf.Persist(); err != nil {
+			t.Fatal(err)
+		}
+
+		// every other block is not a sequential scan
+		cf = maker(sf)
+		sf.ResetStats()
+		for i := 0; i < BLOCKS; i += 2 {
+			expect_block(t, cf, key(i), value(i))
+		}
+		if stats := cf.Stats(); stats.Prefetches != 0 || sf.Stats().Reads != BLOCKS/2 {
+			t.Fatalf("%s: Expected nothing to be read ahead got %+v", name, stats)
+		}
+
+		cf = maker(sf)
+		cf.SetReadahead(0)
+		sf.ResetStats()
+		for i := 0; i < BLOCKS; i++ {
+			expect_block(t, cf, key(i), value(i))
+		}
+		if reads := sf.Stats().Reads; reads != BLOCKS {
+			t.Fatalf("%s: Expected readahead to be off got %d reads", name, reads)
+		}
+	}
+}
+
+func TestReadaheadWindow(t *testing.T) {
+	r := readahead{max: 8}
+	var windows []int
+	for key := int64(BLOCKSIZE); key < 10*BLOCKSIZE; key += BLOCKSIZE {
+		if r.sequential(key, BLOCKSIZE) {
+			windows = append(windows, r.grow(100))
+		}
+	}
+	expected := []int{2, 4, 8, 8, 8, 8, 8, 8}
+	if len(windows) != len(expected) {
+		t.Fatalf("Expected %v got %v", expected, windows)
+	}
+	for i := range expected {
+		if windows[i] != expected[i] {
+			t.Fatalf("Expected %v got %v", expected, windows)
+		}
+	}
+	if r.sequential(3*BLOCKSIZE, BLOCKSIZE) || r.grow(3) != 2 {
+		t.Fatal("Expected a jump to close the window")
+	}
+	r.sequential(4*BLOCKSIZE, BLOCKSIZE)
+	if r.grow(3) != 3 {
+		t.Fatal("Expected the window to be held to the budget")
+	}
+}
@@ -0,0 +1,316 @@
+package file2
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import buf "file-structures/block/buffers"
+
+const SEGMENTSIZE = 1 << 30
+
+const segment_ext = ".seg"
+
+/*
+SegmentedFile is a BlockFile whose image is split across a directory of
+segment files of segment_size bytes each. A segment is named after the offset
+of its first byte in hex, it is created when the file grows into it and removed
+when the file is truncated below it. Every segment but the last is always full.
+
+Block keys are the same offsets a single file would use, so allocation, the
+free list, the control block and the structures built on top behave exactly as
+they do on a BlockFile. The segment size is not recorded anywhere, Open checks
+the segments on disk fit the size it was given.
+*/
+type SegmentedFile struct {
+	*BlockFile
+	dir      string
+	seg_size int64
+}
+
+func NewSegmentedFile(dir string, buf buf.Buffer) *SegmentedFile {
+	return NewSegmentedFileWithFlags(dir, buf, BLOCKSIZE, SEGMENTSIZE, 0)
+}
+
+func NewSegmentedFileWithFlags(dir string, buf buf.Buffer, size uint32, segment_size int64, flags uint32) *SegmentedFile {
+	if segment_size <= 0 || segment_size%int64(size) != 0 {
+		panic(fmt.Errorf("segment size must be a positive multiple of the block size"))
+	}
+	self := &SegmentedFile{
+		BlockFile: NewBlockFileWithFlags(dir, buf, size, flags),
+		dir:       dir,
+		seg_size:  segment_size,
+	}
+	self.opener = func() (storage, error) {
+		return open_segments(dir, segment_size, self.readonly)
+	}
+	return self
+}
+
+// Segments lists the paths of the segment files in order.
+func (self *SegmentedFile) Segments() ([]string, error) {
+	starts, err := list_segments(self.dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(starts))
+	for _, start := range starts {
+		paths = append(paths, segment_path(self.dir, start))
+	}
+	return paths, nil
+}
+
+// Remove deletes the segments and then the directory, which fails if anything
+// else was put in it.
+func (self *SegmentedFile) Remove() error {
+	if self.opened {
+		return fmt.Errorf("Expected file to be closed")
+	}
+	paths, err := self.Segments()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return os.Remove(self.dir)
+}
+
+func segment_path(dir string, start int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x%s", start, segment_ext))
+}
+
+// list_segments returns the starting offsets of the segments in dir, sorted.
+func list_segments(dir string) ([]int64, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+segment_ext))
+	if err != nil {
+		return nil, err
+	}
+	var starts []int64
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), segment_ext)
+		start, err := strconv.ParseInt(name, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a segment", path)
+		}
+		starts = append(starts, start)
+	}
+	sort.Sort(int64s(starts))
+	return starts, nil
+}
+
+type segment_storage struct {
+	dir      string
+	seg_size int64
+	lock     sync.RWMutex
+	segments []*os.File
+	dir_lock *os.File // holds the flock for the whole file
+	length   int64
+	created  bool // the directory has changed since the last Sync
+}
+
+func open_segments(dir string, seg_size int64, readonly bool) (*segment_storage, error) {
+	if !readonly {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	dir_lock, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := lock_file(dir_lock, readonly); err != nil {
+		dir_lock.Close()
+		return nil, err
+	}
+	self := &segment_storage{dir: dir, seg_size: seg_size, dir_lock: dir_lock}
+	starts, err := list_segments(dir)
+	if err != nil {
+		self.Close()
+		return nil, err
+	}
+	for i, start := range starts {
+		if start != int64(i)*seg_size {
+			self.Close()
+			return nil, fmt.Errorf("Segment %s does not fit a segment size of %d",
+				segment_path(dir, start), seg_size)
+		}
+		f, err := os.OpenFile(segment_path(dir, start), open_flag(readonly), 0666)
+		if err != nil {
+			self.Close()
+			return nil, err
+		}
+		self.segments = append(self.segments, f)
+		size, err := (&os_file{f}).Size()
+		if err != nil {
+			self.Close()
+			return nil, err
+		}
+		last := i == len(starts)-1
+		if size > seg_size || (!last && size != seg_size) {
+			self.Close()
+			return nil, fmt.Errorf("Segment %s holds %d bytes, it does not fit a segment size of %d",
+				segment_path(dir, start), size, seg_size)
+		}
+		self.length = start + size
+	}
+	return self, nil
+}
+
+func (self *segment_storage) Size() (int64, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.length, nil
+}
+
+// each calls f for every piece of [off, off+length) that falls in one segment.
+func (self *segment_storage) each(off int64, length int, f func(seg int, seg_off int64, from, to int) error) error {
+	for from := 0; from < length; {
+		seg := off / self.seg_size
+		seg_off := off % self.seg_size
+		to := from + int(self.seg_size-seg_off)
+		if to > length {
+			to = length
+		}
+		if err := f(int(seg), seg_off, from, to); err != nil {
+			return err
+		}
+		off += int64(to - from)
+		from = to
+	}
+	return nil
+}
+
+func (self *segment_storage) ReadAt(bytes []byte, off int64) (int, error) {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	read := 0
+	err := self.each(off, len(bytes), func(seg int, seg_off int64, from, to int) error {
+		if seg >= len(self.segments) {
+			return io.EOF
+		}
+		n, err := self.segments[seg].ReadAt(bytes[from:to], seg_off)
+		read += n
+		return err
+	})
+	return read, err
+}
+
+func (self *segment_storage) WriteAt(bytes []byte, off int64) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if end := off + int64(len(bytes)); end > self.length {
+		if err := self.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	written := 0
+	err := self.each(off, len(bytes), func(seg int, seg_off int64, from, to int) error {
+		n, err := self.segments[seg].WriteAt(bytes[from:to], seg_off)
+		written += n
+		return err
+	})
+	return written, err
+}
+
+func (self *segment_storage) Truncate(size int64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.truncate(size)
+}
+
+// truncate creates or removes segments so that every one but the last is full
+// and together they hold size bytes.
+func (self *segment_storage) truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("Negative size %d", size)
+	}
+	n := int((size + self.seg_size - 1) / self.seg_size)
+	for len(self.segments) > n {
+		last := len(self.segments) - 1
+		if err := self.segments[last].Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(segment_path(self.dir, int64(last)*self.seg_size)); err != nil {
+			return err
+		}
+		self.segments = self.segments[:last]
+		self.created = true
+	}
+	// the segments in front of the last one are full already
+	first := len(self.segments) - 1
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i < n; i++ {
+		if i == len(self.segments) {
+			f, err := os.OpenFile(segment_path(self.dir, int64(i)*self.seg_size), OPENFLAG, 0666)
+			if err != nil {
+				return err
+			}
+			self.segments = append(self.segments, f)
+			self.created = true
+		}
+		length := self.seg_size
+		if i == n-1 {
+			length = size - int64(i)*self.seg_size
+		}
+		if err := self.segments[i].Truncate(length); err != nil {
+			return err
+		}
+	}
+	self.length = size
+	return nil
+}
+
+// Sync syncs every segment, and the directory if segments have come or gone
+// so that they are still there after a power loss.
+func (self *segment_storage) Sync() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, f := range self.segments {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if !self.created {
+		return nil
+	}
+	dir, err := os.Open(self.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return err
+	}
+	self.created = false
+	return nil
+}
+
+func (self *segment_storage) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var first error
+	for _, f := range self.segments {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	self.segments = nil
+	if self.dir_lock != nil {
+		if err := self.dir_lock.Close(); err != nil && first == nil {
+			first = err
+		}
+		self.dir_lock = nil
+	}
+	return first
+}
@@ -0,0 +1,121 @@
+package file2
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	buf "../buffers"
+	bs "file-structures/block/byteslice"
+)
+
+const SEGPATH = "/tmp/__x_segments"
+const SEGSIZE = 4 * BLOCKSIZE
+
+func testsegments(t *testing.T, segment_size int64) *SegmentedFile {
+	f := NewSegmentedFileWithFlags(SEGPATH, &buf.NoBuffer{}, BLOCKSIZE, segment_size, 0)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func expect_segments(t *testing.T, f *SegmentedFile, n int) {
+	if paths, err := f.Segments(); err != nil {
+		t.Fatal(err)
+	} else if len(paths) != n {
+		t.Fatalf("Expected %d segments got %v", n, paths)
+	}
+}
+
+func TestSegmentedFile(t *testing.T) {
+	os.RemoveAll(SEGPATH)
+	defer os.RemoveAll(SEGPATH)
+	f := testsegments(t, SEGSIZE)
+	expect_segments(t, f, 1)
+	var keys []int64
+	for i := 0; i < 9; i++ {
+		key, err := f.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if err := f.WriteBlock(key, filled(f, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the control block and 9 blocks need three segments
+	expect_segments(t, f, 3)
+
+	// a run of blocks crossing a segment boundary
+	run, err := f.AllocateBlocks(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := make(bs.ByteSlice, 0, 5*BLOCKSIZE)
+	for i := 0; i < 5; i++ {
+		blocks = append(blocks, filled(f, byte(0x10+i))...)
+	}
+	for i := int64(0); i < 5; i++ {
+		if err := f.WriteBlock(run+i*BLOCKSIZE, blocks[i*BLOCKSIZE:(i+1)*BLOCKSIZE]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := f.ReadBlocks(run, 5); err != nil {
+		t.Fatal(err)
+	} else if !got.Eq(blocks) {
+		t.Fatal("Expected the run to read back across the segments")
+	}
+	if err := f.SetControlData(filled(f, 7)[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewSegmentedFileWithFlags(SEGPATH, &buf.NoBuffer{}, BLOCKSIZE, 2*BLOCKSIZE, 0).Open(); err == nil {
+		t.Fatal("Expected a different segment size to be refused")
+	}
+	f = testsegments(t, SEGSIZE)
+	for i, key := range keys {
+		expect_block(t, f, key, byte(i))
+	}
+	if data, err := f.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data[:10].Eq(filled(f, 7)[:10]) {
+		t.Fatal("Expected the control data to survive a reopen")
+	}
+
+	// freeing the blocks at the end and compacting drops the empty segments
+	for i := int64(0); i < 5; i++ {
+		if err := f.Free(run + i*BLOCKSIZE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Compact(func(moves map[int64]int64) error {
+		if len(moves) != 0 {
+			t.Fatalf("Expected nothing to move got %v", moves)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expect_segments(t, f, 3)
+	for i, key := range keys {
+		expect_block(t, f, key, byte(i))
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(SEGPATH); !os.IsNotExist(err) {
+		t.Fatal("Expected Remove to delete the directory")
+	}
+}
@@ -0,0 +1,263 @@
+package file2
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+import bs "file-structures/block/byteslice"
+
+const HISTOGRAM_BUCKETS = 24
+
+/*
+Histogram counts durations in buckets which double in width. Bucket 0 holds
+the durations below a microsecond, bucket i the ones below 2^i microseconds and
+the last bucket everything which is slower.
+*/
+type Histogram struct {
+	Count   int64
+	Total   time.Duration
+	Max     time.Duration
+	Buckets [HISTOGRAM_BUCKETS]int64
+}
+
+func (self *Histogram) add(d time.Duration) {
+	i := 0
+	for us := d / time.Microsecond; us > 0 && i < HISTOGRAM_BUCKETS-1; us >>= 1 {
+		i++
+	}
+	self.Buckets[i] += 1
+	self.Count += 1
+	self.Total += d
+	if d > self.Max {
+		self.Max = d
+	}
+}
+
+func (self *Histogram) Mean() time.Duration {
+	if self.Count == 0 {
+		return 0
+	}
+	return self.Total / time.Duration(self.Count)
+}
+
+// Percentile returns the upper bound of the bucket the p'th fraction of the
+// durations fall under, p is between 0 and 1.
+func (self *Histogram) Percentile(p float64) time.Duration {
+	seen := int64(0)
+	for i, n := range self.Buckets {
+		seen += n
+		if seen > 0 && float64(seen) >= p*float64(self.Count) {
+			if i == HISTOGRAM_BUCKETS-1 {
+				return self.Max
+			}
+			return time.Duration(1<<uint(i)) * time.Microsecond
+		}
+	}
+	return 0
+}
+
+/*
+Stats is a snapshot of the counters kept by a StatsFile or one of the cache
+files. A StatsFile leaves the cache counters empty and the cache files leave
+the latencies empty.
+*/
+type Stats struct {
+	Reads        int64
+	Writes       int64
+	BytesRead    int64
+	BytesWritten int64
+	Hits         int64
+	Misses       int64
+	HitRatio     float64
+	Evictions    int64 // pages dropped from a cache to make room
+	PageOuts     int64 // dirty pages written back to the file under a cache
+	Prefetches   int64 // pages read ahead of a sequential scan
+	Allocations  int64
+	Frees        int64
+	ReadLatency  Histogram
+	WriteLatency Histogram
+}
+
+type StatsSource interface {
+	Stats() Stats
+}
+
+// PublishStats makes the stats of source available through expvar under name.
+// The snapshot is taken every time the variable is read.
+func PublishStats(name string, source StatsSource) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("%s is already published", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return source.Stats()
+	}))
+	return nil
+}
+
+type counters struct {
+	lock  sync.Mutex
+	stats Stats
+}
+
+// count is a no op on a nil counters so an lru without an owner keeps none.
+func (self *counters) count(f func(stats *Stats)) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	f(&self.stats)
+}
+
+func (self *counters) read(n int) {
+	self.count(func(stats *Stats) {
+		stats.Reads += 1
+		stats.BytesRead += int64(n)
+	})
+}
+
+func (self *counters) lookup(hit bool) {
+	self.count(func(stats *Stats) {
+		if hit {
+			stats.Hits += 1
+		} else {
+			stats.Misses += 1
+		}
+	})
+}
+
+func (self *counters) write(n int) {
+	self.count(func(stats *Stats) {
+		stats.Writes += 1
+		stats.BytesWritten += int64(n)
+	})
+}
+
+func (self *counters) Stats() Stats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats := self.stats
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// ResetStats zeroes every counter.
+func (self *counters) ResetStats() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.stats = Stats{}
+}
+
+/*
+StatsFile counts the calls made to the device it wraps and times its reads and
+writes. Put it under a cache file to see what the cache lets through, or over
+one to see what the structure asks for.
+*/
+type StatsFile struct {
+	counters
+	file RemovableBlockDevice
+}
+
+func NewStatsFile(file RemovableBlockDevice) *StatsFile {
+	return &StatsFile{file: file}
+}
+
+func (self *StatsFile) Close() error { return self.file.Close() }
+
+func (self *StatsFile) Remove() error { return self.file.Remove() }
+
+func (self *StatsFile) Sync() error {
+	if syncer, ok := self.file.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (self *StatsFile) BlockSize() uint32 { return self.file.BlockSize() }
+
+func (self *StatsFile) ControlData() (data bs.ByteSlice, err error) {
+	return self.file.ControlData()
+}
+
+func (self *StatsFile) SetControlData(data bs.ByteSlice) (err error) {
+	return self.file.SetControlData(data)
+}
+
+func (self *StatsFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+func (self *StatsFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
+func (self *StatsFile) Free(key int64) error {
+	if err := self.file.Free(key); err != nil {
+		return err
+	}
+	self.count(func(stats *Stats) { stats.Frees += 1 })
+	return nil
+}
+
+func (self *StatsFile) MarkDead(key int64) error { return self.file.MarkDead(key) }
+
+func (self *StatsFile) Enter() (epoch int64) { return self.file.Enter() }
+
+func (self *StatsFile) Exit(epoch int64) error { return self.file.Exit(epoch) }
+
+func (self *StatsFile) Reclaim() error { return self.file.Reclaim() }
+
+func (self *StatsFile) Allocate() (key int64, err error) {
+	key, err = self.file.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += 1 })
+	return key, nil
+}
+
+func (self *StatsFile) AllocateBlocks(n int) (key int64, err error) {
+	key, err = self.file.AllocateBlocks(n)
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += int64(n) })
+	return key, nil
+}
+
+func (self *StatsFile) WriteBlock(key int64, block bs.ByteSlice) error {
+	start := time.Now()
+	if err := self.file.WriteBlock(key, block); err != nil {
+		return err
+	}
+	self.write(len(block))
+	self.count(func(stats *Stats) { stats.WriteLatency.add(time.Since(start)) })
+	return nil
+}
+
+func (self *StatsFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	start := time.Now()
+	block, err = self.file.ReadBlock(key)
+	if err != nil {
+		return nil, err
+	}
+	self.read(len(block))
+	self.count(func(stats *Stats) { stats.ReadLatency.add(time.Since(start)) })
+	return block, nil
+}
+
+func (self *StatsFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	start := time.Now()
+	blocks, err = self.file.ReadBlocks(key, n)
+	if err != nil {
+		return nil, err
+	}
+	self.read(len(blocks))
+	self.count(func(stats *Stats) { stats.ReadLatency.add(time.Since(start)) })
+	return blocks, nil
+}
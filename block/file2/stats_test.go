@@ -0,0 +1,159 @@
+package file2
+
+import "testing"
+
+import (
+	"expvar"
+	"strings"
+	"time"
+)
+
+func TestStatsFile(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	sf := NewStatsFile(mf)
+	A, err := sf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := sf.AllocateBlocks(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []int64{A, B, B + BLOCKSIZE} {
+		if err := sf.WriteBlock(key, filled(sf, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect_block(t, sf, A, 1)
+	if _, err := sf.ReadBlocks(B, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Free(A); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := sf.Stats()
+	if stats.Allocations != 3 || stats.Frees != 1 {
+		t.Fatalf("Expected 3 allocations and 1 free got %+v", stats)
+	}
+	if stats.Reads != 2 || stats.BytesRead != 3*BLOCKSIZE {
+		t.Fatalf("Expected 2 reads of 3 blocks got %d reads of %d bytes", stats.Reads, stats.BytesRead)
+	}
+	if stats.Writes != 3 || stats.BytesWritten != 3*BLOCKSIZE {
+		t.Fatalf("Expected 3 writes of 3 blocks got %d writes of %d bytes", stats.Writes, stats.BytesWritten)
+	}
+	if stats.ReadLatency.Count != 2 || stats.WriteLatency.Count != 3 {
+		t.Fatal("Expected every read and write to be timed")
+	}
+	sf.ResetStats()
+	if stats := sf.Stats(); stats.Reads != 0 || stats.WriteLatency.Count != 0 {
+		t.Fatalf("Expected the counters to be zeroed got %+v", stats)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for _, d := range []time.Duration{
+		500 * time.Nanosecond, time.Microsecond, 3 * time.Microsecond, 3 * time.Microsecond, time.Hour,
+	} {
+		h.add(d)
+	}
+	expected := map[int]int64{0: 1, 1: 1, 2: 2, HISTOGRAM_BUCKETS - 1: 1}
+	for i, n := range h.Buckets {
+		if n != expected[i] {
+			t.Fatalf("Expected bucket %d to hold %d got %d", i, expected[i], n)
+		}
+	}
+	if p := h.Percentile(.5); p != 4*time.Microsecond {
+		t.Fatalf("Expected the median to be under 4us got %v", p)
+	}
+	if p := h.Percentile(1); p != time.Hour {
+		t.Fatalf("Expected the slowest to be the max got %v", p)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	lru, err := NewLRUCacheFile(mf, 2*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []int64
+	for i := 0; i < 4; i++ {
+		key, err := lru.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if err := lru.WriteBlock(key, filled(lru, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the cache holds the last two blocks written
+	for i, key := range keys {
+		expect_block(t, lru, key, byte(i))
+	}
+	stats := lru.Stats()
+	if stats.Allocations != 4 || stats.Writes != 4 {
+		t.Fatalf("Expected 4 allocations and writes got %+v", stats)
+	}
+	if stats.Hits != 0 || stats.Misses != 4 || stats.HitRatio != 0 {
+		t.Fatalf("Expected every read to miss got %+v", stats)
+	}
+	if stats.Evictions == 0 || stats.PageOuts != 4 {
+		t.Fatalf("Expected the dirty pages to be paged out got %+v", stats)
+	}
+	expect_block(t, lru, keys[3], 3)
+	if stats := lru.Stats(); stats.Hits != 1 || stats.HitRatio != .2 {
+		t.Fatalf("Expected a hit got %+v", stats)
+	}
+
+	lfu, err := NewLFUCacheFile(NewMemBlockFile(), 2*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lfu.file.(*MemBlockFile).Open(); err != nil {
+		t.Fatal(err)
+	}
+	keys = nil
+	for i := 0; i < 4; i++ {
+		key, err := lfu.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < 3; i++ {
+		expect_block(t, lfu, keys[0], 0)
+	}
+	expect_block(t, lfu, keys[3], 0)
+	stats = lfu.Stats()
+	if stats.Allocations != 4 || stats.Reads != 4 || stats.Hits+stats.Misses != 4 {
+		t.Fatalf("Expected 4 allocations and reads got %+v", stats)
+	}
+	if stats.Misses == 0 || stats.Evictions != stats.PageOuts {
+		t.Fatalf("Expected the LFU cache to page out what it evicts got %+v", stats)
+	}
+}
+
+func TestPublishStats(t *testing.T) {
+	sf := NewStatsFile(NewMemBlockFile())
+	if err := PublishStats("file2_test_stats", sf); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishStats("file2_test_stats", sf); err == nil {
+		t.Fatal("Expected publishing the same name twice to fail")
+	}
+	sf.write(BLOCKSIZE)
+	if v := expvar.Get("file2_test_stats"); v == nil {
+		t.Fatal("Expected the stats to be published")
+	} else if !strings.Contains(v.String(), `"Writes":1,`) {
+		t.Fatalf("Expected the published stats to count the write got %s", v.String())
+	}
+}
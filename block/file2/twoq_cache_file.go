@@ -0,0 +1,428 @@
+package file2
+
+import (
+	"container/list"
+	"fmt"
+)
+
+import bs "file-structures/block/byteslice"
+
+/*
+TwoQCacheFile is a write back cache using the 2Q replacement policy. A page
+read or written for the first time joins the in queue, which is a FIFO holding
+a quarter of the cache. Pages falling off the end of the in queue leave
+their key in the ghost queue. A page which is asked for again while its key is
+still in the ghost queue was not a one off, it joins the main queue which is an
+LRU. A scan over the whole file only churns the in queue and leaves the hot
+pages in the main queue alone. Pages read ahead of a sequential scan join the
+in queue too, see SetReadahead.
+*/
+type TwoQCacheFile struct {
+	counters
+	file       RemovableBlockDevice
+	cache_size int
+	in_size    int
+	out_size   int
+	items      map[int64]*list.Element
+	ghosts     map[int64]*list.Element
+	in         *list.List
+	out        *list.List
+	main       *list.List
+	userdata   []byte
+	dead       DeadList
+	ahead      readahead
+}
+
+type twoq_item struct {
+	bytes []byte
+	p     int64
+	dirty bool
+	pins  int
+	main  bool
+}
+
+func NewTwoQCacheFile(file RemovableBlockDevice, size uint64) (cf *TwoQCacheFile, err error) {
+	cache_size := 1
+	if size > 0 {
+		cache_size = 1 + int(size/uint64(file.BlockSize()))
+	}
+	cf = &TwoQCacheFile{
+		file:       file,
+		cache_size: cache_size,
+		in_size:    1 + cache_size/4,
+		out_size:   1 + cache_size/2,
+		items:      make(map[int64]*list.Element),
+		ghosts:     make(map[int64]*list.Element),
+		in:         list.New(),
+		out:        list.New(),
+		main:       list.New(),
+		userdata:   make([]byte, file.BlockSize()-CONTROLSIZE),
+		ahead:      readahead{max: READAHEAD},
+	}
+	return cf, nil
+}
+
+func OpenTwoQCacheFile(file RemovableBlockDevice, size uint64) (cf *TwoQCacheFile, err error) {
+	cf, err = NewTwoQCacheFile(file, size)
+	if err != nil {
+		return nil, err
+	}
+	if cf.userdata, err = cf.file.ControlData(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (self *TwoQCacheFile) Close() error {
+	if err := self.dead.ReleaseAll(self.Free); err != nil {
+		return err
+	}
+	if err := self.file.Close(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self *TwoQCacheFile) Remove() error {
+	return self.file.Remove()
+}
+
+// Persist writes out the dirty pages and the control data and empties the
+// cache of everything but the pinned pages.
+func (self *TwoQCacheFile) Persist() error {
+	for _, queue := range []*list.List{self.in, self.main} {
+		for e := queue.Back(); e != nil; {
+			i := e.Value.(*twoq_item)
+			prev := e.Prev()
+			if i.dirty {
+				if err := self.pageout(i); err != nil {
+					return err
+				}
+			}
+			if i.pins == 0 {
+				delete(self.items, i.p)
+				queue.Remove(e)
+			}
+			e = prev
+		}
+	}
+	if read_only(self.file) {
+		return nil
+	}
+	return self.file.SetControlData(self.userdata)
+}
+
+func (self *TwoQCacheFile) ControlData() (data bs.ByteSlice, err error) {
+	data = make(bs.ByteSlice, self.file.BlockSize()-CONTROLSIZE)
+	copy(data, self.userdata)
+	return data, nil
+}
+
+func (self *TwoQCacheFile) SetControlData(data bs.ByteSlice) (err error) {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	if len(data) > int(self.file.BlockSize()-CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	self.userdata = make([]byte, self.file.BlockSize()-CONTROLSIZE)
+	copy(self.userdata, data)
+	return nil
+}
+
+func (self *TwoQCacheFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+func (self *TwoQCacheFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
+func (self *TwoQCacheFile) BlockSize() uint32 { return self.file.BlockSize() }
+
+func (self *TwoQCacheFile) ReadOnly() bool { return read_only(self.file) }
+
+func (self *TwoQCacheFile) Free(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	if e, has := self.items[key]; has {
+		i := e.Value.(*twoq_item)
+		if i.pins > 0 {
+			return fmt.Errorf("Cannot free pinned block %d", key)
+		}
+		self.queue(i).Remove(e)
+		delete(self.items, key)
+	}
+	if e, has := self.ghosts[key]; has {
+		self.out.Remove(e)
+		delete(self.ghosts, key)
+	}
+	if err := self.file.Free(key); err != nil {
+		return err
+	}
+	self.count(func(stats *Stats) { stats.Frees += 1 })
+	return nil
+}
+
+func (self *TwoQCacheFile) Allocate() (key int64, err error) {
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
+	key, err = self.file.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += 1 })
+	return key, nil
+}
+
+func (self *TwoQCacheFile) AllocateBlocks(n int) (key int64, err error) {
+	if err := check_writable(self.file); err != nil {
+		return 0, err
+	}
+	key, err = self.file.AllocateBlocks(n)
+	if err != nil {
+		return 0, err
+	}
+	self.count(func(stats *Stats) { stats.Allocations += int64(n) })
+	return key, nil
+}
+
+// MarkDead keeps the block readable, it is freed by the first Reclaim after
+// every reader that might still reach it has exited.
+func (self *TwoQCacheFile) MarkDead(key int64) error {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	return self.dead.Mark(key)
+}
+
+func (self *TwoQCacheFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *TwoQCacheFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *TwoQCacheFile) Reclaim() error {
+	return self.dead.Reclaim(self.Free)
+}
+
+// Pin keeps the block in the cache until it has been unpinned as many times as
+// it was pinned.
+func (self *TwoQCacheFile) Pin(key int64) error {
+	if _, has := self.items[key]; !has {
+		if _, err := self.ReadBlock(key); err != nil {
+			return err
+		}
+	}
+	e, has := self.items[key]
+	if !has {
+		return fmt.Errorf("Block %d could not be brought into the cache", key)
+	}
+	e.Value.(*twoq_item).pins += 1
+	return nil
+}
+
+func (self *TwoQCacheFile) Unpin(key int64) error {
+	if e, has := self.items[key]; has {
+		if i := e.Value.(*twoq_item); i.pins > 0 {
+			i.pins -= 1
+			return nil
+		}
+	}
+	return fmt.Errorf("Block %d is not pinned", key)
+}
+
+// SetReadahead sets the most blocks a miss during a sequential scan reads in
+// one go, 0 turns readahead off. It never reads more than half the in queue so
+// the pages read ahead are still there when the scan gets to them.
+func (self *TwoQCacheFile) SetReadahead(max int) {
+	self.ahead = readahead{max: max}
+}
+
+func (self *TwoQCacheFile) queue(i *twoq_item) *list.List {
+	if i.main {
+		return self.main
+	}
+	return self.in
+}
+
+func (self *TwoQCacheFile) pageout(i *twoq_item) error {
+	if err := self.file.WriteBlock(i.p, i.bytes); err != nil {
+		return err
+	}
+	i.dirty = false
+	self.count(func(stats *Stats) { stats.PageOuts += 1 })
+	return nil
+}
+
+// twoq_victim finds the oldest page in the queue which is not pinned.
+func twoq_victim(queue *list.List) *list.Element {
+	for e := queue.Back(); e != nil; e = e.Prev() {
+		if e.Value.(*twoq_item).pins == 0 {
+			return e
+		}
+	}
+	return nil
+}
+
+// make_room evicts pages until there is room for one more, in the main queue
+// or in the in queue. The in queue is kept to its share even while the cache
+// has room, otherwise a hot set smaller than the cache never leaves it and a
+// scan flushes it like it would a LRU.
+func (self *TwoQCacheFile) make_room(main bool) error {
+	for {
+		full := len(self.items) >= self.cache_size
+		if !full && (main || self.in.Len() < self.in_size) {
+			return nil
+		}
+		in, old := twoq_victim(self.in), twoq_victim(self.main)
+		var e *list.Element
+		if self.in.Len() >= self.in_size && in != nil {
+			e = in
+		} else if full && old != nil {
+			e = old
+		} else if full {
+			e = in
+		} else {
+			// the in queue is over its share but all of it is pinned
+			return nil
+		}
+		if e == nil {
+			return ErrCacheFull
+		}
+		if err := self.evict(e); err != nil {
+			return err
+		}
+	}
+}
+
+// evict drops a page from the cache, the keys of the pages dropped from the in
+// queue are remembered in the ghost queue.
+func (self *TwoQCacheFile) evict(e *list.Element) error {
+	i := e.Value.(*twoq_item)
+	if i.dirty {
+		if err := self.pageout(i); err != nil {
+			return err
+		}
+	}
+	self.queue(i).Remove(e)
+	delete(self.items, i.p)
+	if !i.main {
+		self.ghosts[i.p] = self.out.PushFront(i.p)
+		for self.out.Len() > self.out_size {
+			delete(self.ghosts, self.out.Remove(self.out.Back()).(int64))
+		}
+	}
+	self.count(func(stats *Stats) { stats.Evictions += 1 })
+	return nil
+}
+
+// insert caches a page which is not in the cache yet.
+func (self *TwoQCacheFile) insert(key int64, block []byte, dirty bool) error {
+	i := &twoq_item{p: key, bytes: block, dirty: dirty}
+	if e, has := self.ghosts[key]; has {
+		self.out.Remove(e)
+		delete(self.ghosts, key)
+		i.main = true
+	}
+	if err := self.make_room(i.main); err != nil {
+		return err
+	}
+	self.items[key] = self.queue(i).PushFront(i)
+	return nil
+}
+
+// known says whether the page is cached or its key is in the ghost queue, read
+// ahead stops short of both so reading a page ahead never promotes it.
+func (self *TwoQCacheFile) known(key int64) bool {
+	_, cached := self.items[key]
+	_, ghost := self.ghosts[key]
+	return cached || ghost
+}
+
+// touch records a hit, only pages in the main queue move. The in queue is a
+// FIFO so a page read over and over while it is new still falls out of it.
+func (self *TwoQCacheFile) touch(e *list.Element) {
+	if i := e.Value.(*twoq_item); i.main {
+		self.main.MoveToFront(e)
+	}
+}
+
+func (self *TwoQCacheFile) WriteBlock(key int64, block bs.ByteSlice) (err error) {
+	if err := check_writable(self.file); err != nil {
+		return err
+	}
+	if e, has := self.items[key]; has {
+		i := e.Value.(*twoq_item)
+		i.bytes = block
+		i.dirty = true
+		self.touch(e)
+	} else if err := self.insert(key, block, true); err != nil {
+		return err
+	}
+	self.write(len(block))
+	return nil
+}
+
+func (self *TwoQCacheFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	blk_size := int64(self.BlockSize())
+	seq := self.ahead.sequential(key, blk_size)
+	e, has := self.items[key]
+	self.lookup(has)
+	if has {
+		self.touch(e)
+		block = e.Value.(*twoq_item).bytes
+	} else {
+		n := 1
+		if seq {
+			n = self.ahead.grow(self.in_size / 2)
+		}
+		blocks, err := prefetch(self.file, key, n, self.known)
+		if err != nil {
+			return nil, err
+		}
+		block = blocks[0]
+		if err := self.insert(key, block, false); err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(blocks); i++ {
+			err := self.insert(key+int64(i)*blk_size, blocks[i], false)
+			if err == ErrCacheFull {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			self.count(func(stats *Stats) { stats.Prefetches += 1 })
+		}
+	}
+	self.read(len(block))
+	return block, nil
+}
+
+func (self *TwoQCacheFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	blk_size := int64(self.BlockSize())
+	cached := false
+	for i := int64(0); i < int64(n); i++ {
+		if _, has := self.items[key+i*blk_size]; has {
+			cached = true
+		}
+	}
+	if !cached {
+		// like the LRU the run is not cached, it is most likely read once
+		self.lookup(false)
+		self.read(int(blk_size) * n)
+		return self.file.ReadBlocks(key, n)
+	}
+	blocks = make(bs.ByteSlice, n*int(blk_size))
+	for i := int64(0); i < int64(n); i++ {
+		blk, err := self.ReadBlock(key + i*blk_size)
+		if err != nil {
+			return nil, err
+		}
+		copy(blocks[i*blk_size:(i+1)*blk_size], blk)
+	}
+	return blocks, nil
+}
@@ -0,0 +1,258 @@
+package file2
+
+import "testing"
+
+import (
+	"math/rand"
+)
+
+func TestTwoQWriteBack(t *testing.T) {
+	const ITEMS = 500
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewTwoQCacheFile(mf, 8*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[int64]byte)
+	var keys []int64
+	for i := 0; i < ITEMS; i++ {
+		key, err := cf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		values[key] = byte(i)
+		if err := cf.WriteBlock(key, filled(cf, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		R := keys[rand.Intn(len(keys)/2+1)]
+		expect_block(t, cf, R, values[R])
+	}
+	for i := 0; i < ITEMS*2; i++ {
+		key := keys[rand.Intn(len(keys))]
+		values[key] = byte(rand.Intn(256))
+		if err := cf.WriteBlock(key, filled(cf, values[key])); err != nil {
+			t.Fatal(err)
+		}
+		R := keys[rand.Intn(len(keys))]
+		expect_block(t, cf, R, values[R])
+	}
+	if err := cf.SetControlData(filled(cf, 7)[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	for key, b := range values {
+		expect_block(t, mf, key, b)
+	}
+	if data, err := mf.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data[:10].Eq(filled(cf, 7)[:10]) {
+		t.Fatal("Expected Persist to write the control data")
+	}
+	if stats := cf.Stats(); stats.Evictions == 0 || stats.PageOuts == 0 {
+		t.Fatalf("Expected pages to be evicted and paged out got %+v", stats)
+	}
+}
+
+// A scan through more blocks than the cache holds flushes a LRU but leaves the
+// pages 2Q has seen more than once where they are.
+func TestTwoQScanResistance(t *testing.T) {
+	const CACHE = 19 * BLOCKSIZE
+	const HOT = 5
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []int64
+	for i := 0; i < 300; i++ {
+		key, err := mf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if err := mf.WriteBlock(key, filled(mf, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hot, cold, scan := keys[:HOT], keys[HOT:HOT+8], keys[HOT+8:]
+	workload := func(f BlockDevice) {
+		for _, group := range [][]int64{hot, cold, hot, scan} {
+			for _, key := range group {
+				if _, err := f.ReadBlock(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	hits := func(f StatsSource) int64 { return f.Stats().Hits }
+
+	twoq, err := NewTwoQCacheFile(mf, CACHE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hot pages are read in order, reading them ahead would hide the policy
+	twoq.SetReadahead(0)
+	workload(twoq)
+	before := hits(twoq)
+	for i, key := range hot {
+		expect_block(t, twoq, key, byte(i))
+	}
+	if got := hits(twoq) - before; got != HOT {
+		t.Fatalf("Expected the hot pages to survive the scan got %d hits", got)
+	}
+
+	lru, err := NewLRUCacheFile(mf, CACHE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lru.SetReadahead(0)
+	workload(lru)
+	before = hits(lru)
+	for i, key := range hot {
+		expect_block(t, lru, key, byte(i))
+	}
+	if got := hits(lru) - before; got != 0 {
+		t.Fatalf("Expected the scan to flush the LRU got %d hits", got)
+	}
+}
+
+func TestTwoQPin(t *testing.T) {
+	mf := NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := NewTwoQCacheFile(mf, 4*BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []int64
+	for i := 0; i < 10; i++ {
+		key, err := cf.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+		if err := cf.WriteBlock(key, filled(cf, byte(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		if i < 3 {
+			if err := cf.Pin(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if blk, err := mf.ReadBlock(keys[0]); err != nil {
+		t.Fatal(err)
+	} else if blk.Eq(filled(cf, 1)) {
+		t.Fatal("Expected the pinned page to stay in the cache unwritten")
+	}
+	if err := cf.Free(keys[0]); err == nil {
+		t.Fatal("Expected freeing a pinned block to fail")
+	}
+	for i, key := range keys[:3] {
+		if err := cf.Unpin(key); err != nil {
+			t.Fatal(err)
+		}
+		expect_block(t, cf, key, byte(i+1))
+	}
+	if err := cf.Unpin(keys[0]); err == nil {
+		t.Fatal("Expected unpinning an unpinned block to fail")
+	}
+}
+
+type cachemaker func(file RemovableBlockDevice, size uint64) (RemovableBlockDevice, StatsSource)
+
+var caches = []struct {
+	name string
+	make cachemaker
+}{
+	{"LRU", func(f RemovableBlockDevice, size uint64) (RemovableBlockDevice, StatsSource) {
+		cf, _ := NewLRUCacheFile(f, size)
+		return cf, cf
+	}},
+	{"LFU", func(f RemovableBlockDevice, size uint64) (RemovableBlockDevice, StatsSource) {
+		cf, _ := NewLFUCacheFile(f, size)
+		return cf, cf
+	}},
+	{"2Q", func(f RemovableBlockDevice, size uint64) (RemovableBlockDevice, StatsSource) {
+		cf, _ := NewTwoQCacheFile(f, size)
+		return cf, cf
+	}},
+}
+
+func benchcaches(b *testing.B, workload func(b *testing.B, f BlockDevice)) {
+	const CACHESIZE = 64 * BLOCKSIZE
+	for _, cache := range caches {
+		b.Run(cache.name, func(b *testing.B) {
+			mf := NewMemBlockFile()
+			if err := mf.Open(); err != nil {
+				b.Fatal(err)
+			}
+			f, stats := cache.make(mf, CACHESIZE)
+			b.ResetTimer()
+			workload(b, f)
+			b.ReportMetric(stats.Stats().HitRatio, "hits/op")
+		})
+	}
+}
+
+// BenchmarkPageOut runs the TestPageOut workload, allocations and writes
+// followed by random rewrites and reads.
+func BenchmarkPageOut(b *testing.B) {
+	benchcaches(b, func(b *testing.B, f BlockDevice) {
+		r := rand.New(rand.NewSource(1))
+		var keys []int64
+		for i := 0; i < b.N; i++ {
+			if len(keys) < 1000 {
+				key, err := f.Allocate()
+				if err != nil {
+					b.Fatal(err)
+				}
+				keys = append(keys, key)
+				if err := f.WriteBlock(key, filled(f, byte(key))); err != nil {
+					b.Fatal(err)
+				}
+			}
+			R := keys[r.Intn(len(keys)/2+1)]
+			if _, err := f.ReadBlock(R); err != nil {
+				b.Fatal(err)
+			}
+			W := keys[r.Intn(len(keys))]
+			if err := f.WriteBlock(W, filled(f, byte(W))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkScan reads a hot set which fits in the cache interleaved with a
+// sequential scan of the file, the pattern of a LinearHash.Keys() iteration
+// running next to lookups.
+func BenchmarkScan(b *testing.B) {
+	benchcaches(b, func(b *testing.B, f BlockDevice) {
+		r := rand.New(rand.NewSource(1))
+		var keys []int64
+		for i := 0; i < 1000; i++ {
+			key, err := f.Allocate()
+			if err != nil {
+				b.Fatal(err)
+			}
+			keys = append(keys, key)
+			if err := f.WriteBlock(key, filled(f, byte(key))); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for i := 0; i < b.N; i++ {
+			for _, key := range []int64{keys[r.Intn(40)], keys[i%len(keys)]} {
+				if _, err := f.ReadBlock(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package file2
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+import bs "file-structures/block/byteslice"
+
+/*
+WALFile journals the block images written during a transaction to a sidecar
+log before they are applied to the wrapped device. Between Begin and Commit
+the WriteBlock and SetControlData calls are held in memory. Commit writes them
+to the log, syncs it, applies them to the device and then truncates the log. If
+the process dies part way through applying a transaction the next Open replays
+it, if it dies before the commit record reached the log the transaction is
+discarded. A Commit which fails before the commit record is durable leaves the
+transaction open so that it can be retried or aborted. One which fails after
+leaves the transaction pending in the log, every later call replays it first
+and the log is not reused until it has been.
+
+Frees issued inside a transaction are deferred until after the log has been
+truncated so that a block is never reused while the committed structure may
+still point at it. A crash during that final step leaks the remaining blocks
+instead of double freeing them. Allocations are not logged, the device is
+synced before the commit record is written so that the blocks a replayed
+transaction writes to are never still on the free list.
+
+Blocks marked dead inside a transaction only join the dead list once it has
+committed. Reclaim frees them straight on the device since the transaction that
+killed them is already durable.
+
+Outside of a transaction every call passes straight through to the device.
+*/
+type WALFile struct {
+	file    RemovableBlockDevice
+	path    string
+	log     *os.File
+	txn     *transaction
+	pending *transaction // committed to the log but not yet applied in full
+	dead    DeadList
+}
+
+type transaction struct {
+	blocks    map[int64]bs.ByteSlice
+	order     []int64
+	ctrl      bs.ByteSlice
+	allocated []int64
+	freed     []int64
+	dead      []int64
+}
+
+const (
+	WAL_BLOCK = 1 + iota
+	WAL_CONTROL
+	WAL_FREE
+	WAL_COMMIT
+)
+
+const WAL_RECORD_HEADER = 13
+const WAL_RECORD_OVERHEAD = WAL_RECORD_HEADER + 4
+
+type wal_record struct {
+	kind uint8
+	key  int64
+	data bs.ByteSlice
+}
+
+func (self *wal_record) Bytes() []byte {
+	bytes := make([]byte, WAL_RECORD_OVERHEAD+len(self.data))
+	bytes[0] = self.kind
+	copy(bytes[1:9], bs.ByteSlice64(uint64(self.key)))
+	copy(bytes[9:13], bs.ByteSlice32(uint32(len(self.data))))
+	copy(bytes[13:13+len(self.data)], self.data)
+	end := WAL_RECORD_HEADER + len(self.data)
+	copy(bytes[end:], bs.ByteSlice32(crc32.ChecksumIEEE(bytes[:end])))
+	return bytes
+}
+
+func load_wal_record(bytes bs.ByteSlice) (rec *wal_record, size int, err error) {
+	if len(bytes) < WAL_RECORD_OVERHEAD {
+		return nil, 0, fmt.Errorf("Short log record")
+	}
+	length := int(bytes[9:13].Int32())
+	end := WAL_RECORD_HEADER + length
+	if length > len(bytes)-WAL_RECORD_OVERHEAD {
+		return nil, 0, fmt.Errorf("Short log record")
+	}
+	chksum := bytes[end : end+4].Int32()
+	if new_chksum := crc32.ChecksumIEEE(bytes[:end]); new_chksum != chksum {
+		return nil, 0, fmt.Errorf("Bad log record checksum %x != %x", new_chksum, chksum)
+	}
+	rec = &wal_record{
+		kind: bytes[0],
+		key:  int64(bytes[1:9].Int64()),
+		data: bytes[WAL_RECORD_HEADER:end],
+	}
+	return rec, end + 4, nil
+}
+
+func NewWALFile(file RemovableBlockDevice, path string) *WALFile {
+	return &WALFile{
+		file: file,
+		path: path,
+	}
+}
+
+func (self *WALFile) Open() error {
+	if f, err := os.OpenFile(self.path, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return err
+	} else {
+		self.log = f
+	}
+	return self.recover()
+}
+
+func (self *WALFile) Close() error {
+	if self.txn != nil {
+		if err := self.Abort(); err != nil {
+			return err
+		}
+	}
+	if err := self.dead.ReleaseAll(self.file.Free); err != nil {
+		return err
+	}
+	if err := self.log.Close(); err != nil {
+		return err
+	}
+	self.log = nil
+	return self.file.Close()
+}
+
+func (self *WALFile) Remove() error {
+	if self.log != nil {
+		return fmt.Errorf("Expected file to be closed")
+	}
+	if err := self.file.Remove(); err != nil {
+		return err
+	}
+	return os.Remove(self.path)
+}
+
+func (self *WALFile) Path() string { return self.path }
+
+func (self *WALFile) InTransaction() bool { return self.txn != nil }
+
+func (self *WALFile) Begin() error {
+	if self.txn != nil {
+		return fmt.Errorf("Transaction already in progress")
+	}
+	if err := self.replay(); err != nil {
+		return err
+	}
+	self.txn = &transaction{
+		blocks: make(map[int64]bs.ByteSlice),
+	}
+	return nil
+}
+
+func (self *WALFile) Commit() error {
+	if self.txn == nil {
+		return fmt.Errorf("No transaction in progress")
+	}
+	txn := self.txn
+	records := txn.records()
+	if len(records) > 0 {
+		if err := self.sync(); err != nil {
+			return err
+		}
+		if err := self.write_log(records); err != nil {
+			self.clear_log()
+			return err
+		}
+	}
+	self.txn = nil
+	self.pending = txn
+	return self.replay()
+}
+
+// replay applies the pending transaction, it stays pending until the log has
+// been truncated.
+func (self *WALFile) replay() error {
+	txn := self.pending
+	if txn == nil {
+		return nil
+	}
+	var freed []int64
+	if records := txn.records(); len(records) > 0 {
+		var err error
+		if freed, err = self.apply(records); err != nil {
+			return err
+		}
+	}
+	self.pending = nil
+	for _, key := range txn.dead {
+		if err := self.dead.Mark(key); err != nil {
+			return err
+		}
+	}
+	return self.free_all(freed)
+}
+
+func (self *WALFile) Abort() error {
+	if self.txn == nil {
+		return fmt.Errorf("No transaction in progress")
+	}
+	txn := self.txn
+	self.txn = nil
+	for _, key := range txn.allocated {
+		if err := self.file.Free(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *transaction) records() (records []*wal_record) {
+	for _, key := range self.order {
+		if block, has := self.blocks[key]; has {
+			records = append(records, &wal_record{kind: WAL_BLOCK, key: key, data: block})
+		}
+	}
+	if self.ctrl != nil {
+		records = append(records, &wal_record{kind: WAL_CONTROL, data: self.ctrl})
+	}
+	for _, key := range self.freed {
+		records = append(records, &wal_record{kind: WAL_FREE, key: key})
+	}
+	return records
+}
+
+func (self *WALFile) sync() error {
+	if syncer, ok := self.file.(Syncer); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (self *WALFile) write_log(records []*wal_record) error {
+	var log []byte
+	for _, rec := range records {
+		log = append(log, rec.Bytes()...)
+	}
+	commit := &wal_record{kind: WAL_COMMIT, key: int64(len(records))}
+	log = append(log, commit.Bytes()...)
+	if err := self.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := self.log.WriteAt(log, 0); err != nil {
+		return err
+	}
+	return self.log.Sync()
+}
+
+func (self *WALFile) clear_log() error {
+	if err := self.log.Truncate(0); err != nil {
+		return err
+	}
+	return self.log.Sync()
+}
+
+func (self *WALFile) read_log() (records []*wal_record, err error) {
+	if _, err := self.log.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	bytes, err := ioutil.ReadAll(self.log)
+	if err != nil {
+		return nil, err
+	}
+	log := bs.ByteSlice(bytes)
+	for len(log) > 0 {
+		rec, size, err := load_wal_record(log)
+		if err != nil {
+			// a torn tail, the transaction never committed
+			return nil, nil
+		}
+		log = log[size:]
+		if rec.kind == WAL_COMMIT {
+			if int(rec.key) != len(records) {
+				return nil, fmt.Errorf("Log commit record expected %d records got %d",
+					rec.key, len(records))
+			}
+			return records, nil
+		}
+		records = append(records, rec)
+	}
+	return nil, nil
+}
+
+func (self *WALFile) recover() error {
+	records, err := self.read_log()
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		return self.clear_log()
+	}
+	freed, err := self.apply(records)
+	if err != nil {
+		return err
+	}
+	return self.free_all(freed)
+}
+
+// apply writes the records to the device and truncates the log, it gives back
+// the blocks the transaction freed for the caller to free once the log is
+// gone.
+func (self *WALFile) apply(records []*wal_record) (freed []int64, err error) {
+	for _, rec := range records {
+		switch rec.kind {
+		case WAL_BLOCK:
+			if err := self.file.WriteBlock(rec.key, rec.data); err != nil {
+				return nil, err
+			}
+		case WAL_CONTROL:
+			if err := self.file.SetControlData(rec.data); err != nil {
+				return nil, err
+			}
+		case WAL_FREE:
+			freed = append(freed, rec.key)
+		default:
+			return nil, fmt.Errorf("Unknown log record kind %d", rec.kind)
+		}
+	}
+	if err := self.sync(); err != nil {
+		return nil, err
+	}
+	if err := self.clear_log(); err != nil {
+		return nil, err
+	}
+	return freed, nil
+}
+
+func (self *WALFile) free_all(keys []int64) error {
+	for _, key := range keys {
+		if err := self.file.Free(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *WALFile) ControlData() (data bs.ByteSlice, err error) {
+	if err := self.replay(); err != nil {
+		return nil, err
+	}
+	if self.txn != nil && self.txn.ctrl != nil {
+		data = make(bs.ByteSlice, len(self.txn.ctrl))
+		copy(data, self.txn.ctrl)
+		return data, nil
+	}
+	return self.file.ControlData()
+}
+
+func (self *WALFile) SetControlData(data bs.ByteSlice) (err error) {
+	if err := self.replay(); err != nil {
+		return err
+	}
+	if self.txn == nil {
+		return self.file.SetControlData(data)
+	}
+	if len(data) > int(self.file.BlockSize()-CONTROLSIZE) {
+		return fmt.Errorf("control data was too large")
+	}
+	self.txn.ctrl = make(bs.ByteSlice, self.file.BlockSize()-CONTROLSIZE)
+	copy(self.txn.ctrl, data)
+	return nil
+}
+
+func (self *WALFile) StructureType() (stype uint32, err error) {
+	return self.file.StructureType()
+}
+
+// SetStructureType is not part of the transaction, the tag is written to the
+// device straight away.
+func (self *WALFile) SetStructureType(stype uint32) error {
+	return self.file.SetStructureType(stype)
+}
+
+func (self *WALFile) BlockSize() uint32 { return self.file.BlockSize() }
+
+func (self *WALFile) Free(key int64) error {
+	if err := self.replay(); err != nil {
+		return err
+	}
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is dead, it is freed by Reclaim", key)
+	}
+	if self.txn == nil {
+		return self.file.Free(key)
+	}
+	delete(self.txn.blocks, key)
+	self.txn.freed = append(self.txn.freed, key)
+	return nil
+}
+
+func (self *WALFile) MarkDead(key int64) error {
+	if self.txn == nil {
+		return self.dead.Mark(key)
+	}
+	if self.dead.Has(key) {
+		return fmt.Errorf("Block %d is already dead", key)
+	}
+	self.txn.dead = append(self.txn.dead, key)
+	return nil
+}
+
+func (self *WALFile) Enter() (epoch int64) { return self.dead.Enter() }
+
+func (self *WALFile) Exit(epoch int64) error { return self.dead.Exit(epoch) }
+
+func (self *WALFile) Reclaim() error {
+	return self.dead.Reclaim(self.file.Free)
+}
+
+func (self *WALFile) Allocate() (key int64, err error) {
+	if err := self.replay(); err != nil {
+		return 0, err
+	}
+	key, err = self.file.Allocate()
+	if err != nil {
+		return 0, err
+	}
+	if self.txn != nil {
+		self.txn.allocated = append(self.txn.allocated, key)
+	}
+	return key, nil
+}
+
+func (self *WALFile) AllocateBlocks(n int) (key int64, err error) {
+	if err := self.replay(); err != nil {
+		return 0, err
+	}
+	key, err = self.file.AllocateBlocks(n)
+	if err != nil {
+		return 0, err
+	}
+	if self.txn != nil {
+		blk_size := int64(self.BlockSize())
+		for i := int64(0); i < int64(n); i++ {
+			self.txn.allocated = append(self.txn.allocated, key+i*blk_size)
+		}
+	}
+	return key, nil
+}
+
+func (self *WALFile) WriteBlock(key int64, block bs.ByteSlice) (err error) {
+	if err := self.replay(); err != nil {
+		return err
+	}
+	if self.txn == nil {
+		return self.file.WriteBlock(key, block)
+	}
+	if len(block) != int(self.BlockSize()) {
+		return fmt.Errorf("Expected a block of %d bytes got %d", self.BlockSize(), len(block))
+	}
+	if _, has := self.txn.blocks[key]; !has {
+		self.txn.order = append(self.txn.order, key)
+	}
+	self.txn.blocks[key] = block.Copy()
+	return nil
+}
+
+func (self *WALFile) ReadBlock(key int64) (block bs.ByteSlice, err error) {
+	if err := self.replay(); err != nil {
+		return nil, err
+	}
+	if self.txn != nil {
+		if block, has := self.txn.blocks[key]; has {
+			return block.Copy(), nil
+		}
+	}
+	return self.file.ReadBlock(key)
+}
+
+func (self *WALFile) ReadBlocks(key int64, n int) (blocks bs.ByteSlice, err error) {
+	if err := self.replay(); err != nil {
+		return nil, err
+	}
+	blocks, err = self.file.ReadBlocks(key, n)
+	if err != nil {
+		return nil, err
+	}
+	if self.txn != nil {
+		blocks = blocks.Copy()
+		blk_size := int64(self.BlockSize())
+		for i := int64(0); i < int64(n); i++ {
+			if block, has := self.txn.blocks[key+i*blk_size]; has {
+				copy(blocks[i*blk_size:(i+1)*blk_size], block)
+			}
+		}
+	}
+	return blocks, nil
+}
@@ -0,0 +1,331 @@
+package file2
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	buf "../buffers"
+	bs "file-structures/block/byteslice"
+)
+
+const WALPATH = "/tmp/__x_wal"
+
+func testwal(t *testing.T) *WALFile {
+	cleanup(PATH)
+	cleanup(WALPATH)
+	return openwal(t)
+}
+
+func openwal(t *testing.T) *WALFile {
+	bf := NewBlockFile(PATH, &buf.NoBuffer{})
+	if err := bf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := NewWALFile(bf, WALPATH)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return wf
+}
+
+func reopenwal(t *testing.T, wf *WALFile) *WALFile {
+	if err := wf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openwal(t)
+}
+
+func cleanupwal(wf *WALFile) {
+	if wf.log != nil {
+		wf.Close()
+	}
+	wf.Remove()
+}
+
+func filled(f BlockDevice, b byte) bs.ByteSlice {
+	blk := make(bs.ByteSlice, f.BlockSize())
+	for i := range blk {
+		blk[i] = b
+	}
+	return blk
+}
+
+func expect_block(t *testing.T, f BlockDevice, key int64, b byte) {
+	if rblk, err := f.ReadBlock(key); err != nil {
+		t.Fatal(err)
+	} else if !rblk.Eq(filled(f, b)) {
+		t.Fatalf("Expected block %d to be filled with %x got %v", key, b, rblk[:8])
+	}
+}
+
+func TestWALGenericWriteRead(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 0xf)); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, wf, A, 0xf)
+	if err := wf.Free(A); err != nil {
+		t.Fatal(err)
+	}
+	if B, err := wf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if A != B {
+		t.Fatalf("Expected A == B got %d != %d", A, B)
+	}
+}
+
+func TestWALCommit(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Begin(); err == nil {
+		t.Fatal("Expected nested Begin to fail")
+	}
+	B, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.SetControlData([]byte("committed")); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, wf, A, 2)
+	expect_block(t, wf.file, A, 1)
+	if err := wf.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	wf = reopenwal(t, wf)
+	expect_block(t, wf, A, 2)
+	expect_block(t, wf, B, 3)
+	if data, err := wf.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if string(data[:9]) != "committed" {
+		t.Fatalf("Expected control data to be committed got %v", data[:9])
+	}
+}
+
+func TestWALAbort(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	B, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Free(A); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.SetControlData([]byte("aborted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Abort(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect_block(t, wf, A, 1)
+	if data, err := wf.ControlData(); err != nil {
+		t.Fatal(err)
+	} else if !data.Zero() {
+		t.Fatalf("Expected control data to be empty got %v", data[:8])
+	}
+	if C, err := wf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if B != C {
+		t.Fatalf("Expected the aborted allocation to be reused %d != %d", B, C)
+	}
+}
+
+func TestWALCommitFailure(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	B, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a log which can not be written to
+	wf.log.Close()
+	if wf.log, err = os.Open(WALPATH); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Commit(); err == nil {
+		t.Fatal("Expected the commit to fail")
+	}
+	if !wf.InTransaction() {
+		t.Fatal("Expected the transaction to still be open")
+	}
+	if err := wf.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if C, err := wf.Allocate(); err != nil {
+		t.Fatal(err)
+	} else if B != C {
+		t.Fatalf("Expected the aborted allocation to be reused %d != %d", B, C)
+	}
+}
+
+// A write which fails while a committed transaction is applied leaves it in
+// the log, the next transaction must not truncate it away.
+func TestWALApplyFailure(t *testing.T) {
+	defer os.Remove(WALPATH)
+	os.Remove(WALPATH)
+	ff := NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := NewWALFile(ff, WALPATH)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer wf.Close()
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ff.RefuseWrite(1)
+	if err := wf.Commit(); err != ErrInjected {
+		t.Fatalf("Expected the failed write from Commit got %v", err)
+	}
+	if wf.InTransaction() {
+		t.Fatal("Expected the transaction to be committed")
+	}
+
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	B, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expect_block(t, wf, A, 2)
+	expect_block(t, wf, B, 3)
+}
+
+func TestWALRecover(t *testing.T) {
+	wf := testwal(t)
+	defer cleanupwal(wf)
+	A, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	B, err := wf.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash after the commit record reached the log but before
+	// any of the blocks were applied.
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.write_log(wf.txn.records()); err != nil {
+		t.Fatal(err)
+	}
+	wf.txn = nil
+	expect_block(t, wf, A, 1)
+
+	wf = reopenwal(t, wf)
+	expect_block(t, wf, A, 2)
+	expect_block(t, wf, B, 2)
+	if info, err := os.Stat(WALPATH); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Fatalf("Expected the log to be truncated got %d bytes", info.Size())
+	}
+
+	// simulate a crash while the log was being written, the torn
+	// transaction must be discarded.
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(A, filled(wf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.WriteBlock(B, filled(wf, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.write_log(wf.txn.records()); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(WALPATH); err != nil {
+		t.Fatal(err)
+	} else if err := wf.log.Truncate(info.Size() - WAL_RECORD_OVERHEAD - 1); err != nil {
+		t.Fatal(err)
+	}
+	wf.txn = nil
+
+	wf = reopenwal(t, wf)
+	expect_block(t, wf, A, 2)
+	expect_block(t, wf, B, 2)
+}
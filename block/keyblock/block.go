@@ -1,13 +1,13 @@
 package keyblock
 
 import "fmt"
-import . "file-structures/block/file"
+import file "file-structures/block/file2"
 import . "file-structures/block/byteslice"
 
 const BLOCKHEADER = 5
 
 type KeyBlock struct {
-	bf        *BlockFile
+	bf        file.BlockDevice
 	dim       *BlockDimensions
 	rec_count uint16
 	ptr_count uint16
@@ -16,17 +16,32 @@ type KeyBlock struct {
 	records   RecordsSlice
 	pointers  []ByteSlice
 	extraptr  ByteSlice
+	prevptr   ByteSlice
 }
 
-func NewKeyBlock(bf *BlockFile, dim *BlockDimensions) (*KeyBlock, bool) {
-	if size, ok := bf.Allocate(dim.BlockSize); ok {
-		b := newKeyBlock(bf, ByteSlice64(size), dim)
-		return b, true
+// NewKeyBlock allocates a block of the device for a new empty KeyBlock. The
+// block dimensions may be smaller than the blocks of the device, the rest of
+// the device block is left empty.
+func NewKeyBlock(bf file.BlockDevice, dim *BlockDimensions) (*KeyBlock, error) {
+	if err := check_size(bf, dim); err != nil {
+		return nil, err
+	}
+	key, err := bf.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	return newKeyBlock(bf, ByteSlice64(uint64(key)), dim), nil
+}
+
+func check_size(bf file.BlockDevice, dim *BlockDimensions) error {
+	if dim.BlockSize > bf.BlockSize() {
+		return fmt.Errorf("A block of %d bytes does not fit in the %d byte blocks of the device",
+			dim.BlockSize, bf.BlockSize())
 	}
-	return nil, false
+	return nil
 }
 
-func newKeyBlock(bf *BlockFile, pos ByteSlice, dim *BlockDimensions) *KeyBlock {
+func newKeyBlock(bf file.BlockDevice, pos ByteSlice, dim *BlockDimensions) *KeyBlock {
 	n := dim.KeysPerBlock()
 	//     fmt.Println(n)
 	self := new(KeyBlock)
@@ -75,6 +90,21 @@ func (self *KeyBlock) GetExtraPtr() (ByteSlice, bool) {
 	return nil, false
 }
 
+func (self *KeyBlock) SetPrevPtr(ptr ByteSlice) bool {
+	if self.dim.Mode&PREVPTR != 0 && len(ptr) == int(self.dim.PointerSize) {
+		self.prevptr = ptr
+		return true
+	}
+	return false
+}
+
+func (self *KeyBlock) GetPrevPtr() (ByteSlice, bool) {
+	if self.dim.Mode&PREVPTR != 0 {
+		return self.prevptr, true
+	}
+	return nil, false
+}
+
 func (b *KeyBlock) Add(r *Record) (int, bool) {
 	if b.RecordCount() >= b.MaxRecordCount() {
 		return -1, false
@@ -264,11 +294,14 @@ func (self *KeyBlock) RemovePointer(i int) bool {
 	return true
 }
 
-func (self *KeyBlock) SerializeToFile() bool {
-	if bytes, ok := self.Serialize(); ok {
-		return self.bf.WriteBlock(int64(self.Position().Int64()), bytes)
+func (self *KeyBlock) SerializeToFile() error {
+	bytes, ok := self.Serialize()
+	if !ok {
+		return fmt.Errorf("Could not serialize block %v", self.Position())
 	}
-	return false
+	block := make(ByteSlice, self.bf.BlockSize())
+	copy(block, bytes)
+	return self.bf.WriteBlock(int64(self.Position().Int64()), block)
 }
 
 func (self *KeyBlock) Bytes() []byte {
@@ -307,30 +340,37 @@ func (self *KeyBlock) Serialize() ([]byte, bool) {
 		}
 		c += ptr_size
 	}
+	if self.dim.Mode&PREVPTR != 0 {
+		if self.prevptr != nil {
+			copy(bytes[c:c+ptr_size], self.prevptr)
+		}
+		c += ptr_size
+	}
 	return bytes, true
 }
 
-func DeserializeFromFile(bf *BlockFile, dim *BlockDimensions, pos ByteSlice) (*KeyBlock, bool) {
-	var bytes []byte
-	{
-		var ok bool
-		bytes, ok = bf.ReadBlock(int64(pos.Int64()), dim.BlockSize)
-		if !ok {
-			return nil, false
-		}
-		if !dim.Valid() {
-			return nil, false
-		}
+func DeserializeFromFile(bf file.BlockDevice, dim *BlockDimensions, pos ByteSlice) (*KeyBlock, error) {
+	if !dim.Valid() {
+		return nil, fmt.Errorf("Block dimensions %v are not valid", dim)
+	}
+	if err := check_size(bf, dim); err != nil {
+		return nil, err
+	}
+	bytes, err := bf.ReadBlock(int64(pos.Int64()))
+	if err != nil {
+		return nil, err
 	}
 	return Deserialize(bf, dim, bytes, pos)
 }
 
-func Deserialize(bf *BlockFile, dim *BlockDimensions, bytes []byte, pos ByteSlice) (*KeyBlock, bool) {
+func Deserialize(bf file.BlockDevice, dim *BlockDimensions, bytes []byte, pos ByteSlice) (*KeyBlock, error) {
 	b := newKeyBlock(bf, pos, dim)
 	c := 5
+	if len(bytes) < int(dim.BlockSize) {
+		return nil, fmt.Errorf("Block at %v is %d bytes, expected at least %d", pos, len(bytes), dim.BlockSize)
+	}
 	if dim.Mode != bytes[0] {
-		fmt.Println("Block mode != too dim.Mode")
-		return nil, false
+		return nil, fmt.Errorf("Block at %v has mode %d, expected %d", pos, bytes[0], dim.Mode)
 	}
 	b.rec_count = ByteSlice(bytes[1:3]).Int16()
 	b.ptr_count = ByteSlice(bytes[3:5]).Int16()
@@ -340,7 +380,9 @@ func Deserialize(bf *BlockFile, dim *BlockDimensions, bytes []byte, pos ByteSlic
 			continue
 		}
 		rec := b.NewRecord(make([]byte, dim.KeySize))
-		rec.SetBytes(bytes[c : c+int(rec.Size())])
+		// a copy, the bytes may be the block held in the device's cache and
+		// changing a record in place would change the cached block
+		rec.SetBytes(ByteSlice(bytes[c : c+int(rec.Size())]).Copy())
 		c += int(rec.Size())
 		b.records[i] = rec
 	}
@@ -364,7 +406,15 @@ func Deserialize(bf *BlockFile, dim *BlockDimensions, bytes []byte, pos ByteSlic
 		}
 		b.extraptr = ptr
 	}
-	return b, true
+	if b.dim.Mode&PREVPTR != 0 {
+		ptr := make(ByteSlice, b.PointerSize())
+		for j, _ := range ptr {
+			ptr[j] = bytes[c]
+			c++
+		}
+		b.prevptr = ptr
+	}
+	return b, nil
 }
 
 func (b *KeyBlock) find(k ByteSlice) (int, bool) {
@@ -399,5 +449,8 @@ func (b *KeyBlock) String() string {
 	s += "records: " + fmt.Sprintln(b.records)
 	s += "pointers: " + fmt.Sprintln(b.pointers)
 	s += "extra pointer: " + fmt.Sprintln(b.extraptr)
+	if b.dim.Mode&PREVPTR != 0 {
+		s += "prev pointer: " + fmt.Sprintln(b.prevptr)
+	}
 	return s
 }
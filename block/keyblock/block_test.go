@@ -2,6 +2,7 @@ package keyblock
 
 import "testing"
 import . "file-structures/block/byteslice"
+import file "file-structures/block/file2"
 
 func TestAdd(t *testing.T) {
 	dim, _ := NewBlockDimensions(POINTERS|EQUAPTRS, 128, 8, 8, nil)
@@ -44,3 +45,66 @@ func TestFindAll(t *testing.T) {
 		ack <- true
 	}
 }
+
+func TestPrevPtr(t *testing.T) {
+	dim, _ := NewBlockDimensions(RECORDS|EXTRAPTR|PREVPTR, 128, 8, 8, ([]uint32{4}))
+	if dim.KeysPerBlock() != (128-2*8-BLOCKHEADER)/(8+4) {
+		t.Errorf("expected room for two pointers got %v keys", dim.KeysPerBlock())
+	}
+	self := newKeyBlock(nil, ByteSlice64(128), dim)
+	self.Add(dim.NewRecord(ByteSlice64(1)))
+	self.SetExtraPtr(ByteSlice64(256))
+	self.SetPrevPtr(ByteSlice64(384))
+	bytes, _ := self.Serialize()
+	b, err := Deserialize(nil, dim, bytes, ByteSlice64(128))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next, _ := b.GetExtraPtr(); !next.Eq(ByteSlice64(256)) {
+		t.Errorf("expected extra pointer 256 got %v", next)
+	}
+	if prev, _ := b.GetPrevPtr(); !prev.Eq(ByteSlice64(384)) {
+		t.Errorf("expected prev pointer 384 got %v", prev)
+	}
+	if r, _, _, _ := b.Get(0); !r.GetKey().Eq(ByteSlice64(1)) {
+		t.Errorf("expected key 1 got %v", r.GetKey())
+	}
+
+	dim, _ = NewBlockDimensions(RECORDS|EXTRAPTR, 128, 8, 8, ([]uint32{4}))
+	if newKeyBlock(nil, nil, dim).SetPrevPtr(ByteSlice64(384)) {
+		t.Error("expected a block without PREVPTR to refuse a prev pointer")
+	}
+}
+
+func TestSerializeToFile(t *testing.T) {
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	dim, _ := NewBlockDimensions(RECORDS|EXTRAPTR, 128, 8, 8, ([]uint32{4}))
+	self, err := NewKeyBlock(mf, dim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self.Add(dim.NewRecord(ByteSlice64(7)))
+	self.SetExtraPtr(ByteSlice64(256))
+	if err := self.SerializeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := DeserializeFromFile(mf, dim, self.Position())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := b.Get(0); !r.GetKey().Eq(ByteSlice64(7)) {
+		t.Errorf("expected key 7 got %v", r.GetKey())
+	}
+	other, _ := NewBlockDimensions(POINTERS|EQUAPTRS, 128, 8, 8, nil)
+	if _, err := DeserializeFromFile(mf, other, self.Position()); err == nil {
+		t.Error("expected a block of another mode to be refused")
+	}
+	big, _ := NewBlockDimensions(RECORDS|EXTRAPTR, 2*file.BLOCKSIZE, 8, 8, ([]uint32{4}))
+	if _, err := NewKeyBlock(mf, big); err == nil {
+		t.Error("expected a block larger than the device blocks to be refused")
+	}
+}
@@ -9,6 +9,7 @@ const (
 	EXTRAPTR
 	EQUAPTRS
 	NODUP
+	PREVPTR // a second extra pointer, used to link back to the previous block
 )
 
 type BlockDimensions struct {
@@ -47,6 +48,9 @@ func (self *BlockDimensions) KeysPerBlock() int {
 	if self.Mode&(POINTERS|EQUAPTRS) == (POINTERS | EQUAPTRS) {
 		n = int((self.BlockSize - BLOCKHEADER) /
 			(self.KeySize + self.PointerSize))
+	} else if self.Mode&(EXTRAPTR|PREVPTR) == (EXTRAPTR | PREVPTR) {
+		n = int((self.BlockSize - 2*self.PointerSize - BLOCKHEADER) /
+			(self.RecordSize() + self.KeySize))
 	} else if self.Mode&EXTRAPTR == (EXTRAPTR) {
 		n = int((self.BlockSize - self.PointerSize - BLOCKHEADER) /
 			(self.RecordSize() + self.KeySize))
@@ -94,6 +98,13 @@ func (self *BlockDimensions) Valid() bool {
 		} else {
 			return false
 		}
+	case RECORDS | EXTRAPTR | PREVPTR, RECORDS | EXTRAPTR | PREVPTR | NODUP:
+		if self.RecordSize() > 0 && self.PointerSize > 0 &&
+			self.BlockSize >= 2*self.PointerSize+self.RecordSize()+self.KeySize+BLOCKHEADER {
+			return true
+		} else {
+			return false
+		}
 	case RECORDS | POINTERS, RECORDS | POINTERS | NODUP:
 		if self.RecordSize() > 0 && self.PointerSize > 0 &&
 			self.BlockSize >= (2*self.PointerSize)+self.RecordSize()+self.KeySize+BLOCKHEADER {
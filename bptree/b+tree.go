@@ -1,96 +1,131 @@
 package bptree
 
 import "fmt"
-import "os"
-import "runtime"
 import "sync"
 import "container/list"
 import "file-structures/treeinfo"
-import . "file-structures/block/file"
+import file "file-structures/block/file2"
 import . "file-structures/block/keyblock"
-import . "file-structures/block/buffers"
 import . "file-structures/block/byteslice"
 
-const BUFFERSIZE = 536870912 // 512 megabytes
+// STRUCTURE_TYPE tags the devices holding a BpTree.
+var STRUCTURE_TYPE = file.Tag("BPTR")
 
 type BpTree struct {
 	blocksize uint32
-	bf        *BlockFile
+	bf        file.BlockDevice
 	internal  *BlockDimensions
 	external  *BlockDimensions
 	info      *treeinfo.TreeInfo
 	lock      *sync.Mutex
+	changes   uint64 // counts inserts and removes so a Cursor can tell it is stale
 }
 
-func NewBpTree(path string, keysize uint32, fields []uint32) (*BpTree, bool) {
-	return NewBpTreeBufsize(path, keysize, fields, BUFFERSIZE)
+// NewBpTree makes an empty tree on the device with blocks the size of the
+// device's blocks. Wrap the device in one of the cache files to keep the
+// blocks used most in memory.
+func NewBpTree(bf file.BlockDevice, keysize uint32, fields []uint32) (*BpTree, error) {
+	return new_bptree(bf, bf.BlockSize(), keysize, fields, treeinfo.VERSION)
 }
 
-func NewBpTreeBufsize(path string, keysize uint32, fields []uint32, bufsize int) (*BpTree, bool) {
-	self := new(BpTree)
-	self.lock = new(sync.Mutex)
-	// 4 MB buffer with a block size of 4096 bytes
-	if bf, ok := NewBlockFile(path, NewLRU(bufsize)); !ok {
-		fmt.Fprintln(os.Stderr, "could not create block file")
-		return nil, false
-	} else {
-		self.bf = bf
+// NewBpTreeCustomBlockSize makes an empty tree with blocks of blocksize bytes,
+// which may not be more than the device's block size. The rest of each device
+// block goes unused.
+func NewBpTreeCustomBlockSize(bf file.BlockDevice, blocksize, keysize uint32, fields []uint32) (*BpTree, error) {
+	return new_bptree(bf, blocksize, keysize, fields, treeinfo.VERSION)
+}
+
+func new_bptree(bf file.BlockDevice, blocksize, keysize uint32, fields []uint32, version uint32) (*BpTree, error) {
+	if err := file.CheckStructureType(bf, STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
+	self, err := bptree_with(bf, blocksize, keysize, fields, version)
+	if err != nil {
+		return nil, err
+	}
+	root, err := NewKeyBlock(self.bf, self.external)
+	if err != nil {
+		return nil, err
+	}
+	if err := root.SerializeToFile(); err != nil {
+		return nil, err
+	}
+	if self.info, err = treeinfo.NewVersion(self.bf, blocksize, 1, root.Position(), version); err != nil {
+		return nil, err
+	}
+	if err := bf.SetStructureType(STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// OpenBpTree opens the tree made on the device by NewBpTree, keysize and fields
+// must be the ones it was made with.
+func OpenBpTree(bf file.BlockDevice, keysize uint32, fields []uint32) (*BpTree, error) {
+	if err := file.CheckStructureType(bf, STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
+	info, err := treeinfo.Load(bf)
+	if err != nil {
+		return nil, err
+	}
+	self, err := bptree_with(bf, info.BlockSize(), keysize, fields, info.Version())
+	if err != nil {
+		return nil, err
+	}
+	self.info = info
+	return self, nil
+}
+
+// UpgradeBlockFile converts the file at path, a tree written by the old
+// block/file code, in place so it can be opened as a file2.BlockFile with
+// OpenBpTree. The tree keeps its version 0 leaves, which only link forward.
+func UpgradeBlockFile(path string) error {
+	return file.AdoptBlockFile(path, treeinfo.BLOCKFILE_BLOCKSIZE, STRUCTURE_TYPE, treeinfo.FromBlockFile)
+}
+
+// the format of the leaves depends on the version of the tree
+func bptree_with(bf file.BlockDevice, blocksize, keysize uint32, fields []uint32, version uint32) (*BpTree, error) {
+	if blocksize > bf.BlockSize() {
+		return nil, fmt.Errorf("A block size of %d does not fit in the %d byte blocks of the device",
+			blocksize, bf.BlockSize())
 	}
-	self.blocksize = treeinfo.BLOCKSIZE
-	if inter, ok := NewBlockDimensions(POINTERS|EQUAPTRS|NODUP, self.blocksize, keysize, 8, nil); !ok {
-		fmt.Fprintln(os.Stderr, "Block Dimensions invalid")
-		return nil, false
+	self := &BpTree{
+		blocksize: blocksize,
+		bf:        bf,
+		lock:      new(sync.Mutex),
+	}
+	if inter, ok := NewBlockDimensions(POINTERS|EQUAPTRS|NODUP, blocksize, keysize, 8, nil); !ok {
+		return nil, fmt.Errorf("Block Dimensions invalid")
 	} else {
 		self.internal = inter
 	}
-
-	if leaf, ok := NewBlockDimensions(RECORDS|EXTRAPTR, self.blocksize, keysize, 8, fields); !ok {
-		fmt.Fprintln(os.Stderr, "Block Dimensions invalid")
-		return nil, false
+	if leaf, ok := NewBlockDimensions(leaf_mode(version), blocksize, keysize, 8, fields); !ok {
+		return nil, fmt.Errorf("Block Dimensions invalid")
 	} else {
 		self.external = leaf
 	}
+	return self, nil
+}
 
-	if !self.bf.Open() {
-		fmt.Fprintln(os.Stderr, "Couldn't open file")
-		return nil, false
+// Leaves link back to the leaf before them from version 1 on, trees made
+// before that keep working with leaves that only link forward.
+func leaf_mode(version uint32) uint8 {
+	if version < 1 {
+		return RECORDS | EXTRAPTR
 	}
-	if s, open := self.bf.Size(); open && s == 0 {
-		// This is a new file the size is zero
-		self.bf.Allocate(self.blocksize)
-		b, ok := NewKeyBlock(self.bf, self.external)
-		if !ok {
-			self.bf.Close()
-			fmt.Fprintln(os.Stderr, "Could not create the root block")
-			return nil, false
-		}
-		if !b.SerializeToFile() {
-			self.bf.Close()
-			fmt.Fprintln(os.Stderr, "Could not serialize root block to file")
-			return nil, false
-		}
-		self.info = treeinfo.New(self.bf, 1, b.Position())
-	} else {
-		self.info = treeinfo.Load(self.bf)
-	}
-	runtime.SetFinalizer(self, func(self *BpTree) { self.bf.Close() })
-	return self, true
+	return RECORDS | EXTRAPTR | PREVPTR
 }
 
-/*
-get all the records between the left key and the right key
-Usage:
-    records, ack := bptree.Find(ByteSlice64(1), ByteSlice64(15))
-    for record := range records {
-        do something with the record
-        ack<-true;                              // ack<-true must be the last line of the loop.
-    }
-*/
+// Close closes the device the tree is on.
+func (self *BpTree) Close() error {
+	return self.bf.Close()
+}
 
-func (self *BpTree) compute_size() uint64 {
+func (self *BpTree) compute_size() (count uint64, err error) {
+	defer catch(&err)
 	zerokey := make([]byte, self.internal.KeySize)
 	_, block := self.find(zerokey, self.getblock(self.info.Root()), self.info.Height()-1)
-	count := uint64(0)
 	for true {
 		// the extra pointer is in the block points to the next block
 		count += uint64(block.RecordCount())
@@ -100,7 +135,7 @@ func (self *BpTree) compute_size() uint64 {
 		}
 		block = self.getblock(p)
 	}
-	return count
+	return count, nil
 }
 
 func (self *BpTree) Size() uint64 {
@@ -109,36 +144,42 @@ func (self *BpTree) Size() uint64 {
 	return self.info.Entries()
 }
 
-func (self *BpTree) Get(key ByteSlice) *Record {
+// Get finds the first record with the key, nil if there is none.
+func (self *BpTree) Get(key ByteSlice) (rec *Record, err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
+	defer catch(&err)
 	i, block := self.find(key, self.getblock(self.info.Root()), self.info.Height()-1)
 	rec, _, _, ok := block.Get(i)
-	last_rec, _, _, _ := block.Get(int(block.RecordCount() - 1))
-	for !ok && last_rec.GetKey().Lt(key) {
+	// the key may be in the next block, an empty block (the root of an empty
+	// tree) has nothing in it
+	before := func(block *KeyBlock) bool {
+		last_rec, _, _, ok := block.Get(int(block.RecordCount()) - 1)
+		return !ok || last_rec.GetKey().Lt(key)
+	}
+	for !ok && before(block) {
 		next_blk, has := block.GetExtraPtr()
 		if !has || next_blk.Zero() {
-			return nil
+			return nil, nil
 		}
 		block = self.getblock(next_blk)
 		_, rec, _, _, ok = block.Find(key)
-		last_rec, _, _, _ = block.Get(int(block.RecordCount() - 1))
 	}
 	if !ok {
-		return nil
+		return nil, nil
 	}
 	if !key.Eq(rec.GetKey()) {
-		return nil
+		return nil, nil
 	}
-	return rec
+	return rec, nil
 }
 
-func (self *BpTree) Contains(key ByteSlice) bool {
-	rec := self.Get(key)
-	if rec == nil {
-		return false
+func (self *BpTree) Contains(key ByteSlice) (bool, error) {
+	rec, err := self.Get(key)
+	if err != nil {
+		return false, err
 	}
-	return true
+	return rec != nil, nil
 }
 
 // recursively finds the first matching record
@@ -189,56 +230,78 @@ func (self *BpTree) find(key ByteSlice, block *KeyBlock, height int) (int, *KeyB
 	return i, block
 }
 
-func (self *BpTree) Find(left ByteSlice, right ByteSlice) <-chan *Record {
-	records := make(chan *Record, 200)
+/*
+get all the records between the left key and the right key. The range is walked
+in one hold of the tree's lock and gathered before Find returns, so writers can
+not cut it short and the caller may stop reading the channel at any point. The
+whole range is held in memory, walk a Cursor over a range too large for that,
+it reads one leaf at a time.
+Usage:
 
-	// Go Routine which finds and returns the records
-	go func(yield chan<- *Record) {
+	records, err := bptree.Find(ByteSlice64(1), ByteSlice64(15))
+	if err != nil {
+	    ...
+	}
+	for record := range records {
+	    do something with the record
+	}
+*/
+func (self *BpTree) Find(left ByteSlice, right ByteSlice) (<-chan *Record, error) {
+	var found []*Record
+	// parameters are invalid or will yield the empty set
+	if left != nil && right != nil && !right.Lt(left) {
 		self.lock.Lock()
 		defer self.lock.Unlock()
-		// parameters are invalid or will yield the empty set
-		if left == nil || right == nil || (!left.Eq(right) && right.Lt(left)) {
-			close(yield)
-			return
+		cursor := &Cursor{tree: self}
+		cursor.seek(left)
+		for cursor.next() && !right.Lt(cursor.Key()) {
+			found = append(found, cursor.Record())
 		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return send(found), nil
+}
 
-		i, block := self.find(left, self.getblock(self.info.Root()), self.info.Height()-1)
+/*
+get all the records between the left key and the right key from the highest
+key down, duplicates come out in the reverse of the order Find gives them. Like
+Find the whole range is gathered in one hold of the lock before it returns.
+Usage:
 
-		// for a given block and a starting index returns the matching records in that block
-		// if it ends on a matching record it will return true, else it will return false.
-		// returning true indicates that the next block may have matching records. returning false
-		// indicates the next block will never have matching records
-		returns := func(start int, block *KeyBlock) bool {
-			for i := start; i < int(block.RecordCount()); i++ {
-				rec, _, _, ok := block.Get(i)
-				if !ok {
-					return false
-				}
-				if rec.GetKey().Eq(left) ||
-					rec.GetKey().Eq(right) ||
-					(rec.GetKey().Gt(left) && rec.GetKey().Lt(right)) {
-					yield <- rec
-				} else {
-					return false
-				}
-			}
-			return true
+	records, err := bptree.FindReverse(ByteSlice64(1), ByteSlice64(15))
+	for record := range records {
+	    do something with the record
+	}
+*/
+func (self *BpTree) FindReverse(left ByteSlice, right ByteSlice) (<-chan *Record, error) {
+	var found []*Record
+	// parameters are invalid or will yield the empty set
+	if left != nil && right != nil && !right.Lt(left) {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		cursor := &Cursor{tree: self}
+		// go past the records with the right key, then back over them
+		cursor.seek(right)
+		for cursor.next() && !right.Lt(cursor.Key()) {
 		}
-
-		start := i
-		for returns(start, block) {
-			// the extra pointer is in the block points to the next block
-			p, _ := block.GetExtraPtr()
-			if p.Eq(ByteSlice64(0)) {
-				break
-			}
-			block = self.getblock(p)
-			start = 0
+		for cursor.prev() && !cursor.Key().Lt(left) {
+			found = append(found, cursor.Record())
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
 		}
-		close(yield)
-		return
-	}(records)
+	}
+	return send(found), nil
+}
 
+func send(found []*Record) <-chan *Record {
+	records := make(chan *Record, len(found))
+	for _, rec := range found {
+		records <- rec
+	}
+	close(records)
 	return records
 }
 
@@ -250,7 +313,11 @@ func (self *BpTree) String() string {
 		e := stack.Front()
 		pos := e.Value.(ByteSlice)
 		stack.Remove(e)
-		block := self.getblock(pos)
+		block, err := self.readblock(pos)
+		if err != nil {
+			s += fmt.Sprintln(err)
+			continue
+		}
 		s += fmt.Sprintln(block)
 		for i := 0; i < int(block.PointerCount()); i++ {
 			if p, ok := block.GetPointer(i); ok {
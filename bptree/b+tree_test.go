@@ -1,81 +1,101 @@
 package bptree
 
 import "testing"
-import "os"
-import "fmt"
-import "runtime"
-import "sync"
+import "math/rand"
+import "strings"
 import "file-structures/treeinfo"
-import . "file-structures/block/file"
+import file "file-structures/block/file2"
 import . "file-structures/block/keyblock"
-import . "file-structures/block/buffers"
 import . "file-structures/block/byteslice"
 import "file-structures/block/dirty"
 
 var rec []ByteSlice = []ByteSlice{[]byte{1}, []byte{1}, []byte{1, 2}}
-var BLOCKSIZE uint32 = treeinfo.BLOCKSIZE
-
-func newBpTree(blocksize uint32, path string, keysize uint32, fields []uint32) (*BpTree, bool) {
-	self := new(BpTree)
-	self.lock = new(sync.Mutex)
-	// 4 MB buffer with a block size of 4096 bytes
-	if bf, ok := NewBlockFile(path, NewLFU(1000)); !ok {
-		fmt.Println("could not create block file")
-		return nil, false
-	} else {
-		self.bf = bf
-	}
-	self.blocksize = blocksize
-	OPENFLAG = os.O_RDWR | os.O_CREATE
-	if inter, ok := NewBlockDimensions(POINTERS|EQUAPTRS|NODUP, self.blocksize, keysize, 8, nil); !ok {
-		fmt.Println("Block Dimensions invalid")
-		return nil, false
-	} else {
-		self.internal = inter
-	}
-
-	if leaf, ok := NewBlockDimensions(RECORDS|EXTRAPTR, self.blocksize, keysize, 8, fields); !ok {
-		fmt.Println("Block Dimensions invalid")
-		return nil, false
-	} else {
-		self.external = leaf
-	}
-
-	if !self.bf.Open() {
-		fmt.Println("Couldn't open file")
-		return nil, false
-	}
-	if s, open := self.bf.Size(); open && s == 0 {
-		// This is a new file the size is zero
-		self.bf.Allocate(self.blocksize)
-		b, ok := NewKeyBlock(self.bf, self.external)
-		if !ok {
-			self.bf.Close()
-			fmt.Println("Could not create the root block")
-			return nil, false
-		}
-		if !b.SerializeToFile() {
-			self.bf.Close()
-			fmt.Println("Could not serialize root block to file")
-			return nil, false
-		}
-		self.info = treeinfo.New(self.bf, 1, b.Position())
-	} else {
-		self.info = treeinfo.Load(self.bf)
+var BLOCKSIZE uint32 = file.BLOCKSIZE
+
+func newBpTree(blocksize uint32, keysize uint32, fields []uint32) (*BpTree, error) {
+	return newBpTreeVersion(blocksize, keysize, fields, treeinfo.VERSION)
+}
+
+// makes a tree in memory, of an older version of the format if asked
+func newBpTreeVersion(blocksize uint32, keysize uint32, fields []uint32, version uint32) (*BpTree, error) {
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		return nil, err
+	}
+	return new_bptree(mf, blocksize, keysize, fields, version)
+}
+
+// opens the tree again from a copy of the device it is on
+func reopen(self *BpTree, t *testing.T) *BpTree {
+	mf, err := file.LoadMemBlockFile(self.bf.(*file.MemBlockFile).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
 	}
-	runtime.SetFinalizer(self, func(self *BpTree) { self.bf.Close() })
-	return self, true
+	self, err = OpenBpTree(mf, self.external.KeySize, self.external.RecordFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return self
 }
 
 func makebptree(size uint32, t *testing.T) *BpTree {
-	self, ok := newBpTree(size, "test.bptree", 4, ([]uint32{2, 2, 4}))
-	if !ok {
-		t.Fatal("could not create B+ Tree")
+	self, err := newBpTree(size, 4, ([]uint32{2, 2, 4}))
+	if err != nil {
+		t.Fatal("could not create B+ Tree", err)
 	}
 	return self
 }
 
-func cleanbptree(self *BpTree) { os.Remove(self.bf.Path()) }
+func cleanbptree(self *BpTree) { self.Close() }
+
+func put(self *BpTree, t *testing.T, key ByteSlice, record []ByteSlice) {
+	if err := self.Insert(key, record); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func contains(self *BpTree, t *testing.T, key ByteSlice) bool {
+	has, err := self.Contains(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return has
+}
+
+func remove(self *BpTree, t *testing.T, key ByteSlice) bool {
+	removed, err := self.Remove(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return removed
+}
+
+func removeRecord(self *BpTree, t *testing.T, key ByteSlice, record []ByteSlice) bool {
+	removed, err := self.RemoveRecord(key, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return removed
+}
+
+func find(self *BpTree, t *testing.T, left, right ByteSlice) <-chan *Record {
+	records, err := self.Find(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func findReverse(self *BpTree, t *testing.T, left, right ByteSlice) <-chan *Record {
+	records, err := self.FindReverse(left, right)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
 
 func TestCreate(t *testing.T) {
 	t.Log("------- TestCreate -------")
@@ -105,7 +125,9 @@ func TestGetBlock(t *testing.T) {
 	b2 := self.allocate(self.external)
 	dirty.Insert(b1)
 	dirty.Insert(b2)
-	dirty.Sync()
+	if err := dirty.Sync(); err != nil {
+		t.Fatal(err)
+	}
 
 	b1_ := self.getblock(b1.Position())
 	b2_ := self.getblock(b2.Position())
@@ -180,3 +202,160 @@ func TestFind(t *testing.T) {
 		t.Errorf("insert pos != to 1, i=%v\n%v\n", i, b)
 	}
 }
+
+func TestFindConcurrent(t *testing.T) {
+	t.Log("------- TestFindConcurrent -------")
+	self, err := newBpTree(128, 4, ([]uint32{2, 2, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanbptree(self)
+	n := 500
+	for _, j := range rand.Perm(n) {
+		put(self, t, ByteSlice32(uint32(j)), record)
+	}
+
+	// a writer splitting and merging leaves outside the range while it is read
+	done := make(chan bool)
+	failed := make(chan error, 1)
+	go func() {
+		defer close(failed)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := ByteSlice32(uint32(n + i%n))
+			if err := self.Insert(key, record); err != nil {
+				failed <- err
+				return
+			}
+			if i%3 == 0 {
+				if _, err := self.Remove(key); err != nil {
+					failed <- err
+					return
+				}
+			}
+		}
+	}()
+	for k := 0; k < 50; k++ {
+		j := 0
+		for rec := range find(self, t, ByteSlice32(0), ByteSlice32(uint32(n-1))) {
+			if !rec.GetKey().Eq(ByteSlice32(uint32(j))) {
+				t.Fatalf("expected key %v got %v", j, rec.GetKey())
+			}
+			j++
+		}
+		if j != n {
+			t.Fatalf("expected %v records from find got %v", n, j)
+		}
+		for rec := range findReverse(self, t, ByteSlice32(0), ByteSlice32(uint32(n-1))) {
+			j--
+			if !rec.GetKey().Eq(ByteSlice32(uint32(j))) {
+				t.Fatalf("expected key %v got %v", j, rec.GetKey())
+			}
+		}
+		if j != 0 {
+			t.Fatalf("expected %v records from find reverse got %v", n, n-j)
+		}
+	}
+	close(done)
+	if err := <-failed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDevice(t *testing.T) {
+	t.Log("------- TestDevice -------")
+	empty := file.NewMemBlockFile()
+	if err := empty.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBpTree(empty, 4, ([]uint32{2, 2, 4})); err == nil {
+		t.Fatal("expected an empty device not to open as a tree")
+	}
+	if err := empty.SetStructureType(file.Tag("LINH")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBpTree(empty, 4, ([]uint32{2, 2, 4})); err == nil {
+		t.Fatal("expected a device holding another structure to be refused")
+	}
+	if _, err := NewBpTreeCustomBlockSize(empty, 2*file.BLOCKSIZE, 4, ([]uint32{2, 2, 4})); err == nil {
+		t.Fatal("expected blocks larger than the device's to be refused")
+	}
+
+	// a tree behind a cache keeps its records once the cache is written back
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err := file.NewLRUCacheFile(mf, 16*file.BLOCKSIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := NewBpTreeCustomBlockSize(cf, 128, 4, ([]uint32{2, 2, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 1000
+	for _, j := range rand.Perm(n) {
+		put(self, t, ByteSlice32(uint32(j)), record)
+	}
+	if err := cf.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	self = reopen(&BpTree{bf: mf, external: self.external}, t)
+	if self.Size() != uint64(n) || self.blocksize != 128 {
+		t.Fatalf("expected %v records in blocks of 128 got %v in %v", n, self.Size(), self.blocksize)
+	}
+	for j := 0; j < n; j++ {
+		if !contains(self, t, ByteSlice32(uint32(j))) {
+			t.Fatalf("expected %v in the reopened tree", j)
+		}
+	}
+
+	// a device which fails gives back an error instead of panicking
+	ff := file.NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	self, err = NewBpTreeCustomBlockSize(ff, 128, 4, ([]uint32{2, 2, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := 0; j < 100; j++ {
+		put(self, t, ByteSlice32(uint32(j)), record)
+	}
+	ff.FailRead(1)
+	if _, err := self.Get(ByteSlice32(50)); err != file.ErrInjected {
+		t.Fatalf("expected the failed read from Get got %v", err)
+	}
+	ff.FailRead(1)
+	if cursor := self.Cursor(); cursor.Next() || cursor.Err() != file.ErrInjected {
+		t.Fatalf("expected the failed read from the cursor got %v", cursor.Err())
+	}
+	// the cursor Find makes reads down the tree once before seeking to left
+	ff.FailRead(self.info.Height() + 1)
+	if _, err := self.Find(ByteSlice32(0), ByteSlice32(100)); err != file.ErrInjected {
+		t.Fatalf("expected the failed read from Find got %v", err)
+	}
+	ff.FailRead(1)
+	if _, err := self.compute_size(); err != file.ErrInjected {
+		t.Fatalf("expected the failed read from compute_size got %v", err)
+	}
+	ff.FailRead(1)
+	if s := self.String(); !strings.Contains(s, file.ErrInjected.Error()) {
+		t.Fatalf("expected String to show the failed read got %v", s)
+	}
+	if !contains(self, t, ByteSlice32(50)) {
+		t.Fatal("expected the tree to work after a failed read")
+	}
+	ff.FailWrite(1)
+	if err := self.Insert(ByteSlice32(100), record); err == nil {
+		t.Fatal("expected an insert on a crashed device to fail")
+	}
+	if _, err := self.Remove(ByteSlice32(1)); err == nil {
+		t.Fatal("expected a remove on a crashed device to fail")
+	}
+}
@@ -0,0 +1,257 @@
+package bptree
+
+import "fmt"
+import . "file-structures/block/byteslice"
+import . "file-structures/block/keyblock"
+
+/*
+BulkLoader builds an empty tree from records given in key order. The leaves are
+filled one after the other to the fill factor and each internal level is built
+as the level under it grows, so every block is allocated in order and written
+once when it is done. This is much cheaper than inserting the records one at a
+time.
+
+A key which repeats is kept in one leaf, and the blocks chained after it if it
+does not fit, the same as Insert keeps it. So a leaf may be filled past the fill
+factor and the records with the key are moved to a new leaf when the leaf fills
+up with other keys in it.
+
+The new levels are built in blocks of their own, the tree stays empty until
+Finish makes them its root and frees the old one. A load which fails frees the
+blocks it allocated. The tree must not be changed while it is loaded, Finish
+fails if it was.
+Usage:
+
+	loader, err := bptree.BulkLoad(.9)
+	for each record in order {
+	    if err := loader.Add(key, fields); err != nil {
+	        ...
+	    }
+	}
+	err = loader.Finish()
+*/
+type BulkLoader struct {
+	tree          *BpTree
+	leaf_fill     int
+	internal_fill int
+	blocks        []*KeyBlock // the block being filled at each height
+	firsts        []ByteSlice // the lowest key at each height
+	heads         []ByteSlice // the first block at each height
+	overflow      bool        // blocks[0] holds duplicates which did not fit in the leaf before it
+	allocated     []ByteSlice // every block of the load, freed if it fails
+	last          ByteSlice
+	entries       uint64
+	changes       uint64
+	err           error
+}
+
+// BulkLoad starts loading the tree, which must be empty. fill is the fraction
+// of every block to fill, between 0 and 1.
+func (self *BpTree) BulkLoad(fill float64) (*BulkLoader, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if fill <= 0 || fill > 1 {
+		return nil, fmt.Errorf("the fill factor must be in (0, 1] got %v", fill)
+	}
+	if self.info.Entries() != 0 || self.info.Height() != 1 {
+		return nil, fmt.Errorf("only an empty tree can be bulk loaded")
+	}
+	at_least := func(n, min int) int {
+		if n < min {
+			return min
+		}
+		return n
+	}
+	return &BulkLoader{
+		tree:      self,
+		leaf_fill: at_least(int(fill*float64(self.external.KeysPerBlock())), 1),
+		// an internal block needs two pointers or the levels never end
+		internal_fill: at_least(int(fill*float64(self.internal.KeysPerBlock())), 2),
+		changes:       self.changes,
+	}, nil
+}
+
+// Add puts the next record in the tree, its key must be no less than the key
+// of the record before it.
+func (self *BulkLoader) Add(key ByteSlice, record []ByteSlice) (err error) {
+	if self.err != nil {
+		return self.err
+	}
+	tree := self.tree
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	defer self.catch(&err)
+	rec, valid := pkg_rec(tree, key, record)
+	if !valid {
+		return fmt.Errorf("key or record not valid")
+	}
+	if self.last != nil && key.Lt(self.last) {
+		return self.fail(fmt.Errorf("the keys are not in order, %v came after %v", key, self.last))
+	}
+
+	leaf := self.leaf()
+	if leaf == nil {
+		leaf = self.allocate(tree.external)
+		self.push(0, key, leaf)
+	} else if self.last.Eq(key) {
+		if leaf.Full() && leaf.Count(key) == int(leaf.RecordCount()) {
+			// chain on a block for the duplicates which do not fit
+			next := self.next_leaf(leaf)
+			self.write(leaf)
+			leaf = next
+			self.overflow = true
+		} else if leaf.Full() {
+			// the duplicates move to a leaf of their own
+			next := self.next_leaf(leaf)
+			for {
+				r, _, _, ok := leaf.Get(int(leaf.RecordCount()) - 1)
+				if !ok || !r.GetKey().Eq(key) {
+					break
+				}
+				leaf.RemoveAtIndex(int(leaf.RecordCount()) - 1)
+				next.Add(r)
+			}
+			self.write(leaf)
+			self.push(0, key, next)
+			leaf = next
+		}
+	} else if self.overflow || int(leaf.RecordCount()) >= self.leaf_fill || leaf.Full() {
+		next := self.next_leaf(leaf)
+		self.write(leaf)
+		leaf = next
+		self.push(0, key, leaf)
+		self.overflow = false
+	}
+	if _, ok := leaf.Add(rec.external()); !ok {
+		return self.fail(fmt.Errorf("could not add %v to leaf %v", key, leaf.Position()))
+	}
+	self.last = key.Copy()
+	self.entries++
+	return nil
+}
+
+// Finish writes the blocks still being filled and makes the new levels the
+// tree. The loader can not be used after.
+func (self *BulkLoader) Finish() error {
+	if self.err != nil {
+		return self.err
+	}
+	tree := self.tree
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	self.err = fmt.Errorf("the bulk load is finished")
+	if self.changes != tree.changes {
+		return self.fail(fmt.Errorf("the tree was changed during the bulk load"))
+	}
+	if len(self.blocks) == 0 {
+		return nil
+	}
+	for _, block := range self.blocks {
+		if err := block.SerializeToFile(); err != nil {
+			return self.fail(err)
+		}
+	}
+	old := tree.info.Root()
+	tree.info.SetRoot(self.heads[len(self.heads)-1])
+	tree.info.SetHeight(len(self.blocks))
+	tree.info.SetEntries(self.entries)
+	if err := tree.info.Serialize(); err != nil {
+		tree.info.SetRoot(old)
+		tree.info.SetHeight(1)
+		tree.info.SetEntries(0)
+		return self.fail(err)
+	}
+	tree.changes++
+	self.allocated = nil
+	return tree.bf.Free(int64(old.Int64()))
+}
+
+// a block which could not be allocated or written ends the load
+func (self *BulkLoader) catch(err *error) {
+	if e := recover(); e != nil {
+		*err = self.fail(caught(e))
+	}
+}
+
+// fail ends the load with err and gives back the blocks it allocated, the tree
+// never pointed at them.
+func (self *BulkLoader) fail(err error) error {
+	self.err = err
+	for _, pos := range self.allocated {
+		self.tree.bf.Free(int64(pos.Int64()))
+	}
+	self.allocated = nil
+	return err
+}
+
+func (self *BulkLoader) allocate(dim *BlockDimensions) *KeyBlock {
+	block := self.tree.allocate(dim)
+	self.allocated = append(self.allocated, block.Position())
+	return block
+}
+
+func (self *BulkLoader) leaf() *KeyBlock {
+	if len(self.blocks) == 0 {
+		return nil
+	}
+	return self.blocks[0]
+}
+
+// allocates the block after leaf in the leaf chain
+func (self *BulkLoader) next_leaf(leaf *KeyBlock) *KeyBlock {
+	next := self.allocate(self.tree.external)
+	leaf.SetExtraPtr(next.Position())
+	next.SetExtraPtr(ByteSlice64(0))
+	next.SetPrevPtr(leaf.Position())
+	self.blocks[0] = next
+	return next
+}
+
+// puts block, whose lowest key is key, in the tree at height h. The parent
+// gets a pointer to it and the internal block before it is written out, it is
+// done. Leaves are written as the next one is started.
+func (self *BulkLoader) push(h int, key ByteSlice, block *KeyBlock) {
+	tree := self.tree
+	if h == len(self.blocks) {
+		// the first block at this height
+		self.blocks = append(self.blocks, block)
+		self.firsts = append(self.firsts, key.Copy())
+		self.heads = append(self.heads, block.Position())
+		return
+	}
+	if h+1 == len(self.blocks) {
+		// the second block at the top, it needs a parent
+		parent := self.allocate(tree.internal)
+		self.add(parent, self.firsts[h], self.heads[h])
+		self.blocks = append(self.blocks, parent)
+		self.firsts = append(self.firsts, self.firsts[h])
+		self.heads = append(self.heads, parent.Position())
+	}
+	parent := self.blocks[h+1]
+	if int(parent.RecordCount()) >= self.internal_fill {
+		next := self.allocate(tree.internal)
+		self.push(h+1, key, next)
+		parent = next
+	}
+	self.add(parent, key, block.Position())
+	if h > 0 {
+		self.write(self.blocks[h])
+	}
+	self.blocks[h] = block
+}
+
+func (self *BulkLoader) add(block *KeyBlock, key, ptr ByteSlice) {
+	if i, ok := block.Add(self.tree.internal.NewRecord(key)); !ok {
+		msg := fmt.Sprintf("could not add key %v to block \n%v\n", key, block)
+		panic(msg)
+	} else if !block.InsertPointer(i, ptr) {
+		msg := fmt.Sprintf("could not insert pointer %v to block \n%v\n", ptr, block)
+		panic(msg)
+	}
+}
+
+func (self *BulkLoader) write(block *KeyBlock) {
+	if err := block.SerializeToFile(); err != nil {
+		panic(err)
+	}
+}
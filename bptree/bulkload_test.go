@@ -0,0 +1,201 @@
+package bptree
+
+import "testing"
+import "fmt"
+import "math/rand"
+import . "file-structures/block/byteslice"
+import file "file-structures/block/file2"
+
+func TestBulkLoad(t *testing.T) {
+	fmt.Println("----------- Bulk Load -----------")
+	for _, size := range sizes {
+		for _, fill := range []float64{1, .7, .5, .1} {
+			self := makebptree(size, t)
+			loader, err := self.BulkLoad(fill)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// runs of duplicates of all lengths, some longer than a leaf
+			n := 2000
+			expect := make(map[uint32]int)
+			for key, j := uint32(0), 0; j < n; key++ {
+				c := 1
+				if rand.Intn(4) == 0 {
+					c = rand.Intn(int(self.external.KeysPerBlock())*3) + 1
+				}
+				for ; c > 0 && j < n; c, j = c-1, j+1 {
+					if err := loader.Add(ByteSlice32(2*key), duprecord(uint32(j))); err != nil {
+						t.Fatal(err)
+					}
+					expect[2*key]++
+				}
+			}
+			if err := loader.Finish(); err != nil {
+				t.Fatal(err)
+			}
+
+			counts := check_tree(self, t)
+			if len(counts) != len(expect) {
+				t.Fatalf("expected %v keys got %v", len(expect), len(counts))
+			}
+			for key, c := range expect {
+				if counts[key] != c {
+					t.Fatalf("expected %v records with key %v got %v", c, key, counts[key])
+				}
+				if !contains(self, t, ByteSlice32(key)) || contains(self, t, ByteSlice32(key+1)) {
+					t.Fatalf("Contains is wrong about %v or %v", key, key+1)
+				}
+			}
+			found := 0
+			prev := ByteSlice32(0)
+			for rec := range find(self, t, ByteSlice32(0), ByteSlice32(0xffffffff)) {
+				if rec.GetKey().Lt(prev) {
+					t.Fatalf("Find out of order %v after %v", rec.GetKey(), prev)
+				}
+				prev = rec.GetKey()
+				found++
+			}
+			if found != n {
+				t.Fatalf("expected Find to get %v records got %v", n, found)
+			}
+
+			// the tree can still be changed as usual
+			for key := range expect {
+				if rand.Intn(2) == 0 {
+					remove(self, t, ByteSlice32(key))
+					delete(expect, key)
+				} else {
+					put(self, t, ByteSlice32(key+1), record)
+					expect[key+1]++
+				}
+			}
+			counts = check_tree(self, t)
+			for key, c := range expect {
+				if counts[key] != c {
+					t.Fatalf("expected %v records with key %v got %v", c, key, counts[key])
+				}
+			}
+			cleanbptree(self)
+		}
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	self := makebptree(ORDER_5_4, t)
+	defer cleanbptree(self)
+	if _, err := self.BulkLoad(0); err == nil {
+		t.Fatal("expected a fill factor of 0 to be refused")
+	}
+	if _, err := self.BulkLoad(1.5); err == nil {
+		t.Fatal("expected a fill factor over 1 to be refused")
+	}
+
+	// nothing loaded leaves the tree empty
+	loader, err := self.BulkLoad(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if self.Size() != 0 || self.info.Height() != 1 {
+		t.Fatal("expected the tree to stay empty")
+	}
+
+	loader, err = self.BulkLoad(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range []uint32{1, 2, 2, 5} {
+		if err := loader.Add(ByteSlice32(j), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loader.Add(ByteSlice32(3), record); err == nil {
+		t.Fatal("expected a key out of order to be refused")
+	}
+	if err := loader.Add(ByteSlice32(6), record); err == nil {
+		t.Fatal("expected the loader to stay failed")
+	}
+	if err := loader.Finish(); err == nil {
+		t.Fatal("expected a failed load not to finish")
+	}
+
+	loader, _ = self.BulkLoad(1)
+	loader.Add(ByteSlice32(1), record)
+	put(self, t, ByteSlice32(1), record)
+	if err := loader.Finish(); err == nil {
+		t.Fatal("expected a load the tree changed under not to finish")
+	}
+	if _, err := self.BulkLoad(1); err == nil {
+		t.Fatal("expected a tree with records in it to be refused")
+	}
+}
+
+// A load which fails part way must leave the tree empty and its blocks free.
+func TestBulkLoadRejected(t *testing.T) {
+	self := makebptree(ORDER_5_4, t)
+	defer cleanbptree(self)
+	load := func(tree *BpTree, n uint32) *BulkLoader {
+		loader, err := tree.BulkLoad(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := uint32(0); j < n; j++ {
+			if err := loader.Add(ByteSlice32(j), record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return loader
+	}
+	size := func() uint64 {
+		size, err := self.bf.(*file.MemBlockFile).Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return size
+	}
+
+	loader := load(self, 500)
+	if err := loader.Add(ByteSlice32(1), record); err == nil {
+		t.Fatal("expected a key out of order to be refused")
+	}
+	if self.Size() != 0 || self.info.Height() != 1 {
+		t.Fatal("expected the tree to stay empty")
+	}
+	if rec, err := self.Get(ByteSlice32(10)); err != nil {
+		t.Fatal(err)
+	} else if rec != nil {
+		t.Fatal("expected the rejected records not to be in the tree")
+	}
+	for _ = range find(self, t, ByteSlice32(0), ByteSlice32(0xffffffff)) {
+		t.Fatal("expected Find to get nothing from the empty tree")
+	}
+
+	// the blocks of the rejected load are reused by the next one
+	before := size()
+	if err := load(self, 500).Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if after := size(); after > before {
+		t.Fatalf("expected the load to reuse the freed blocks, the file grew from %d to %d", before, after)
+	}
+	if counts := check_tree(self, t); len(counts) != 500 {
+		t.Fatalf("expected 500 keys got %d", len(counts))
+	}
+
+	// of two loads started on the same empty tree only the first to finish
+	// is kept
+	other := makebptree(ORDER_5_4, t)
+	defer cleanbptree(other)
+	first, second := load(other, 100), load(other, 200)
+	if err := first.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Finish(); err == nil {
+		t.Fatal("expected the second load not to finish")
+	}
+	if counts := check_tree(other, t); len(counts) != 100 {
+		t.Fatalf("expected the 100 keys of the first load got %d", len(counts))
+	}
+}
@@ -0,0 +1,242 @@
+package bptree
+
+import "fmt"
+import . "file-structures/block/byteslice"
+import . "file-structures/block/keyblock"
+
+/*
+Cursor walks the records of the tree in key order along the leaf chain, forward
+with Next and backward with Prev. It only holds the tree's lock while it moves,
+so the tree may be used between calls and a cursor which is dropped part way
+through costs nothing. Once the tree is changed the position of the cursor is
+no longer good, Next and Prev then stop and Err says why, a seek puts the
+cursor back on the tree.
+
+A cursor is either on a record or between two records, after a seek or after
+running off either end. Next and Prev from between two records land on the one
+after or the one before.
+Usage:
+
+	cursor := bptree.Cursor()
+	defer cursor.Close()
+	for cursor.Seek(ByteSlice64(1)); cursor.Next(); {
+	    do something with cursor.Key() and cursor.Record()
+	}
+	if err := cursor.Err(); err != nil {
+	    ...
+	}
+*/
+type Cursor struct {
+	tree    *BpTree
+	block   *KeyBlock
+	i       int     // the record the cursor is on or the one after it
+	rec     *Record // nil when between records
+	changes uint64
+	err     error
+}
+
+// Cursor makes a cursor sitting before the first record of the tree.
+func (self *BpTree) Cursor() *Cursor {
+	cursor := &Cursor{tree: self}
+	cursor.Seek(make(ByteSlice, self.internal.KeySize))
+	return cursor
+}
+
+// Seek moves the cursor to just before the first record with a key no less
+// than key, the next call to Next lands on it and Prev on the one before.
+func (self *Cursor) Seek(key ByteSlice) (ok bool) {
+	if self.tree == nil {
+		self.err = fmt.Errorf("the cursor is closed")
+		return false
+	}
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	return self.seek(key)
+}
+
+// seek is Seek with the tree's lock already held
+func (self *Cursor) seek(key ByteSlice) (ok bool) {
+	tree := self.tree
+	defer self.catch(&ok)
+	self.rec = nil
+	if !tree.ValidateKey(key) {
+		self.block = nil
+		self.err = fmt.Errorf("key %v is not valid", key)
+		return false
+	}
+	self.i, self.block = tree.find(key, tree.getblock(tree.info.Root()), tree.info.Height()-1)
+	// the leaf found may end in a run of duplicates of a lower key
+	for {
+		if self.i >= int(self.block.RecordCount()) {
+			p, _ := self.block.GetExtraPtr()
+			if p.Zero() {
+				break
+			}
+			self.block = tree.getblock(p)
+			self.i = 0
+		} else if r, _, _, _ := self.block.Get(self.i); r.GetKey().Lt(key) {
+			self.i++
+		} else {
+			break
+		}
+	}
+	self.changes = tree.changes
+	self.err = nil
+	return true
+}
+
+// SeekEnd moves the cursor to just after the last record, for walking the
+// tree backward with Prev.
+func (self *Cursor) SeekEnd() (ok bool) {
+	if self.tree == nil {
+		self.err = fmt.Errorf("the cursor is closed")
+		return false
+	}
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	return self.seek_end()
+}
+
+// seek_end is SeekEnd with the tree's lock already held
+func (self *Cursor) seek_end() (ok bool) {
+	tree := self.tree
+	defer self.catch(&ok)
+	block := tree.getblock(tree.info.Root())
+	for block.Mode() == tree.internal.Mode {
+		p, _ := block.GetPointer(int(block.PointerCount()) - 1)
+		block = tree.getblock(p)
+	}
+	// the last leaf may be followed by the duplicates which did not fit in it
+	for {
+		p, _ := block.GetExtraPtr()
+		if p.Zero() {
+			break
+		}
+		block = tree.getblock(p)
+	}
+	self.block = block
+	self.i = int(block.RecordCount())
+	self.rec = nil
+	self.changes = tree.changes
+	self.err = nil
+	return true
+}
+
+// Next moves the cursor to the next record. It returns false once there are no
+// more records or the cursor failed, see Err.
+func (self *Cursor) Next() bool {
+	if self.tree == nil {
+		return self.move(0, true)
+	}
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	return self.next()
+}
+
+// Prev moves the cursor to the record before. It returns false once there are
+// no more records or the cursor failed, see Err.
+func (self *Cursor) Prev() bool {
+	if self.tree == nil {
+		return self.move(0, false)
+	}
+	self.tree.lock.Lock()
+	defer self.tree.lock.Unlock()
+	return self.prev()
+}
+
+// next and prev are Next and Prev with the tree's lock already held
+func (self *Cursor) next() bool {
+	i := self.i
+	if self.rec != nil {
+		i++
+	}
+	return self.move(i, true)
+}
+
+func (self *Cursor) prev() bool {
+	return self.move(self.i-1, false)
+}
+
+// moves the cursor onto record i of its block, going into the blocks after or
+// before it when i is past the end or the start. The tree's lock must be held.
+func (self *Cursor) move(i int, forward bool) (ok bool) {
+	if self.tree == nil || self.block == nil || self.err != nil {
+		self.rec = nil
+		return false
+	}
+	tree := self.tree
+	defer self.catch(&ok)
+	if self.changes != tree.changes {
+		self.block = nil
+		self.rec = nil
+		self.err = fmt.Errorf("the tree was changed, seek to start again")
+		return false
+	}
+	for forward && i >= int(self.block.RecordCount()) {
+		// the extra pointer is in the block points to the next block
+		p, _ := self.block.GetExtraPtr()
+		if p.Zero() {
+			self.i = int(self.block.RecordCount())
+			self.rec = nil
+			return false
+		}
+		self.block = tree.getblock(p)
+		i = 0
+	}
+	for !forward && i < 0 {
+		prev := tree.prev_leaf(self.block)
+		if prev == nil {
+			self.i = 0
+			self.rec = nil
+			return false
+		}
+		self.block = prev
+		i = int(self.block.RecordCount()) - 1
+	}
+	rec, _, _, has := self.block.Get(i)
+	if !has {
+		self.err = fmt.Errorf("could not get record %v from block %v", i, self.block.Position())
+		self.block = nil
+		self.rec = nil
+		return false
+	}
+	self.i = i
+	self.rec = rec
+	return true
+}
+
+// a block which could not be read takes the cursor off the tree, the error is
+// kept for Err
+func (self *Cursor) catch(ok *bool) {
+	if e := recover(); e != nil {
+		self.err = caught(e)
+		self.block = nil
+		self.rec = nil
+		*ok = false
+	}
+}
+
+// Key is the key of the record the cursor is on, nil if it is not on one.
+func (self *Cursor) Key() ByteSlice {
+	if self.rec == nil {
+		return nil
+	}
+	return self.rec.GetKey()
+}
+
+// Record is the record the cursor is on, nil if it is not on one.
+func (self *Cursor) Record() *Record {
+	return self.rec
+}
+
+func (self *Cursor) Err() error {
+	return self.err
+}
+
+// Close lets go of the tree, the cursor can not be used after.
+func (self *Cursor) Close() error {
+	self.tree = nil
+	self.block = nil
+	self.rec = nil
+	return nil
+}
@@ -0,0 +1,281 @@
+package bptree
+
+import "testing"
+import "fmt"
+import "math/rand"
+import "io/ioutil"
+import "os"
+import "file-structures/treeinfo"
+import file "file-structures/block/file2"
+import buf "file-structures/block/buffers"
+import . "file-structures/block/keyblock"
+import . "file-structures/block/byteslice"
+
+func same(a, b *Record) bool {
+	return ByteSlice(a.Bytes()).Eq(b.Bytes())
+}
+
+func TestCursor(t *testing.T) {
+	fmt.Println("----------- Cursor -----------")
+	for _, size := range sizes[:4] {
+		self := makebptree(size, t)
+		n := 500
+		for _, j := range rand.Perm(n) {
+			// only the even keys, every key twice
+			put(self, t, ByteSlice32(uint32(2*j)), record)
+			put(self, t, ByteSlice32(uint32(2*j)), record)
+		}
+
+		cursor := self.Cursor()
+		count := 0
+		for ; cursor.Next(); count++ {
+			if key := cursor.Key().Int32(); key != uint32(count/2*2) {
+				t.Fatalf("expected key %v got %v", count/2*2, key)
+			}
+		}
+		if cursor.Err() != nil || count != 2*n {
+			t.Fatalf("expected %v records got %v, %v", 2*n, count, cursor.Err())
+		}
+		if cursor.Next() || cursor.Record() != nil || cursor.Key() != nil {
+			t.Fatal("expected the cursor to stay at the end")
+		}
+
+		// seeking to a missing key lands on the next key
+		for _, j := range []uint32{0, 1, 2, 501, 998, 999} {
+			cursor.Seek(ByteSlice32(j))
+			if j > 998 {
+				if cursor.Next() {
+					t.Fatalf("expected nothing after %v got %v", j, cursor.Key())
+				}
+				continue
+			}
+			if !cursor.Next() || cursor.Key().Int32() != (j+1)/2*2 {
+				t.Fatalf("expected seek %v to land on %v got %v", j, (j+1)/2*2, cursor.Key())
+			}
+		}
+		if cursor.Seek(ByteSlice64(0)) || cursor.Err() == nil || cursor.Next() {
+			t.Fatal("expected a key of the wrong size to be refused")
+		}
+
+		// a cursor left part way does not hold up the tree, but it does see
+		// that the tree changed
+		cursor.Seek(ByteSlice32(10))
+		cursor.Next()
+		put(self, t, ByteSlice32(11), record)
+		if cursor.Next() || cursor.Err() == nil {
+			t.Fatal("expected the cursor to stop once the tree changed")
+		}
+		cursor.Seek(ByteSlice32(11))
+		if !cursor.Next() || cursor.Key().Int32() != 11 || cursor.Err() != nil {
+			t.Fatal("expected seek to recover the cursor")
+		}
+		cursor.Close()
+		if cursor.Next() || cursor.Seek(ByteSlice32(0)) {
+			t.Fatal("expected a closed cursor to do nothing")
+		}
+
+		// so does a Find which is not read to the end
+		for _ = range find(self, t, ByteSlice32(0), ByteSlice32(uint32(2*n))) {
+			break
+		}
+		if !remove(self, t, ByteSlice32(11)) {
+			t.Fatal("could not remove 11")
+		}
+		count = 0
+		for rec := range find(self, t, ByteSlice32(100), ByteSlice32(200)) {
+			if key := rec.GetKey().Int32(); key < 100 || key > 200 {
+				t.Fatalf("found %v outside of [100, 200]", key)
+			}
+			count++
+		}
+		if count != 102 {
+			t.Fatalf("expected 102 records got %v", count)
+		}
+		cleanbptree(self)
+	}
+}
+
+func TestCursorPrev(t *testing.T) {
+	fmt.Println("----------- Cursor Prev -----------")
+	for _, version := range []uint32{0, treeinfo.VERSION} {
+		for _, size := range sizes[:4] {
+			self, err := newBpTreeVersion(size, 4, ([]uint32{2, 2, 4}), version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, has := self.getblock(self.info.Root()).GetPrevPtr(); has != (version > 0) {
+				t.Fatalf("expected back links only from version 1 on, version %v", version)
+			}
+			n := 400
+			for _, j := range rand.Perm(n) {
+				// the keys under 50 many times over so they run past a leaf
+				put(self, t, ByteSlice32(uint32(j%(n-50))), duprecord(uint32(j)))
+			}
+			for _, j := range rand.Perm(n)[:n/4] {
+				removeRecord(self, t, ByteSlice32(uint32(j%(n-50))), duprecord(uint32(j)))
+			}
+			check_tree(self, t)
+
+			var forward []*Record
+			for rec := range find(self, t, ByteSlice32(0), ByteSlice32(uint32(n))) {
+				forward = append(forward, rec)
+			}
+			cursor := self.Cursor()
+			cursor.SeekEnd()
+			for i := len(forward) - 1; i >= 0; i-- {
+				if !cursor.Prev() {
+					t.Fatalf("expected %v more records, %v", i+1, cursor.Err())
+				}
+				if !same(cursor.Record(), forward[i]) {
+					t.Fatalf("expected %v got %v", forward[i], cursor.Record())
+				}
+			}
+			if cursor.Prev() || cursor.Err() != nil {
+				t.Fatal("expected the cursor to stop at the first record")
+			}
+			// and turns around at the start
+			if !cursor.Next() || !same(cursor.Record(), forward[0]) || !cursor.Next() ||
+				!cursor.Prev() || !same(cursor.Record(), forward[0]) {
+				t.Fatal("expected the cursor to turn around at the start")
+			}
+			cursor.Seek(ByteSlice32(100))
+			if !cursor.Prev() || !(cursor.Key().Int32() < 100) {
+				t.Fatalf("expected Prev after a seek to land before 100 got %v", cursor.Key())
+			}
+			cursor.Close()
+
+			// the records in [20, 200] backward
+			var expect []*Record
+			for _, rec := range forward {
+				if key := rec.GetKey().Int32(); key >= 20 && key <= 200 {
+					expect = append([]*Record{rec}, expect...)
+				}
+			}
+			i := 0
+			for rec := range findReverse(self, t, ByteSlice32(20), ByteSlice32(200)) {
+				if i >= len(expect) || !same(rec, expect[i]) {
+					t.Fatalf("FindReverse gave %v as record %v", rec, i)
+				}
+				i++
+			}
+			if i != len(expect) {
+				t.Fatalf("expected %v records got %v", len(expect), i)
+			}
+			for _ = range findReverse(self, t, ByteSlice32(200), ByteSlice32(20)) {
+				t.Fatal("expected nothing from an empty range")
+			}
+
+			cleanbptree(self)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	fmt.Println("----------- Version -----------")
+	for _, version := range []uint32{0, treeinfo.VERSION} {
+		self, err := newBpTreeVersion(BLOCKSIZE, 4, ([]uint32{2, 2, 4}), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 5000
+		for _, j := range rand.Perm(n) {
+			put(self, t, ByteSlice32(uint32(j)), record)
+		}
+		// opening the file again keeps its version and the leaves of it
+		old := self
+		self = reopen(self, t)
+		cleanbptree(old)
+		if self.info.Version() != version {
+			t.Fatalf("expected version %v got %v", version, self.info.Version())
+		}
+		for j := 0; j < n; j += 2 {
+			remove(self, t, ByteSlice32(uint32(j)))
+		}
+		check_tree(self, t)
+		j := n - 1
+		for rec := range findReverse(self, t, ByteSlice32(0), ByteSlice32(uint32(n))) {
+			if key := rec.GetKey().Int32(); key != uint32(j) {
+				t.Fatalf("expected %v got %v", j, key)
+			}
+			j -= 2
+		}
+		if j != -1 {
+			t.Fatalf("expected to get down to 1 got to %v", j+2)
+		}
+		cleanbptree(self)
+	}
+
+	// a tree of a later version is refused
+	self := makebptree(BLOCKSIZE, t)
+	defer cleanbptree(self)
+	ctrl, err := self.bf.ControlData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(ctrl[20:24], ByteSlice32(treeinfo.VERSION+1))
+	if err := self.bf.SetControlData(ctrl); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBpTree(self.bf, 4, ([]uint32{2, 2, 4})); err == nil {
+		t.Fatal("expected a tree of a later version to be refused")
+	}
+}
+
+func TestUpgradeBlockFile(t *testing.T) {
+	fmt.Println("----------- Upgrade Block File -----------")
+	path := "/tmp/__bptree_blockfile"
+	defer os.Remove(path)
+	self, err := newBpTreeVersion(treeinfo.BLOCKFILE_BLOCKSIZE, 4, ([]uint32{2, 2, 4}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 2000
+	for _, j := range rand.Perm(n) {
+		put(self, t, ByteSlice32(uint32(j)), record)
+	}
+	// the old block/file code kept the height, root and entries in the first
+	// block in place of a control block
+	image := self.bf.(*file.MemBlockFile).Bytes()
+	first := make([]byte, treeinfo.BLOCKFILE_BLOCKSIZE)
+	copy(first[0:4], ByteSlice32(uint32(self.info.Height())))
+	copy(first[4:12], self.info.Root())
+	copy(first[12:20], ByteSlice64(self.info.Entries()))
+	copy(image, first)
+	cleanbptree(self)
+	if err := ioutil.WriteFile(path, image, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpgradeBlockFile(path); err != nil {
+		t.Fatal(err)
+	}
+	bf := file.NewBlockFile(path, &buf.NoBuffer{})
+	if err := bf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	self, err = OpenBpTree(bf, 4, ([]uint32{2, 2, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.info.Version() != 0 || self.info.Entries() != uint64(n) {
+		t.Fatalf("expected a version 0 tree of %v entries got version %v of %v",
+			n, self.info.Version(), self.info.Entries())
+	}
+	put(self, t, ByteSlice32(uint32(n)), record)
+	check_tree(self, t)
+	j := n
+	for rec := range findReverse(self, t, ByteSlice32(0), ByteSlice32(uint32(n))) {
+		if key := rec.GetKey().Int32(); key != uint32(j) {
+			t.Fatalf("expected %v got %v", j, key)
+		}
+		j--
+	}
+	if j != -1 {
+		t.Fatalf("expected to get down to 0 got to %v", j+1)
+	}
+	cleanbptree(self)
+
+	if err := UpgradeBlockFile(path); err == nil {
+		t.Fatal("expected a file which was already upgraded to be refused")
+	}
+}
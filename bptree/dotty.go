@@ -11,9 +11,14 @@ var footer string = "}\n\n"
 
 var subgraph string = "\n    subgraph graph0 {\n        graph[rank=same];\n"
 
-func Dotty(filename string, tree *BpTree) {
+func Dotty(filename string, tree *BpTree) (err error) {
+	defer catch(&err)
 	s := ""
-	file, _ := os.Create(filename)
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 	s += header
 
 	label := func(vals []string, size int) string {
@@ -122,6 +127,6 @@ func Dotty(filename string, tree *BpTree) {
 		}
 	}
 	s += footer
-	fmt.Fprint(file, s)
-	file.Close()
+	_, err = fmt.Fprint(file, s)
+	return err
 }
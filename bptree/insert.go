@@ -59,14 +59,10 @@ func (self BpTree) balance_blocks(s int, full, empty *KeyBlock) {
 	for j := n - 1; j > s; j-- {
 		// move the records
 		if r, _, _, ok := full.Get(j); !ok {
-			fmt.Printf("could not get index j<%v> from block: %v", j, full)
-			os.Exit(5)
-			return
+			panic(fmt.Errorf("could not get index j<%v> from block %v", j, full.Position()))
 		} else {
 			if !full.RemoveAtIndex(j) {
-				fmt.Printf("could not remove index j<%v> from block: %v", j, full)
-				os.Exit(5)
-				return
+				panic(fmt.Errorf("could not remove index j<%v> from block %v", j, full.Position()))
 			}
 			empty.Add(r)
 		}
@@ -100,9 +96,7 @@ func (self *BpTree) split(a *KeyBlock, rec *tmprec, nextb *KeyBlock, dirty *dirt
 	//      the mid point which is on the edge of the run of duplicate keys
 	//
 	// s is the point which the blocks should be balanced against. (ie the balance point)
-	//
-	// right is the block to insert into, true is a, false is b
-	m, s, right := func() (m int, s int, right bool) {
+	m, s := func() (m int, s int) {
 		getk := func(i int) ByteSlice {
 			r, _, _, _ := a.Get(i)
 			return r.GetKey()
@@ -120,11 +114,9 @@ func (self *BpTree) split(a *KeyBlock, rec *tmprec, nextb *KeyBlock, dirty *dirt
 		if lr <= rr && l != 0 {
 			m = l
 			s = l - 1 // since it is the left one we *must* subtract one from the balance point
-			right = false
 		} else {
 			m = r
 			s = r
-			right = true
 		}
 		return
 	}()
@@ -135,24 +127,15 @@ func (self *BpTree) split(a *KeyBlock, rec *tmprec, nextb *KeyBlock, dirty *dirt
 	var nextp ByteSlice
 	{
 		i, _, _, _, ok := a.Find(r.GetKey())
-		//         fmt.Printf("m=%v, s=%v, i=%v, choice=%v\n", m, s, i, right)
-
 		// so what is going on here is if the key is in a certain block we need to make sure
-		// we insert our next key in that block. This is the cleanest way to do that for now. even
-		// though it is hideously ugly.
-		if ok && m > i {
-			//             fmt.Println("choosing a", i, m, ok)
-			right = true
-		} else if ok && m < i {
-			//             fmt.Println("choosing b", i, m, ok)
-			right = false
-		} else if m > i {
+		// we insert our next key in that block. A key already in the block is left where it is.
+		if !ok && m > i {
 			// the mid point is after the spot where we would insert the key so we take the record
 			// just before the mid point as our new record would shift the mid point over by 1
 			split_rec, nextp, _, _ = a.Get(m - 1)
 			a.RemoveAtIndex(m - 1)
 			a.RemovePointer(m - 1)
-		} else if m < i {
+		} else if !ok && m < i {
 			// the mid point is before the new record so we can take the record at the mid point as
 			// the split record.
 			split_rec, nextp, _, _ = a.Get(m)
@@ -205,12 +188,7 @@ func (self *BpTree) split(a *KeyBlock, rec *tmprec, nextb *KeyBlock, dirty *dirt
 
 	// add the record to the block
 	if i, ok := block.Add(split_rec); !ok {
-		fmt.Println(m, s, right)
-		fmt.Println("Full:\n", a)
-		fmt.Println("Empty:\n", b)
-		fmt.Println("Rec:", r)
-		fmt.Println("return rec:", return_rec)
-		panic("Could not add the split_rec to the selected block PANIC")
+		panic(fmt.Errorf("could not add the split record to block %v", block.Position()))
 	} else {
 		// we now insert the pointer if we have one
 		if block.Mode()&POINTERS == POINTERS && nextp != nil {
@@ -239,9 +217,7 @@ func (self *BpTree) split(a *KeyBlock, rec *tmprec, nextb *KeyBlock, dirty *dirt
 	// if we have an external node (leaf) then we need to hook up the pointers between the leaf
 	// nodes to support range queries and duplicate keys
 	if a.Mode() == self.external.Mode {
-		tmp, _ := a.GetExtraPtr()
-		b.SetExtraPtr(tmp)
-		a.SetExtraPtr(b.Position())
+		self.link(a, b, dirty)
 	}
 
 	//     fmt.Println("\n\n\nAFTER EVERYTHING")
@@ -354,9 +330,7 @@ func (self *BpTree) insert(block *KeyBlock, rec *tmprec, height int, dirty *dirt
 					if block.Full() || !r.GetKey().Eq(firstr.GetKey()) {
 						newblock := self.allocate(self.external)
 						dirty.Insert(newblock)
-						p, _ := block.GetExtraPtr()
-						newblock.SetExtraPtr(p)
-						block.SetExtraPtr(newblock.Position())
+						self.link(block, newblock, dirty)
 						if _, ok := newblock.Add(r); !ok {
 							panic("347 could not add to empty block")
 						}
@@ -375,9 +349,7 @@ func (self *BpTree) insert(block *KeyBlock, rec *tmprec, height int, dirty *dirt
 					newblock := self.allocate(self.external)
 					dirty.Insert(block)
 					dirty.Insert(newblock)
-					p, _ := block.GetExtraPtr()
-					newblock.SetExtraPtr(p)
-					block.SetExtraPtr(newblock.Position())
+					self.link(block, newblock, dirty)
 					self.mv(block, newblock)
 					if _, ok := block.Add(r); !ok {
 						panic("366 could not add to empty block")
@@ -412,16 +384,16 @@ func (self *BpTree) insert(block *KeyBlock, rec *tmprec, height int, dirty *dirt
 	return self.split(block, rec, nextb, dirty)
 }
 
-func (self *BpTree) Insert(key ByteSlice, record []ByteSlice) bool {
+func (self *BpTree) Insert(key ByteSlice, record []ByteSlice) (err error) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
+	defer catch(&err)
 	dirty := dirty.New(self.info.Height() * 4)
 
 	// package the temp rec
 	rec, valid := pkg_rec(self, key, record)
 	if !valid {
-		fmt.Fprintln(os.Stderr, "key or record not valid")
-		return false
+		return fmt.Errorf("key or record not valid")
 	}
 
 	// insert the block if split is true then we need to split the root
@@ -430,7 +402,9 @@ func (self *BpTree) Insert(key ByteSlice, record []ByteSlice) bool {
 
 		// we have to sync the blocks back because the first key in the root will have been
 		// modified if the key we inserted was less than any key in the b+ tree
-		dirty.Sync()
+		if err := dirty.Sync(); err != nil {
+			return err
+		}
 
 		// we get the oldroot so we can get the first key from it, this key becomes the first key in
 		// the new root.
@@ -449,18 +423,14 @@ func (self *BpTree) Insert(key ByteSlice, record []ByteSlice) bool {
 		if i, ok := root.Add(first.internal()); ok {
 			root.InsertPointer(i, self.info.Root())
 		} else {
-			fmt.Println("431 Could not insert into empty block PANIC")
-			os.Exit(2)
-			return false
+			panic(fmt.Errorf("could not insert into the new root %v", root.Position()))
 		}
 
 		// then we point the split rec's key at the the split block
 		if i, ok := root.Add(r.internal()); ok {
 			root.InsertPointer(i, b.Position())
 		} else {
-			fmt.Println("440 Could not insert into empty block PANIC\n", r, "\n", root, oldroot)
-			os.Exit(2)
-			return false
+			panic(fmt.Errorf("could not insert into the new root %v", root.Position()))
 		}
 
 		// don't forget to update the height of the tree and the root
@@ -468,8 +438,8 @@ func (self *BpTree) Insert(key ByteSlice, record []ByteSlice) bool {
 		self.info.SetHeight(self.info.Height() + 1)
 	}
 	// at the end of of the method sync back the dirty blocks
+	self.changes++
 	self.info.IncEntries()
-	self.info.Serialize()
-	dirty.Sync()
-	return true
+	self.sync(dirty)
+	return nil
 }
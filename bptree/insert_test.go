@@ -21,12 +21,14 @@ func init() {
 
 var record []ByteSlice = []ByteSlice{[]byte{1, 2}, []byte{3, 4}, []byte{5, 6, 7, 8}}
 
-const ORDER_2_2 = 37
-const ORDER_3_3 = 50
-const ORDER_4_4 = 61
-const ORDER_5_5 = 73
+// ORDER_i_l blocks hold i keys in an internal block and l records in a leaf,
+// the leaves have room for two pointers to the leaves beside them
+const ORDER_3_2 = 45
+const ORDER_4_3 = 57
+const ORDER_5_4 = 69
+const ORDER_6_5 = 81
 
-var sizes [5]uint32 = [5]uint32{ORDER_2_2, ORDER_3_3, ORDER_4_4, ORDER_5_5, 256}
+var sizes [5]uint32 = [5]uint32{ORDER_3_2, ORDER_4_3, ORDER_5_4, ORDER_6_5, 256}
 
 func insert(a *KeyBlock, key ByteSlice) bool {
 	r := a.NewRecord(key)
@@ -160,7 +162,8 @@ func TestSplit(t *testing.T) {
 		var n int
 		{
 			self := makebptree(size, t)
-			n = int(self.external.KeysPerBlock())
+			// test_split splits internal blocks
+			n = int(self.internal.KeysPerBlock())
 			cleanbptree(self)
 		}
 		for i := 0; i <= n; i++ {
@@ -281,7 +284,8 @@ func TestInsert(t *testing.T) {
 		var i int
 		{
 			self := makebptree(size, t)
-			i = self.internal.KeysPerBlock()
+			// make_complete fills i leaves of i records
+			i = self.external.KeysPerBlock()
 			cleanbptree(self)
 		}
 
@@ -291,9 +295,7 @@ func TestInsert(t *testing.T) {
 			// t.Log(i)
 			self := makebptree(size, t)
 			make_complete(self, i, t)
-			if ok := self.Insert(ByteSlice32(uint32(i)), record); !ok {
-				t.Fatal("Insert returned false")
-			}
+			put(self, t, ByteSlice32(uint32(i)), record)
 			validate(self, n+1, t)
 			cleanbptree(self)
 		}
@@ -325,10 +327,10 @@ func TestRandomBuild(t *testing.T) {
 					_, ok = inserted[j]
 				}
 				inserted[j] = true
-				self.Insert(ByteSlice32(uint32(j)), record)
+				put(self, t, ByteSlice32(uint32(j)), record)
 			}
 			validate(self, n, t)
-			records := self.Find(ByteSlice32(uint32(0)), ByteSlice32(uint32(n)))
+			records := find(self, t, ByteSlice32(uint32(0)), ByteSlice32(uint32(n)))
 			i := 0
 			for rec := range records {
 				if !rec.GetKey().Eq(ByteSlice32(uint32(i))) {
@@ -336,9 +338,11 @@ func TestRandomBuild(t *testing.T) {
 				}
 				i++
 			}
-			if self.Size() != self.compute_size() {
+			if size, err := self.compute_size(); err != nil {
+				t.Fatal(err)
+			} else if self.Size() != size {
 				t.Log(self)
-				t.Fatalf("bptree.Size() != bptree.compute_size() %v got %v", self.Size(), self.compute_size())
+				t.Fatalf("bptree.Size() != bptree.compute_size() %v got %v", self.Size(), size)
 			}
 			cleanbptree(self)
 		}
@@ -408,13 +412,13 @@ func TestDupSplitO4(t *testing.T) {
 	}
 	for i, test := range tests {
 		//         fmt.Println("-------------->", i, test)
-		self := makebptree(ORDER_4_4, t)
+		self := makebptree(ORDER_5_4, t)
 		for _, i := range test {
-			self.Insert(ByteSlice32(i), record)
+			put(self, t, ByteSlice32(i), record)
 		}
 
 		prev := ByteSlice32(0)
-		results := self.Find(ByteSlice32(0), ByteSlice32(6))
+		results := find(self, t, ByteSlice32(0), ByteSlice32(6))
 		for result := range results {
 			if prev.Gt(result.GetKey()) {
 				t.Errorf("465 prev, %v, greater than current, %v.\n", prev, result.GetKey())
@@ -482,20 +486,22 @@ func TestRandomDuplicate(t *testing.T) {
 				m := n >> 1
 				j := rand.Intn(m)
 				inserted[j] = true
-				self.Insert(ByteSlice32(uint32(j)), record)
+				put(self, t, ByteSlice32(uint32(j)), record)
 			}
 
 			prev := ByteSlice32(0)
-			results := self.Find(ByteSlice32(0), ByteSlice32(uint32(n)))
+			results := find(self, t, ByteSlice32(0), ByteSlice32(uint32(n)))
 			for result := range results {
 				if prev.Gt(result.GetKey()) {
 					t.Errorf("465 prev, %v, greater than current, %v.\n", prev, result.GetKey())
 				}
 				prev = result.GetKey()
 			}
-			if self.Size() != self.compute_size() {
+			if size, err := self.compute_size(); err != nil {
+				t.Fatal(err)
+			} else if self.Size() != size {
 				t.Log(self)
-				t.Fatalf("bptree.Size() != bptree.compute_size() %v got %v", self.Size(), self.compute_size())
+				t.Fatalf("bptree.Size() != bptree.compute_size() %v got %v", self.Size(), size)
 			}
 			if i != 4 {
 				if k < 10 {
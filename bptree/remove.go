@@ -0,0 +1,367 @@
+package bptree
+
+import "fmt"
+import . "file-structures/block/byteslice"
+import . "file-structures/block/keyblock"
+import "file-structures/block/dirty"
+
+/*
+Removal takes a record out of its leaf and then walks back up the path to the
+root fixing every block left less than half full, either by merging it with a
+sibling or by evening out the records between the two. The keys in the internal
+blocks are not changed when the records under them are removed. A key only has
+to be no greater than every key under its pointer and greater than every key
+under the pointer before it, which stays true.
+
+Duplicate keys which overflow a leaf are kept in blocks chained after it that
+have no key in the parent. In such a run every block but the last is full, so
+when a record is removed from the run the hole is filled from the last block,
+and the last block is unlinked and freed once it is empty. Records are never
+moved across the edge of a run of duplicates, so a key is always found by
+descending to the leaf its run starts in.
+*/
+
+// a step of the path from the root to a leaf, the block and the index of the
+// pointer followed out of it
+type step struct {
+	block *KeyBlock
+	i     int
+}
+
+// Remove deletes every record with the key. It returns false if there were
+// none.
+func (self *BpTree) Remove(key ByteSlice) (removed bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer catch(&err)
+	if !self.ValidateKey(key) {
+		return false, fmt.Errorf("key not valid")
+	}
+	for self.remove(key, func(*Record) bool { return true }) {
+		removed = true
+	}
+	return removed, nil
+}
+
+// RemoveRecord deletes one record with the key and the fields given, for
+// telling apart the records of a duplicated key. It returns false if there was
+// no such record.
+func (self *BpTree) RemoveRecord(key ByteSlice, record []ByteSlice) (removed bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer catch(&err)
+	if !self.ValidateKey(key) || !self.ValidateRecord(record) {
+		return false, fmt.Errorf("key or record not valid")
+	}
+	return self.remove(key, func(rec *Record) bool {
+		for i, field := range record {
+			if !rec.Get(uint32(i)).Eq(field) {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+// descends to the leaf a record with key would be inserted in, which is the
+// leaf the run of records with key starts in
+func (self *BpTree) path(key ByteSlice) ([]step, *KeyBlock) {
+	var path []step
+	block := self.getblock(self.info.Root())
+	for height := self.info.Height() - 1; height > 0; height-- {
+		i, _, _, _, ok := block.Find(key)
+		if i > 0 && !ok {
+			i--
+		}
+		p, has := block.GetPointer(i)
+		if !has {
+			msg := fmt.Sprintf(
+				"Error could not get pointer %v from block %v", i, block)
+			panic(msg)
+		}
+		path = append(path, step{block, i})
+		block = self.getblock(p)
+	}
+	return path, block
+}
+
+// removes the first record with key that match accepts
+func (self *BpTree) remove(key ByteSlice, match func(*Record) bool) bool {
+	path, leaf := self.path(key)
+	dirty := dirty.New(self.info.Height() * 4)
+	var freed []*KeyBlock
+
+	run := self.run(leaf)
+	found := false
+	for _, block := range run {
+		i, _, _, _, ok := block.Find(key)
+		for ; ok && i < int(block.RecordCount()); i++ {
+			rec, _, _, _ := block.Get(i)
+			if !rec.GetKey().Eq(key) {
+				break
+			}
+			if match(rec) {
+				block.RemoveAtIndex(i)
+				dirty.Insert(block)
+				found = true
+				break
+			}
+		}
+		if found {
+			// fill the hole from the end of the run
+			last := run[len(run)-1]
+			if len(run) > 1 && block != last {
+				rec, _, _, _ := last.Get(int(last.RecordCount()) - 1)
+				last.RemoveAtIndex(int(last.RecordCount()) - 1)
+				block.Add(rec)
+				dirty.Insert(last)
+			}
+			if len(run) > 1 && last.RecordCount() == 0 {
+				next, _ := last.GetExtraPtr()
+				self.relink(run[len(run)-2], next, dirty)
+				freed = append(freed, last)
+			}
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	child := leaf
+	for level := len(path) - 1; level >= 0; level-- {
+		parent, i := path[level].block, path[level].i
+		if child.RecordCount() == 0 {
+			if self.sole(path[:level+1]) {
+				// the tree is empty, the root collapses down to this block
+				break
+			}
+			if child.Mode() == self.external.Mode {
+				self.unlink(path, child, dirty)
+			}
+			parent.RemoveAtIndex(i)
+			parent.RemovePointer(i)
+			freed = append(freed, child)
+		} else if self.underfull(child) {
+			self.rebalance(parent, i, child, dirty, &freed)
+		}
+		dirty.Insert(parent)
+		child = parent
+	}
+	if err := dirty.Sync(); err != nil {
+		panic(err)
+	}
+
+	// a root with a single pointer is replaced by the block it points at
+	for self.info.Height() > 1 {
+		root := self.getblock(self.info.Root())
+		if root.PointerCount() != 1 {
+			break
+		}
+		p, _ := root.GetPointer(0)
+		freed = append(freed, root)
+		self.info.SetRoot(p)
+		self.info.SetHeight(self.info.Height() - 1)
+	}
+	for _, block := range freed {
+		self.free(block.Position())
+	}
+	self.changes++
+	self.info.DecEntries()
+	if err := self.info.Serialize(); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// the leaf and the blocks chained after it holding the duplicates of its key
+// which did not fit in it
+func (self *BpTree) run(leaf *KeyBlock) []*KeyBlock {
+	run := []*KeyBlock{leaf}
+	first, _, _, ok := leaf.Get(0)
+	if !ok || !leaf.Full() || leaf.Count(first.GetKey()) != int(leaf.RecordCount()) {
+		return run
+	}
+	for block := leaf; ; {
+		p, _ := block.GetExtraPtr()
+		if p.Zero() {
+			return run
+		}
+		next := self.getblock(p)
+		if r, _, _, ok := next.Get(0); !ok || !r.GetKey().Eq(first.GetKey()) {
+			return run
+		}
+		run = append(run, next)
+		block = next
+	}
+}
+
+// every block on the path has a single pointer
+func (self *BpTree) sole(path []step) bool {
+	for _, s := range path {
+		if s.block.PointerCount() != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *BpTree) underfull(block *KeyBlock) bool {
+	return block.RecordCount() < block.MaxRecordCount()/2
+}
+
+// takes the leaf at the end of path out of the leaf chain by pointing the
+// block before it past it
+func (self *BpTree) unlink(path []step, leaf *KeyBlock, dirty *dirty.DirtyBlocks) {
+	next, _ := leaf.GetExtraPtr()
+	if prev := self.left_leaf(path); prev != nil {
+		self.relink(self.chain_to(prev, leaf.Position()), next, dirty)
+	} else {
+		// this is the first leaf, nothing points at it
+		self.relink(nil, next, dirty)
+	}
+}
+
+// fixes the underfull child at index i of parent using the sibling to its left
+// or failing that the one to its right
+func (self *BpTree) rebalance(parent *KeyBlock, i int, child *KeyBlock, dirty *dirty.DirtyBlocks, freed *[]*KeyBlock) {
+	if i > 0 {
+		p, _ := parent.GetPointer(i - 1)
+		left := self.getblock(p)
+		// a leaf followed by a run of its duplicates can not take any records
+		next, _ := left.GetExtraPtr()
+		if left.Mode() == self.internal.Mode || next.Eq(child.Position()) {
+			self.balance_pair(parent, i, left, child, dirty, freed)
+			return
+		}
+	}
+	if i+1 < int(parent.PointerCount()) {
+		p, _ := parent.GetPointer(i + 1)
+		right := self.getblock(p)
+		self.balance_pair(parent, i+1, child, right, dirty, freed)
+	}
+}
+
+// merges b, the block at index j of parent, into a if they fit in one block
+// otherwise moves records between them until they are about even
+func (self *BpTree) balance_pair(parent *KeyBlock, j int, a, b *KeyBlock, dirty *dirty.DirtyBlocks, freed *[]*KeyBlock) {
+	max := int(a.MaxRecordCount())
+	if a.Mode() == self.internal.Mode {
+		// b's first key might be lower than the key for it in the parent,
+		// either one is above every key under a
+		sep, _, _, _ := parent.Get(j)
+		entries := self.entries(a)
+		bentries := self.entries(b)
+		bentries[0].key = sep.GetKey()
+		entries = append(entries, bentries...)
+		if len(entries) <= max {
+			self.set_entries(a, entries)
+			parent.RemoveAtIndex(j)
+			parent.RemovePointer(j)
+			*freed = append(*freed, b)
+		} else {
+			m := len(entries) / 2
+			self.set_entries(a, entries[:m])
+			self.set_entries(b, entries[m:])
+			sep.SetKey(entries[m].key)
+			dirty.Insert(b)
+		}
+		dirty.Insert(a)
+		return
+	}
+
+	records := append(self.records(a), self.records(b)...)
+	if len(records) <= max {
+		next, _ := b.GetExtraPtr()
+		self.set_records(a, records)
+		self.relink(a, next, dirty)
+		parent.RemoveAtIndex(j)
+		parent.RemovePointer(j)
+		*freed = append(*freed, b)
+		dirty.Insert(a)
+		return
+	}
+	if len(self.run(b)) > 1 {
+		// b heads a run of duplicates, it has to stay full
+		return
+	}
+	// split at the edge of a run of duplicates closest to the middle
+	m := -1
+	for k := len(records) - max; k <= max; k++ {
+		if records[k-1].GetKey().Eq(records[k].GetKey()) {
+			continue
+		}
+		if m < 0 || abs(len(records)-2*k) < abs(len(records)-2*m) {
+			m = k
+		}
+	}
+	if m < 0 || m == int(a.RecordCount()) {
+		return
+	}
+	self.set_records(a, records[:m])
+	self.set_records(b, records[m:])
+	sep, _, _, _ := parent.Get(j)
+	sep.SetKey(records[m].GetKey())
+	dirty.Insert(a)
+	dirty.Insert(b)
+}
+
+type entry struct {
+	key ByteSlice
+	ptr ByteSlice
+}
+
+func (self *BpTree) entries(block *KeyBlock) []entry {
+	entries := make([]entry, 0, block.RecordCount())
+	for i := 0; i < int(block.RecordCount()); i++ {
+		r, p, _, _ := block.Get(i)
+		entries = append(entries, entry{r.GetKey(), p})
+	}
+	return entries
+}
+
+func (self *BpTree) set_entries(block *KeyBlock, entries []entry) {
+	for block.RecordCount() > 0 {
+		block.RemoveAtIndex(0)
+	}
+	for block.PointerCount() > 0 {
+		block.RemovePointer(0)
+	}
+	for _, e := range entries {
+		if i, ok := block.Add(self.internal.NewRecord(e.key)); !ok {
+			msg := fmt.Sprintf("could not add key %v to block \n%v\n", e.key, block)
+			panic(msg)
+		} else if !block.InsertPointer(i, e.ptr) {
+			msg := fmt.Sprintf("could not insert pointer %v to block \n%v\n", e.ptr, block)
+			panic(msg)
+		}
+	}
+}
+
+func (self *BpTree) records(block *KeyBlock) []*Record {
+	records := make([]*Record, 0, block.RecordCount())
+	for i := 0; i < int(block.RecordCount()); i++ {
+		r, _, _, _ := block.Get(i)
+		records = append(records, r)
+	}
+	return records
+}
+
+func (self *BpTree) set_records(block *KeyBlock, records []*Record) {
+	for block.RecordCount() > 0 {
+		block.RemoveAtIndex(0)
+	}
+	for _, r := range records {
+		if _, ok := block.Add(r); !ok {
+			msg := fmt.Sprintf("could not add record %v to block \n%v\n", r, block)
+			panic(msg)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,224 @@
+package bptree
+
+import "testing"
+import "fmt"
+import "math/rand"
+import file "file-structures/block/file2"
+import . "file-structures/block/keyblock"
+import . "file-structures/block/byteslice"
+
+func duprecord(j uint32) []ByteSlice {
+	return []ByteSlice{[]byte{1, 2}, []byte{3, 4}, ByteSlice32(j)}
+}
+
+// check_tree walks the tree checking the keys of the internal blocks bound the
+// blocks under them and that the leaf chain holds the leaves in order, with
+// only runs of duplicates between them, and links back the same way. It
+// returns the number of records with each key.
+func check_tree(self *BpTree, t *testing.T) map[uint32]int {
+	var leaves []*KeyBlock
+	var walk func(block *KeyBlock, height int, low, high ByteSlice)
+	walk = func(block *KeyBlock, height int, low, high ByteSlice) {
+		if height > 0 {
+			if block.Mode() != self.internal.Mode {
+				t.Fatalf("expected an internal block at height %v\n%v", height, block)
+			}
+			if block.RecordCount() == 0 {
+				t.Fatalf("empty internal block\n%v", block)
+			}
+			for i := 0; i < int(block.RecordCount()); i++ {
+				r, p, _, _ := block.Get(i)
+				lo := r.GetKey()
+				if i == 0 {
+					lo = low
+				} else if low != nil && lo.Lt(low) {
+					t.Fatalf("key %v is below its bound %v\n%v", lo, low, block)
+				}
+				hi := high
+				if next, _, _, ok := block.Get(i + 1); ok {
+					hi = next.GetKey()
+					if !r.GetKey().Lt(hi) {
+						t.Fatalf("keys out of order\n%v", block)
+					}
+				}
+				walk(self.getblock(p), height-1, lo, hi)
+			}
+			return
+		}
+		if block.Mode() != self.external.Mode {
+			t.Fatalf("expected a leaf\n%v", block)
+		}
+		if block.RecordCount() == 0 && height != self.info.Height()-1 {
+			t.Fatalf("empty leaf\n%v", block)
+		}
+		for i := 0; i < int(block.RecordCount()); i++ {
+			r, _, _, _ := block.Get(i)
+			if (low != nil && r.GetKey().Lt(low)) || (high != nil && !r.GetKey().Lt(high)) {
+				t.Fatalf("record %v is outside of [%v, %v)\n%v", r, low, high, block)
+			}
+		}
+		leaves = append(leaves, block)
+	}
+	walk(self.getblock(self.info.Root()), self.info.Height()-1, nil, nil)
+
+	counts := make(map[uint32]int)
+	var prev ByteSlice
+	total := uint64(0)
+	block := leaves[0]
+	before := ByteSlice64(0)
+	for j := 0; ; {
+		if p, has := block.GetPrevPtr(); has && !p.Eq(before) {
+			t.Fatalf("expected the block to point back at %v got %v\n%v", before, p, block)
+		}
+		before = block.Position()
+		if j < len(leaves) && block.Position().Eq(leaves[j].Position()) {
+			j++
+		} else {
+			// a block not in the tree must hold duplicates of the full block
+			// before it
+			r, _, _, _ := block.Get(0)
+			if block.RecordCount() == 0 || prev == nil || !r.GetKey().Eq(prev) ||
+				block.Count(prev) != int(block.RecordCount()) {
+				t.Fatalf("unexpected block in the leaf chain\n%v", block)
+			}
+		}
+		for i := 0; i < int(block.RecordCount()); i++ {
+			r, _, _, _ := block.Get(i)
+			if prev != nil && r.GetKey().Lt(prev) {
+				t.Fatalf("leaf chain out of order %v < %v", r.GetKey(), prev)
+			}
+			prev = r.GetKey()
+			counts[uint32(r.GetKey().Int32())]++
+			total++
+		}
+		p, _ := block.GetExtraPtr()
+		if p.Zero() {
+			if j != len(leaves) {
+				t.Fatalf("the leaf chain ended after %v of %v leaves", j, len(leaves))
+			}
+			break
+		}
+		block = self.getblock(p)
+	}
+	if self.Size() != total {
+		t.Fatalf("bptree.Size() != %v got %v", total, self.Size())
+	}
+	return counts
+}
+
+func TestRemove(t *testing.T) {
+	fmt.Println("----------- Random Remove -----------")
+	for i, size := range sizes {
+		if i == 4 {
+			break
+		}
+		var order int
+		{
+			self := makebptree(size, t)
+			order = self.internal.KeysPerBlock()
+			cleanbptree(self)
+		}
+		n := order*order*(order+2) + 1
+		for k := 0; k < 5; k++ {
+			self := makebptree(size, t)
+			keys := rand.Perm(n)
+			for _, j := range keys {
+				put(self, t, ByteSlice32(uint32(j)), record)
+			}
+			built, _ := self.bf.(*file.MemBlockFile).Size()
+			for x, j := range rand.Perm(n) {
+				if !remove(self, t, ByteSlice32(uint32(j))) {
+					t.Fatalf("could not remove %v", j)
+				}
+				if contains(self, t, ByteSlice32(uint32(j))) {
+					t.Fatalf("%v is still in the tree", j)
+				}
+				if remove(self, t, ByteSlice32(uint32(j))) {
+					t.Fatalf("removed %v twice", j)
+				}
+				if counts := check_tree(self, t); len(counts) != n-x-1 {
+					t.Fatalf("expected %v keys got %v", n-x-1, len(counts))
+				}
+			}
+			if self.info.Height() != 1 || self.Size() != 0 {
+				t.Fatalf("expected an empty tree of height 1 got height %v size %v",
+					self.info.Height(), self.Size())
+			}
+			for _ = range find(self, t, ByteSlice32(0), ByteSlice32(uint32(n))) {
+				t.Fatal("found a record in an empty tree")
+			}
+
+			// the blocks freed are used again
+			for _, j := range keys {
+				put(self, t, ByteSlice32(uint32(j)), record)
+			}
+			check_tree(self, t)
+			if size, _ := self.bf.(*file.MemBlockFile).Size(); size != built {
+				t.Fatalf("expected the file to stay %v bytes got %v", built, size)
+			}
+			cleanbptree(self)
+		}
+	}
+}
+
+func TestRemoveDuplicates(t *testing.T) {
+	fmt.Println("----------- Random Remove Duplicates -----------")
+	for i, size := range sizes {
+		if i == 0 || i == 4 {
+			continue
+		}
+		var order int
+		{
+			self := makebptree(size, t)
+			order = self.internal.KeysPerBlock()
+			cleanbptree(self)
+		}
+		n := order * order * (order + 2)
+		for k := 0; k < 5; k++ {
+			self := makebptree(size, t)
+			type rec struct{ key, val uint32 }
+			var recs []rec
+			expect := make(map[uint32]int)
+			for j := 0; j < n; j++ {
+				r := rec{uint32(rand.Intn(n >> 2)), uint32(j)}
+				recs = append(recs, r)
+				expect[r.key]++
+				put(self, t, ByteSlice32(r.key), duprecord(r.val))
+			}
+			check_tree(self, t)
+			// take out half of the records one at a time
+			for _, x := range rand.Perm(len(recs))[:len(recs)/2] {
+				r := recs[x]
+				if !removeRecord(self, t, ByteSlice32(r.key), duprecord(r.val)) {
+					t.Fatalf("could not remove %v", r)
+				}
+				if removeRecord(self, t, ByteSlice32(r.key), duprecord(r.val)) {
+					t.Fatalf("removed %v twice", r)
+				}
+				if expect[r.key]--; expect[r.key] == 0 {
+					delete(expect, r.key)
+				}
+				counts := check_tree(self, t)
+				for key, c := range expect {
+					if counts[key] != c {
+						t.Fatalf("expected %v records with key %v got %v", c, key, counts[key])
+					}
+				}
+			}
+			// and the rest a key at a time
+			for key := range expect {
+				if !remove(self, t, ByteSlice32(key)) {
+					t.Fatalf("could not remove %v", key)
+				}
+				if contains(self, t, ByteSlice32(key)) {
+					t.Fatalf("%v is still in the tree", key)
+				}
+				check_tree(self, t)
+			}
+			if self.Size() != 0 || self.info.Height() != 1 {
+				t.Fatalf("expected an empty tree got %v records", self.Size())
+			}
+			cleanbptree(self)
+		}
+	}
+}
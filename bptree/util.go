@@ -5,6 +5,7 @@ import "fmt"
 import "runtime"
 import . "file-structures/block/keyblock"
 import . "file-structures/block/byteslice"
+import "file-structures/block/dirty"
 
 // Allocates a new key block. This isn't quite as convient as the method
 // for BTrees as we have to tell it if we are allocating an internal or an
@@ -13,46 +14,169 @@ func (self *BpTree) allocate(dim *BlockDimensions) *KeyBlock {
 	if dim != self.external && dim != self.internal {
 		panic("Cannot allocate a block that has dimensions that are niether the dimensions of internal or external nodes.")
 	}
-	block, ok := NewKeyBlock(self.bf, dim)
-	if !ok {
-		panic("Could not allocate block PANIC")
+	block, err := NewKeyBlock(self.bf, dim)
+	if err != nil {
+		panic(err)
 	}
 	return block
 }
 
+// Gives the block at pos back to the device for allocate to hand out again.
+func (self *BpTree) free(pos ByteSlice) {
+	if err := self.bf.Free(int64(pos.Int64())); err != nil {
+		panic(err)
+	}
+}
+
+// Writes back the changed blocks and then the tree info.
+func (self *BpTree) sync(dirty *dirty.DirtyBlocks) {
+	if err := dirty.Sync(); err != nil {
+		panic(err)
+	}
+	if err := self.info.Serialize(); err != nil {
+		panic(err)
+	}
+}
+
+/*
+A block which can not be read or written fails the change the tree is in the
+middle of by panicking with the error, so the recursive insert and remove code
+does not have to pass it back up. The exported methods defer catch to return it.
+The blocks written before the failure stay written, a tree on a device which
+fails part way through a change may need to be rebuilt.
+*/
+func catch(err *error) {
+	if e := recover(); e != nil {
+		*err = caught(e)
+	}
+}
+
+// the error a recovered panic was raised with, anything else is a bug and
+// carries on panicking
+func caught(e interface{}) error {
+	if _, is := e.(runtime.Error); is {
+		panic(e)
+	}
+	if err, is := e.(error); is {
+		return err
+	}
+	panic(e)
+}
+
+// Puts block into the leaf chain after prev.
+func (self *BpTree) link(prev, block *KeyBlock, dirty *dirty.DirtyBlocks) {
+	next, _ := prev.GetExtraPtr()
+	self.relink(block, next, dirty)
+	prev.SetExtraPtr(block.Position())
+	block.SetPrevPtr(prev.Position())
+	dirty.Insert(prev)
+}
+
+// Points block at next in the leaf chain and next back at block. A nil block
+// makes next the first leaf.
+func (self *BpTree) relink(block *KeyBlock, next ByteSlice, dirty *dirty.DirtyBlocks) {
+	if block != nil {
+		block.SetExtraPtr(next)
+		dirty.Insert(block)
+	}
+	if self.external.Mode&PREVPTR == 0 || next.Zero() {
+		return
+	}
+	nb := self.getblock(next)
+	if block != nil {
+		nb.SetPrevPtr(block.Position())
+	} else {
+		nb.SetPrevPtr(ByteSlice64(0))
+	}
+	dirty.Insert(nb)
+}
+
+// Finds the last leaf under the pointer to the left of the path, nil if the
+// path leads to the first leaf. Records with the same key as its last record
+// may follow it in blocks which are not in the tree.
+func (self *BpTree) left_leaf(path []step) *KeyBlock {
+	for level := len(path) - 1; level >= 0; level-- {
+		if path[level].i == 0 {
+			continue
+		}
+		p, _ := path[level].block.GetPointer(path[level].i - 1)
+		block := self.getblock(p)
+		for block.Mode() == self.internal.Mode {
+			p, _ = block.GetPointer(int(block.PointerCount()) - 1)
+			block = self.getblock(p)
+		}
+		return block
+	}
+	return nil
+}
+
+// Finds the block before block in the leaf chain, nil if it is the first.
+// Leaves of older trees do not link back so it is looked for from the leaf
+// the first key of block is found in.
+func (self *BpTree) prev_leaf(block *KeyBlock) *KeyBlock {
+	if p, has := block.GetPrevPtr(); has {
+		if p.Zero() {
+			return nil
+		}
+		return self.getblock(p)
+	}
+	first, _, _, ok := block.Get(0)
+	if !ok {
+		// only the root of an empty tree is empty
+		return nil
+	}
+	path, leaf := self.path(first.GetKey())
+	if leaf.Position().Eq(block.Position()) {
+		if leaf = self.left_leaf(path); leaf == nil {
+			return nil
+		}
+	}
+	return self.chain_to(leaf, block.Position())
+}
+
+// Walks the leaf chain from block to the block pointing at pos.
+func (self *BpTree) chain_to(block *KeyBlock, pos ByteSlice) *KeyBlock {
+	for {
+		p, _ := block.GetExtraPtr()
+		if p.Eq(pos) {
+			return block
+		}
+		if p.Zero() {
+			msg := fmt.Sprintf("block %v is not in the leaf chain", pos)
+			panic(msg)
+		}
+		block = self.getblock(p)
+	}
+}
+
 // This version of getblock needs to find out what kind of block
 // it is getting. It does this by checking the mode of the block
 // before deserialization thus we cannot use the convience method
 // DeserializeFromFile
 func (self *BpTree) getblock(pos ByteSlice) *KeyBlock {
-	if bytes, read := self.bf.ReadBlock(int64(pos.Int64()), self.blocksize); read {
-		if bytes[0] == self.external.Mode {
-			if block, ok := Deserialize(self.bf, self.external, bytes, pos); !ok {
-				msg := fmt.Sprint(
-					"Unable to deserialize block at position: ", pos)
-				panic(msg)
-			} else {
-				return block
-			}
-		} else if bytes[0] == self.internal.Mode {
-			if block, ok := Deserialize(self.bf, self.internal, bytes, pos); !ok {
-				msg := fmt.Sprint(
-					"Unable to deserialize block at position: ", pos)
-				panic(msg)
-			} else {
-				return block
-			}
-		} else {
-			a, b, c, d := runtime.Caller(1)
-			msg := fmt.Sprintf(
-				"Block at position %v has an invalid mode\n%v\n%v\n%v\n%v\n", pos, a, b, c, d)
-			panic(msg)
-		}
+	bytes, err := self.bf.ReadBlock(int64(pos.Int64()))
+	if err != nil {
+		panic(err)
 	}
-	msg := fmt.Sprint(
-		"Error reading block at postion: ", pos)
-	panic(msg)
-	return nil
+	var dim *BlockDimensions
+	if bytes[0] == self.external.Mode {
+		dim = self.external
+	} else if bytes[0] == self.internal.Mode {
+		dim = self.internal
+	} else {
+		panic(fmt.Errorf("Block at position %v has an invalid mode %d", pos, bytes[0]))
+	}
+	block, err := Deserialize(self.bf, dim, bytes, pos)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// readblock is getblock returning the error for the callers outside catch.
+func (self *BpTree) readblock(pos ByteSlice) (block *KeyBlock, err error) {
+	defer catch(&err)
+	return self.getblock(pos), nil
 }
 
 func (self *BpTree) ValidateKey(key ByteSlice) bool {
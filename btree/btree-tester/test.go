@@ -3,6 +3,8 @@ package main
 import "fmt"
 import . "file-structures/btree"
 import . "file-structures/block/byteslice"
+import buf "file-structures/block/buffers"
+import file "file-structures/block/file2"
 
 func main() {
 
@@ -15,7 +17,20 @@ func main() {
 	}
 
 	fmt.Println("test2 yoyo")
-	btree, _ := NewBTree("hello.btree", 4, ([]uint32{1, 1, 2}))
+	bf := file.NewBlockFile("hello.btree", &buf.NoBuffer{})
+	if err := bf.Open(); err != nil {
+		panic(err)
+	}
+	cf, err := file.OpenLRUCacheFile(bf, 1000*file.BLOCKSIZE)
+	if err != nil {
+		panic(err)
+	}
+	btree, err := NewBTree(cf, 4, ([]uint32{1, 1, 2}))
+	if err != nil {
+		panic(err)
+	}
+	defer btree.Close()
+	defer cf.Persist()
 	rec := []ByteSlice{[]byte{1}, []byte{1}, []byte{1, 2}}
 	//     fmt.Println(btree)
 	fmt.Println(btree.Insert(ByteSlice32(1), rec))
@@ -66,5 +81,5 @@ func main() {
 	//     fmt.Println(btree)
 
 	fmt.Println(fac(5))
-	Dotty("out.dot", btree)
+	fmt.Println(Dotty("out.dot", btree))
 }
@@ -3,67 +3,91 @@ package btree
 import "fmt"
 
 // import "os"
-import "runtime"
 import "container/list"
 import "file-structures/treeinfo"
-import . "file-structures/block/file"
+import file "file-structures/block/file2"
 import . "file-structures/block/keyblock"
-import . "file-structures/block/buffers"
 import . "file-structures/block/byteslice"
 
 // const BLOCKSIZE = 45
 // const BLOCKSIZE = 65
 // const BLOCKSIZE = 105
 
+// STRUCTURE_TYPE tags the devices holding a BTree.
+var STRUCTURE_TYPE = file.Tag("BTRE")
+
 type BTree struct {
-	bf   *BlockFile
+	bf   file.BlockDevice
 	node *BlockDimensions
 	info *treeinfo.TreeInfo
 }
 
-func NewBTree(path string, keysize uint32, fields []uint32) (*BTree, bool) {
-	self := new(BTree)
-	// 4 MB buffer with a block size of 4096 bytes
-	if bf, ok := NewBlockFile(path, NewLFU(1000)); !ok {
-		fmt.Println("could not create block file")
-		return nil, false
-	} else {
-		self.bf = bf
+func NewBTree(bf file.BlockDevice, keysize uint32, fields []uint32) (*BTree, error) {
+	return NewBTreeCustomBlockSize(bf, bf.BlockSize(), keysize, fields)
+}
+
+// NewBTreeCustomBlockSize makes an empty tree whose nodes take blocksize bytes
+// of the device's blocks.
+func NewBTreeCustomBlockSize(bf file.BlockDevice, blocksize, keysize uint32, fields []uint32) (*BTree, error) {
+	if err := file.CheckStructureType(bf, STRUCTURE_TYPE); err != nil {
+		return nil, err
 	}
-	if dim, ok := NewBlockDimensions(RECORDS|POINTERS, treeinfo.BLOCKSIZE, keysize, 8, fields); !ok {
-		fmt.Println("Block Dimensions invalid")
-		return nil, false
-	} else {
-		self.node = dim
+	self, err := btree_with(bf, blocksize, keysize, fields)
+	if err != nil {
+		return nil, err
 	}
-	if !self.bf.Open() {
-		fmt.Println("Couldn't open file")
-		return nil, false
+	b, err := NewKeyBlock(self.bf, self.node)
+	if err != nil {
+		return nil, err
 	}
-	if s, open := self.bf.Size(); open && s == 0 {
-		// This is a new file the size is zero
-		self.bf.Allocate(self.node.BlockSize)
-		b, ok := NewKeyBlock(self.bf, self.node)
-		if !ok {
-			self.bf.Close()
-			fmt.Println("Could not create the root block")
-			return nil, false
-		}
-		if !b.SerializeToFile() {
-			self.bf.Close()
-			fmt.Println("Could not serialize root block to file")
-			return nil, false
-		}
-		self.info = treeinfo.New(self.bf, 1, b.Position())
-	} else {
-		self.info = treeinfo.Load(self.bf)
+	if err := b.SerializeToFile(); err != nil {
+		return nil, err
+	}
+	if self.info, err = treeinfo.New(self.bf, blocksize, 1, b.Position()); err != nil {
+		return nil, err
+	}
+	if err := bf.SetStructureType(STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func OpenBTree(bf file.BlockDevice, keysize uint32, fields []uint32) (*BTree, error) {
+	if err := file.CheckStructureType(bf, STRUCTURE_TYPE); err != nil {
+		return nil, err
 	}
-	runtime.SetFinalizer(self,
-		func(self *BTree) { self.bf.Close() })
-	return self, true
+	info, err := treeinfo.Load(bf)
+	if err != nil {
+		return nil, err
+	}
+	self, err := btree_with(bf, info.BlockSize(), keysize, fields)
+	if err != nil {
+		return nil, err
+	}
+	self.info = info
+	return self, nil
+}
+
+func btree_with(bf file.BlockDevice, blocksize, keysize uint32, fields []uint32) (*BTree, error) {
+	if blocksize > bf.BlockSize() {
+		return nil, fmt.Errorf("A block size of %d does not fit in the %d byte blocks of the device",
+			blocksize, bf.BlockSize())
+	}
+	dim, ok := NewBlockDimensions(RECORDS|POINTERS, blocksize, keysize, 8, fields)
+	if !ok {
+		return nil, fmt.Errorf("Block Dimensions invalid")
+	}
+	return &BTree{bf: bf, node: dim}, nil
+}
+
+// Close closes the device the tree is on.
+func (self *BTree) Close() error {
+	return self.bf.Close()
 }
 
-func (self *BTree) Find(key ByteSlice) (*Record, bool) {
+// Find gets the record with the key, nil if there is none.
+func (self *BTree) Find(key ByteSlice) (rec *Record, err error) {
+	defer catch(&err)
 	var find func(*KeyBlock, int) *Record
 	find = func(block *KeyBlock, ht int) *Record {
 		i, rec, _, _, found := block.Find(key)
@@ -81,15 +105,9 @@ func (self *BTree) Find(key ByteSlice) (*Record, bool) {
 		}
 		return nil
 	}
-	r := find(self.getblock(self.info.Root()), self.info.Height())
-	if r == nil {
-		return nil, false
-	}
-	return r, true
+	return find(self.getblock(self.info.Root()), self.info.Height()), nil
 }
 
-func (self *BTree) Path() string { return self.bf.Path() }
-
 func (self *BTree) String() string {
 	s := "BTree:\n{\n"
 	stack := list.New()
@@ -98,7 +116,7 @@ func (self *BTree) String() string {
 		e := stack.Front()
 		pos := e.Value.(ByteSlice)
 		stack.Remove(e)
-		if block, ok := DeserializeFromFile(self.bf, self.node, pos); ok {
+		if block, err := DeserializeFromFile(self.bf, self.node, pos); err == nil {
 			s += fmt.Sprintln(block)
 			for i := 0; i < int(block.PointerCount()); i++ {
 				if p, ok := block.GetPointer(i); ok {
@@ -1,69 +1,29 @@
 package btree
 
 import "testing"
-import "fmt"
-import "os"
-import "runtime"
-import "file-structures/block/file"
-import "file-structures/treeinfo"
-import . "file-structures/block/keyblock"
-import . "file-structures/block/buffers"
+import file "file-structures/block/file2"
 import . "file-structures/block/byteslice"
 
 var rec []ByteSlice = []ByteSlice{[]byte{1}, []byte{1}, []byte{1, 2}}
 var BLOCKSIZE uint32 = 65
 
-func testingNewBTree(blocksize uint32) (*BTree, bool) {
-	path := "test.btree"
-	keysize := uint32(4)
-	fields := ([]uint32{1, 1, 2})
-	self := new(BTree)
-	// 4 MB buffer with a block size of 4096 bytes
-	if bf, ok := file.NewBlockFile(path, NewLFU(1000)); !ok {
-		fmt.Println("could not create block file")
-		return nil, false
-	} else {
-		self.bf = bf
-	}
-	file.OPENFLAG = os.O_RDWR | os.O_CREATE
-	if dim, ok := NewBlockDimensions(RECORDS|POINTERS, blocksize, keysize, 8, fields); !ok {
-		fmt.Println("Block Dimensions invalid")
-		return nil, false
-	} else {
-		self.node = dim
-	}
-	//     fmt.Println("keys per block", self.node.KeysPerBlock())
-	if !self.bf.Open() {
-		fmt.Println("Couldn't open file")
-		return nil, false
-	}
-	if s, open := self.bf.Size(); open && s == 0 {
-		// This is a new file the size is zero
-		self.bf.Allocate(self.node.BlockSize)
-		b, ok := NewKeyBlock(self.bf, self.node)
-		if !ok {
-			self.bf.Close()
-			fmt.Println("Could not create the root block")
-			return nil, false
-		}
-		if !b.SerializeToFile() {
-			self.bf.Close()
-			fmt.Println("Could not serialize root block to file")
-			return nil, false
-		}
-		self.info = treeinfo.New(self.bf, 1, b.Position())
+func testingNewBTree(blocksize uint32) (*BTree, error) {
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		return nil, err
 	}
-	clean := func(self *BTree) { self.bf.Close() }
-	runtime.SetFinalizer(self, clean)
-	return self, true
+	return NewBTreeCustomBlockSize(mf, blocksize, 4, ([]uint32{1, 1, 2}))
 }
 
 func makebtree(blocksize uint32) *BTree {
-	btree, _ := testingNewBTree(blocksize)
+	btree, err := testingNewBTree(blocksize)
+	if err != nil {
+		panic(err)
+	}
 	return btree
 }
 
-func cleanbtree(btree *BTree) { os.Remove(btree.Path()) }
+func cleanbtree(btree *BTree) { btree.Close() }
 
 // this is commented out because i intend to play with the blocksize, to do so i need to ensure
 // the test will not fail because of a miss aligned read or write so i disable O_DIRECT on linux
@@ -85,8 +45,8 @@ func TestAllocate(t *testing.T) {
 	if k == nil {
 		t.Error("could not allocate a new block")
 	}
-	if !k.SerializeToFile() {
-		t.Error("could not serialize a new block to file")
+	if err := k.SerializeToFile(); err != nil {
+		t.Error("could not serialize a new block to file", err)
 	}
 }
 
@@ -147,3 +107,44 @@ func TestValidateRecord(t *testing.T) {
 		t.Error("invalid key validated")
 	}
 }
+
+func TestOpen(t *testing.T) {
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBTree(mf, 4, ([]uint32{1, 1, 2})); err == nil {
+		t.Fatal("expected an empty device not to open as a tree")
+	}
+	self, err := NewBTreeCustomBlockSize(mf, ORDER_3, 4, ([]uint32{1, 1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 200
+	for i := 1; i <= n; i++ {
+		if err := self.Insert(ByteSlice32(uint32(i)), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopened, err := file.LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	self, err = OpenBTree(reopened, 4, ([]uint32{1, 1, 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= n; i++ {
+		if r, err := self.Find(ByteSlice32(uint32(i))); err != nil {
+			t.Fatal(err)
+		} else if r == nil {
+			t.Fatalf("could not find %v in the reopened tree", i)
+		}
+	}
+	if r, err := self.Find(ByteSlice32(uint32(n + 1))); err != nil || r != nil {
+		t.Fatalf("expected no record for %v got %v %v", n+1, r, err)
+	}
+}
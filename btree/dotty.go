@@ -8,9 +8,13 @@ import "container/list"
 var header string = "digraph btree {\n"
 var footer string = "}\n"
 
-func Dotty(filename string, tree *BTree) {
-
-	file, _ := os.Create(filename)
+func Dotty(filename string, tree *BTree) (err error) {
+	defer catch(&err)
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 	fmt.Fprintln(file, header)
 
 	label := func(vals []string, size int) string {
@@ -72,6 +76,6 @@ func Dotty(filename string, tree *BTree) {
 			fmt.Fprintln(file, edge)
 		}
 	}
-	fmt.Fprintln(file, footer)
-	file.Close()
+	_, err = fmt.Fprintln(file, footer)
+	return err
 }
@@ -13,9 +13,9 @@ func TestFind(t *testing.T) {
 	self.Insert(ByteSlice32(uint32(n)), rec)
 
 	for i := 1; i <= n; i++ {
-		r, ok := self.Find(ByteSlice32(uint32(i)))
-		if !ok {
-			t.Errorf("could not find i in block")
+		r, err := self.Find(ByteSlice32(uint32(i)))
+		if err != nil || r == nil {
+			t.Fatalf("could not find i in block %v", err)
 		}
 		if int(r.GetKey().Int32()) != i {
 			t.Errorf("key of the returned record not the one searched for")
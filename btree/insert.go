@@ -1,7 +1,6 @@
 package btree
 
 import "fmt"
-import "os"
 
 // import "container/list"
 // import . "block/file"
@@ -21,14 +20,10 @@ func (self BTree) balance_blocks(full *KeyBlock, empty *KeyBlock) {
 	m := n >> 1
 	for j := n - 1; j >= m; j-- {
 		if r, _, _, ok := full.Get(j); !ok {
-			fmt.Printf("could not get index j<%v> from block: %v", j, full)
-			os.Exit(5)
-			return
+			panic(fmt.Errorf("could not get index j<%v> from block %v", j, full.Position()))
 		} else {
 			if !full.RemoveAtIndex(j) {
-				fmt.Printf("could not remove index j<%v> from block: %v", j, full)
-				os.Exit(5)
-				return
+				panic(fmt.Errorf("could not remove index j<%v> from block %v", j, full.Position()))
 			}
 			empty.Add(r)
 		}
@@ -60,21 +55,21 @@ func (self *BTree) split(block *KeyBlock, rec *Record, nextb *KeyBlock, dirty *d
 		split_rec, _, _, _ = block.Get(m - 1)
 		block.RemoveAtIndex(m - 1)
 		if _, ok := block.Add(rec); !ok {
-			fmt.Println("Inserting record into block failed PANIC")
-			os.Exit(3)
+			panic(fmt.Errorf("could not insert the record into block %v", block.Position()))
 		}
 	} else if m < i {
 		split_rec, _, _, _ = block.Get(m)
 		block.RemoveAtIndex(m)
 		if _, ok := block.Add(rec); !ok {
-			fmt.Println("Inserting record into block failed PANIC")
-			os.Exit(3)
+			panic(fmt.Errorf("could not insert the record into block %v", block.Position()))
 		}
 	} else {
 		split_rec = rec
 	}
 	self.balance_blocks(block, new_block)
-	dirty.Sync() // figure out how to remove
+	if err := dirty.Sync(); err != nil { // figure out how to remove
+		panic(err)
+	}
 	if nextb != nil {
 		//         fmt.Println("NEXTB: ", nextb)
 		nextr, _, _, _ := nextb.Get(0)
@@ -145,9 +140,7 @@ func (self *BTree) insert(block *KeyBlock, rec *Record, height int, dirty *dirty
 			} else if ok && right != nil {
 				pos = right // the right
 			} else {
-				fmt.Println("Bad block pointer in interior node PANIC, for real? ", ok)
-				fmt.Println(block)
-				os.Exit(4)
+				panic(fmt.Errorf("bad block pointer in interior block %v", block.Position()))
 			}
 		}
 		// recursive insert call, s is true we a node split occured in the level below so we change our insert
@@ -175,11 +168,12 @@ func (self *BTree) insert(block *KeyBlock, rec *Record, height int, dirty *dirty
 	return self.split(block, rec, nextb, dirty)
 }
 
-func (self *BTree) Insert(key ByteSlice, record []ByteSlice) bool {
+func (self *BTree) Insert(key ByteSlice, record []ByteSlice) (err error) {
+	defer catch(&err)
 	dirty := dirty.New(self.info.Height() * 4) // this is our buffer of "dirty" blocks that we will write back at the end
 
 	if !self.ValidateKey(key) || !self.ValidateRecord(record) {
-		return false
+		return fmt.Errorf("key or record not valid")
 	}
 
 	// makes the record
@@ -198,14 +192,14 @@ func (self *BTree) Insert(key ByteSlice, record []ByteSlice) bool {
 			root.InsertPointer(i, self.info.Root())
 			root.InsertPointer(i+1, b.Position())
 		} else {
-			fmt.Println("Could not insert into empty block PANIC")
-			os.Exit(2)
-			return false
+			panic(fmt.Errorf("could not insert into the new root %v", root.Position()))
 		}
 		// don't forget to update the height of the tree and the root
 		self.info.SetRoot(root.Position())
 		self.info.SetHeight(self.info.Height() + 1)
 	}
-	dirty.Sync() // writes the dirty blocks to disk
-	return true
+	if err := dirty.Sync(); err != nil { // writes the dirty blocks to disk
+		return err
+	}
+	return self.info.Serialize()
 }
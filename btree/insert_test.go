@@ -374,9 +374,9 @@ func TestRandomBuildO2(t *testing.T) {
 		self := makebtree(ORDER_2)
 		for i := 1; i <= n; i++ {
 			j := rand.Intn(n) + 1
-			for _, ok := self.Find(ByteSlice32(uint32(j))); ok; {
+			for r, _ := self.Find(ByteSlice32(uint32(j))); r != nil; {
 				j = rand.Intn(n) + 1
-				_, ok = self.Find(ByteSlice32(uint32(j)))
+				r, _ = self.Find(ByteSlice32(uint32(j)))
 			}
 			self.Insert(ByteSlice32(uint32(j)), rec)
 		}
@@ -397,9 +397,9 @@ func TestRandomBuildO3(t *testing.T) {
 		self := makebtree(ORDER_3)
 		for i := 1; i <= n; i++ {
 			j := rand.Intn(n) + 1
-			for _, ok := self.Find(ByteSlice32(uint32(j))); ok; {
+			for r, _ := self.Find(ByteSlice32(uint32(j))); r != nil; {
 				j = rand.Intn(n) + 1
-				_, ok = self.Find(ByteSlice32(uint32(j)))
+				r, _ = self.Find(ByteSlice32(uint32(j)))
 			}
 			self.Insert(ByteSlice32(uint32(j)), rec)
 		}
@@ -421,9 +421,9 @@ func TestRandomBuildO4(t *testing.T) {
 		self := makebtree(ORDER_4)
 		for i := 1; i <= n; i++ {
 			j := rand.Intn(n) + 1
-			for _, ok := self.Find(ByteSlice32(uint32(j))); ok; {
+			for r, _ := self.Find(ByteSlice32(uint32(j))); r != nil; {
 				j = rand.Intn(n) + 1
-				_, ok = self.Find(ByteSlice32(uint32(j)))
+				r, _ = self.Find(ByteSlice32(uint32(j)))
 			}
 			self.Insert(ByteSlice32(uint32(j)), rec)
 		}
@@ -445,9 +445,9 @@ func TestRandomBuildO5(t *testing.T) {
 		self := makebtree(ORDER_5)
 		for i := 1; i <= n; i++ {
 			j := rand.Intn(n) + 1
-			for _, ok := self.Find(ByteSlice32(uint32(j))); ok; {
+			for r, _ := self.Find(ByteSlice32(uint32(j))); r != nil; {
 				j = rand.Intn(n) + 1
-				_, ok = self.Find(ByteSlice32(uint32(j)))
+				r, _ = self.Find(ByteSlice32(uint32(j)))
 			}
 			self.Insert(ByteSlice32(uint32(j)), rec)
 		}
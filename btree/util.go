@@ -1,28 +1,39 @@
 package btree
 
-import "fmt"
-import "os"
+import "runtime"
 import . "file-structures/block/keyblock"
 import . "file-structures/block/byteslice"
 
 func (self *BTree) allocate() *KeyBlock {
-	b, ok := NewKeyBlock(self.bf, self.node)
-	if !ok {
-		fmt.Println("Could not allocate block PANIC")
-		os.Exit(1)
+	b, err := NewKeyBlock(self.bf, self.node)
+	if err != nil {
+		panic(err)
 	}
 	return b
 }
 
 func (self *BTree) getblock(pos ByteSlice) *KeyBlock {
-	cblock, ok := DeserializeFromFile(self.bf, self.node, pos)
-	if !ok {
-		fmt.Println("Bad block pointer PANIC")
-		os.Exit(7)
+	cblock, err := DeserializeFromFile(self.bf, self.node, pos)
+	if err != nil {
+		panic(err)
 	}
 	return cblock
 }
 
+// A block which can not be read or written panics with the error all the way
+// up to the exported method, which returns it. Other panics keep going.
+func catch(err *error) {
+	if e := recover(); e != nil {
+		if _, is := e.(runtime.Error); is {
+			panic(e)
+		} else if e2, is := e.(error); is {
+			*err = e2
+		} else {
+			panic(e)
+		}
+	}
+}
+
 func (self *BTree) ValidateKey(key ByteSlice) bool {
 	return len(key) == int(self.node.KeySize)
 }
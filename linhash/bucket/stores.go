@@ -162,6 +162,14 @@ func NewVarcharStore(file file.BlockDevice) (*VarcharStore, error) {
 	return &VarcharStore{vc}, nil
 }
 
+func OpenVarcharStore(file file.BlockDevice) (*VarcharStore, error) {
+	vc, err := varchar.OpenVarchar(file)
+	if err != nil {
+		return nil, err
+	}
+	return &VarcharStore{vc}, nil
+}
+
 func (self *VarcharStore) Size() uint8 {
 	return 8
 }
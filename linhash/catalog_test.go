@@ -0,0 +1,91 @@
+package linhash
+
+import "testing"
+
+import (
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+	bucket "file-structures/linhash/bucket"
+)
+
+// the hash and the store of its values share one device through a catalog
+func TestLinearHashCatalog(t *testing.T) {
+	const RECORDS = 300
+	mf := file.NewMemBlockFile()
+	if err := mf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := file.NewCatalog(mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vroot, err := catalog.Create("values")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := bucket.NewVarcharStore(vroot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hroot, err := catalog.Create("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linhash, err := NewLinearHash(hroot, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]bs.ByteSlice)
+	for len(keys) < RECORDS {
+		keys[string(randslice(8))] = randslice(100)
+	}
+	for key, value := range keys {
+		if err := linhash.Put(bs.ByteSlice(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := linhash.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := file.LoadMemBlockFile(mf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reopened.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if catalog, err = file.OpenCatalog(reopened); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := catalog.Close(); err != nil {
+			panic(err)
+		}
+	}()
+	if vroot, err = catalog.Root("values"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLinearHash(vroot, store); err == nil {
+		t.Fatal("Expected the store's root not to open as a hash")
+	}
+	if store, err = bucket.OpenVarcharStore(vroot); err != nil {
+		t.Fatal(err)
+	}
+	if hroot, err = catalog.Root("hash"); err != nil {
+		t.Fatal(err)
+	}
+	if linhash, err = OpenLinearHash(hroot, store); err != nil {
+		t.Fatal(err)
+	}
+	if linhash.Length() != RECORDS {
+		t.Fatalf("Expected %d records got %d", RECORDS, linhash.Length())
+	}
+	for key, value := range keys {
+		if got, err := linhash.Get(bs.ByteSlice(key)); err != nil {
+			t.Fatal(err)
+		} else if !got.Eq(value) {
+			t.Fatal("Error getting record, value was not as expected")
+		}
+	}
+}
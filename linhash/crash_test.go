@@ -0,0 +1,284 @@
+package linhash
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+	bucket "file-structures/linhash/bucket"
+)
+
+const CRASHWAL = "/tmp/__lin_crash_wal"
+
+/*
+The crash tests run a LinearHash over a WALFile over a FaultFile. An operation
+is run once for every write it makes with the device crashing at that write,
+then the image left behind is reopened through OpenLinearHash and has to hold
+either everything before the operation or everything after it.
+*/
+
+type crashstate map[string]bs.ByteSlice
+
+func (self crashstate) copy() crashstate {
+	state := make(crashstate)
+	for key, value := range self {
+		state[key] = value
+	}
+	return state
+}
+
+func crashopen(t *testing.T, image []byte, kv bucket.KVStore) (*file.FaultFile, *file.WALFile, *LinearHash) {
+	ff, err := file.LoadFaultFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := file.NewWALFile(ff, CRASHWAL)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	linhash, err := OpenLinearHash(wf, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ff, wf, linhash
+}
+
+func crashcheck(t *testing.T, linhash *LinearHash, before, after crashstate, probe string) {
+	expected := before
+	if has, err := linhash.Has(bs.ByteSlice(probe)); err != nil {
+		t.Fatal(err)
+	} else if has {
+		expected = after
+	}
+	if linhash.Length() != len(expected) {
+		t.Fatalf("Expected %d records got %d", len(expected), linhash.Length())
+	}
+	keys, err := linhash.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys got %d", len(expected), len(keys))
+	}
+	for _, key := range keys {
+		if _, has := expected[string(key)]; !has {
+			t.Fatalf("Found key %v which should not be there", key)
+		}
+	}
+	for key, value := range after {
+		if _, has := before[key]; has {
+			continue
+		}
+		if got, err := linhash.Get(bs.ByteSlice(key)); err != nil {
+			t.Fatal(err)
+		} else if !got.Eq(value) {
+			t.Fatal("Error getting record, value was not as expected")
+		}
+	}
+	// the structure has to keep working after recovery
+	key, value := randslice(8), randslice(8)
+	if err := linhash.Put(key, value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := linhash.Get(key); err != nil {
+		t.Fatal(err)
+	} else if !got.Eq(value) {
+		t.Fatal("Error getting record, value was not as expected")
+	}
+}
+
+func TestLinearHashCrash(t *testing.T) {
+	const PUTS = 40
+	const REMOVES = 10
+	defer os.Remove(CRASHWAL)
+	os.Remove(CRASHWAL)
+	kv, err := bucket.NewBytesStore(8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ff := file.NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := file.NewWALFile(ff, CRASHWAL)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wf.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	linhash, err := NewLinearHash(wf, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stop just short of a split so the operation under test splits a bucket
+	records := int(UTILIZATION*float64(int(linhash.ctrl.buckets)*linhash.table.RecordsPerBlock())) - PUTS/2
+	before := make(crashstate)
+	for len(before) < records {
+		key, value := randslice(8), randslice(8)
+		if err := linhash.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		before[string(key)] = value
+	}
+	if err := wf.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	buckets := linhash.ctrl.buckets
+	if err := linhash.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base := ff.Bytes()
+
+	after := before.copy()
+	var puts, removes []string
+	for len(puts) < PUTS {
+		key := string(randslice(8))
+		if _, has := after[key]; !has {
+			puts = append(puts, key)
+			after[key] = randslice(8)
+		}
+	}
+	for key := range before {
+		if len(removes) == REMOVES {
+			break
+		}
+		removes = append(removes, key)
+		delete(after, key)
+	}
+	op := func(wf *file.WALFile, linhash *LinearHash) error {
+		if err := wf.Begin(); err != nil {
+			return err
+		}
+		for _, key := range puts {
+			if err := linhash.Put(bs.ByteSlice(key), after[key]); err != nil {
+				return err
+			}
+		}
+		for _, key := range removes {
+			if err := linhash.Remove(bs.ByteSlice(key)); err != nil {
+				return err
+			}
+		}
+		return wf.Commit()
+	}
+
+	for _, tear := range []bool{false, true} {
+		for _, power := range []bool{false, true} {
+			for n := 1; ; n++ {
+				ff, wf, linhash := crashopen(t, base, kv)
+				if tear {
+					ff.TearWrite(n)
+				} else {
+					ff.FailWrite(n)
+				}
+				err := op(wf, linhash)
+				if err == nil && !ff.Crashed() {
+					if linhash.ctrl.buckets == buckets {
+						t.Fatal("Expected the operation to split a bucket")
+					}
+					if err := linhash.Close(); err != nil {
+						t.Fatal(err)
+					}
+					break
+				} else if !ff.Crashed() {
+					t.Fatal(err)
+				}
+				wf.Close()
+
+				image := ff.Bytes()
+				if power {
+					image = ff.SyncedBytes()
+				}
+				_, _, linhash = crashopen(t, image, kv)
+				crashcheck(t, linhash, before, after, puts[0])
+				if err := linhash.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+func TestLinearHashReadFault(t *testing.T) {
+	defer os.Remove(CRASHWAL)
+	os.Remove(CRASHWAL)
+	kv, err := bucket.NewBytesStore(8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ff := file.NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := file.NewWALFile(ff, CRASHWAL)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	linhash, err := NewLinearHash(wf, kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(crashstate)
+	for len(before) < 100 {
+		key, value := randslice(8), randslice(8)
+		if err := linhash.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		before[string(key)] = value
+	}
+	if err := linhash.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base := ff.Bytes()
+
+	after := before.copy()
+	var puts []string
+	for len(puts) < 20 {
+		key := string(randslice(8))
+		puts = append(puts, key)
+		after[key] = randslice(8)
+	}
+	for n := 1; ; n++ {
+		ff, wf, linhash := crashopen(t, base, kv)
+		ff.FailRead(n)
+		err := func() error {
+			if err := wf.Begin(); err != nil {
+				return err
+			}
+			for _, key := range puts {
+				if err := linhash.Put(bs.ByteSlice(key), after[key]); err != nil {
+					return err
+				}
+			}
+			return wf.Commit()
+		}()
+		if err == nil {
+			if err := linhash.Close(); err != nil {
+				t.Fatal(err)
+			}
+			break
+		} else if err != file.ErrInjected {
+			t.Fatal(err)
+		}
+		if err := wf.Abort(); err != nil {
+			t.Fatal(err)
+		}
+		if err := wf.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_, _, linhash = crashopen(t, ff.Bytes(), kv)
+		crashcheck(t, linhash, before, before, puts[0])
+		if err := linhash.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -30,6 +30,9 @@ type ctrlblk struct {
 
 const CONTROLSIZE = 21
 
+// STRUCTURE_TYPE tags the files holding the buckets of a LinearHash.
+var STRUCTURE_TYPE = file.Tag("LINH")
+
 func (self *ctrlblk) Bytes() []byte {
 	bytes := make([]byte, CONTROLSIZE)
 	copy(bytes[0:4], bs.ByteSlice32(self.buckets))
@@ -87,10 +90,16 @@ func NewLinearHash(file file.BlockDevice, kv bucket.KVStore) (self *LinearHash,
 			i:       I,
 		},
 	}
+	if err := file.SetStructureType(STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
 	return self, self.write_ctrlblk()
 }
 
 func OpenLinearHash(file file.BlockDevice, kv bucket.KVStore) (self *LinearHash, err error) {
+	if err := check_type(file); err != nil {
+		return nil, err
+	}
 	self = &LinearHash{
 		file: file,
 		kv:   kv,
@@ -101,6 +110,10 @@ func OpenLinearHash(file file.BlockDevice, kv bucket.KVStore) (self *LinearHash,
 	return self, nil
 }
 
+func check_type(f file.BlockDevice) error {
+	return file.CheckStructureType(f, STRUCTURE_TYPE)
+}
+
 func (self *LinearHash) Close() error {
 	return self.file.Close()
 }
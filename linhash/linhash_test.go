@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 )
 
 import (
@@ -13,6 +14,7 @@ import (
 	bs "file-structures/block/byteslice"
 	file "file-structures/block/file2"
 	bucket "file-structures/linhash/bucket"
+	"file-structures/varchar"
 )
 
 const PATH = "/tmp/__lin_linhash"
@@ -323,3 +325,31 @@ func TestPutHasGetRemoveLinearHash(t *testing.T) {
 			linhash.ctrl.records)
 	}
 }
+
+func TestOpenWrongStructure(t *testing.T) {
+	g := file.NewMemBlockFile()
+	if err := g.Open(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := bucket.NewVarcharStore(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLinearHash(g, store); err == nil || !strings.Contains(err.Error(), `"VCHR"`) {
+		t.Fatalf("Expected opening a varchar as a linear hash to fail got %v", err)
+	}
+
+	f := file.NewMemBlockFile()
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewLinearHash(f, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLinearHash(f, store); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := varchar.OpenVarchar(f); err == nil || !strings.Contains(err.Error(), `"LINH"`) {
+		t.Fatalf("Expected opening a linear hash as a varchar to fail got %v", err)
+	}
+}
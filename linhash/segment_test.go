@@ -0,0 +1,87 @@
+package linhash
+
+import "testing"
+
+import (
+	buf "file-structures/block/buffers"
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+	bucket "file-structures/linhash/bucket"
+)
+
+const SEGPATH = "/tmp/__lin_segments"
+const VSEGPATH = "/tmp/__varchar_store_lin_segments"
+
+// segments small enough that the hash and its store spread over many of them
+func segmentfile(t *testing.T, path string) *file.SegmentedFile {
+	f := file.NewSegmentedFileWithFlags(path, &buf.NoBuffer{}, file.BLOCKSIZE, 8*file.BLOCKSIZE, 0)
+	if err := f.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestPutGetRemoveLinearHashSegments(t *testing.T) {
+	const RECORDS = 500
+	g := segmentfile(t, VSEGPATH)
+	defer func() {
+		if e := g.Close(); e != nil {
+			panic(e)
+		}
+		if e := g.Remove(); e != nil {
+			panic(e)
+		}
+	}()
+	store, err := bucket.NewVarcharStore(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := segmentfile(t, SEGPATH)
+	defer func() {
+		if e := f.Close(); e != nil {
+			panic(e)
+		}
+		if e := f.Remove(); e != nil {
+			panic(e)
+		}
+	}()
+	linhash, err := NewLinearHash(f, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make(map[string]bs.ByteSlice)
+	for len(keys) < RECORDS {
+		keys[string(randslice(8))] = randslice(100)
+	}
+	for key, value := range keys {
+		if err := linhash.Put(bs.ByteSlice(key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segments, err := f.Segments(); err != nil {
+		t.Fatal(err)
+	} else if len(segments) < 2 {
+		t.Fatalf("Expected the hash to span several segments got %v", segments)
+	}
+	for key, value := range keys {
+		if got, err := linhash.Get(bs.ByteSlice(key)); err != nil {
+			t.Fatal(err)
+		} else if !got.Eq(value) {
+			t.Fatal("Error getting record, value was not as expected")
+		}
+	}
+	for key := range keys {
+		if err := linhash.Remove(bs.ByteSlice(key)); err != nil {
+			t.Fatal(err)
+		}
+		if has, err := linhash.Has(bs.ByteSlice(key)); err != nil {
+			t.Fatal(err)
+		} else if has {
+			t.Fatal("expected key to be gone")
+		}
+	}
+	if linhash.Length() != 0 {
+		t.Fatalf("Expected record count == %d got %d", 0, linhash.ctrl.records)
+	}
+}
@@ -1,34 +1,55 @@
 package treeinfo
 
-import . "file-structures/block/file"
+import "fmt"
+import file "file-structures/block/file2"
 import . "file-structures/block/byteslice"
 
-const BLOCKSIZE = 4096
+// VERSION is the format of the trees made by New. Version 0 trees have leaves
+// which only link forward.
+const VERSION = 1
 
-// const BLOCKSIZE = 1048576
+// INFOSIZE is the number of bytes of the device's control data a TreeInfo
+// takes.
+const INFOSIZE = 28
 
+/*
+TreeInfo is the root of a tree, kept in the control data of the device holding
+the tree. The setters only change the TreeInfo, Serialize writes it out.
+*/
 type TreeInfo struct {
-	file    *BlockFile
-	height  int
-	entries uint64
-	root    ByteSlice
+	file      file.BlockDevice
+	height    int
+	entries   uint64
+	root      ByteSlice
+	version   uint32
+	blocksize uint32 // the size of the blocks of the tree, at most that of the device
 }
 
-func New(file *BlockFile, h int, r ByteSlice) *TreeInfo {
-	self := new(TreeInfo)
-	self.file = file
-	self.height = h
-	self.root = r
-	self.entries = 0
-	self.Serialize()
-	return self
+func New(file file.BlockDevice, blocksize uint32, h int, r ByteSlice) (*TreeInfo, error) {
+	return NewVersion(file, blocksize, h, r, VERSION)
 }
 
-func Load(file *BlockFile) *TreeInfo {
-	self := new(TreeInfo)
-	self.file = file
-	self.deserialize()
-	return self
+// NewVersion makes the TreeInfo of a tree in an older format.
+func NewVersion(file file.BlockDevice, blocksize uint32, h int, r ByteSlice, version uint32) (*TreeInfo, error) {
+	self := &TreeInfo{
+		file:      file,
+		height:    h,
+		root:      r,
+		version:   version,
+		blocksize: blocksize,
+	}
+	if err := self.Serialize(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func Load(file file.BlockDevice) (*TreeInfo, error) {
+	self := &TreeInfo{file: file}
+	if err := self.deserialize(); err != nil {
+		return nil, err
+	}
+	return self, nil
 }
 
 func (self *TreeInfo) Height() int {
@@ -47,39 +68,91 @@ func (self *TreeInfo) IncEntries() {
 	self.entries += 1
 }
 
+func (self *TreeInfo) SetEntries(n uint64) {
+	self.entries = n
+}
+
 func (self *TreeInfo) DecEntries() {
 	if self.entries > 0 {
 		self.entries -= 1
 	}
 }
 
+func (self *TreeInfo) Version() uint32 {
+	return self.version
+}
+
+func (self *TreeInfo) BlockSize() uint32 {
+	return self.blocksize
+}
+
 func (self *TreeInfo) SetHeight(h int) {
 	self.height = h
-	self.Serialize()
 }
 
 func (self *TreeInfo) SetRoot(r ByteSlice) {
 	self.root = r
-	self.Serialize()
-}
-
-func (self *TreeInfo) Serialize() {
-	bytes := make([]byte, BLOCKSIZE)
-	i := 0
-	copy(bytes[i:i+4], ByteSlice32(uint32(self.height)))
-	i += 4
-	copy(bytes[i:i+len(self.root)], self.root)
-	i += len(self.root)
-	copy(bytes[i:i+8], ByteSlice64(self.entries))
-	i += 8
-	self.file.WriteBlock(0, bytes)
-}
-
-func (self *TreeInfo) deserialize() {
-	bytes, ok := self.file.ReadBlock(0, BLOCKSIZE)
-	if ok {
-		self.height = int(ByteSlice(bytes[0:4]).Int32())
-		self.root = ByteSlice(bytes[4:12])
-		self.entries = ByteSlice(bytes[12:20]).Int64()
+}
+
+func (self *TreeInfo) Serialize() error {
+	return self.file.SetControlData(self.bytes())
+}
+
+func (self *TreeInfo) bytes() ByteSlice {
+	bytes := make(ByteSlice, INFOSIZE)
+	copy(bytes[0:4], ByteSlice32(uint32(self.height)))
+	copy(bytes[4:12], self.root)
+	copy(bytes[12:20], ByteSlice64(self.entries))
+	copy(bytes[20:24], ByteSlice32(self.version))
+	copy(bytes[24:28], ByteSlice32(self.blocksize))
+	return bytes
+}
+
+// BLOCKFILE_BLOCKSIZE is the size of the blocks of the trees the old
+// block/file code wrote.
+const BLOCKFILE_BLOCKSIZE = 4096
+
+/*
+FromBlockFile turns the first block of a tree written by the old block/file
+code, which held the height, root and entries and nothing else, into the
+control data of a version 0 tree. Pass it to file2.AdoptBlockFile to convert
+the file.
+*/
+func FromBlockFile(first ByteSlice) (ByteSlice, error) {
+	if len(first) < 20 {
+		return nil, fmt.Errorf("The first block is %d bytes, a tree needs 20", len(first))
+	}
+	self := &TreeInfo{
+		height:    int(first[0:4].Int32()),
+		root:      first[4:12].Copy(),
+		entries:   first[12:20].Int64(),
+		version:   0,
+		blocksize: BLOCKFILE_BLOCKSIZE,
+	}
+	if self.height == 0 || self.root.Zero() || self.root.Int64()%BLOCKFILE_BLOCKSIZE != 0 {
+		return nil, fmt.Errorf("The first block does not hold a tree")
+	}
+	return self.bytes(), nil
+}
+
+func (self *TreeInfo) deserialize() error {
+	bytes, err := self.file.ControlData()
+	if err != nil {
+		return err
+	}
+	if len(bytes) < INFOSIZE {
+		return fmt.Errorf("The control data is %d bytes, a tree needs %d", len(bytes), INFOSIZE)
+	}
+	self.height = int(bytes[0:4].Int32())
+	self.root = bytes[4:12].Copy()
+	self.entries = bytes[12:20].Int64()
+	self.version = bytes[20:24].Int32()
+	self.blocksize = bytes[24:28].Int32()
+	if self.height == 0 || self.root.Zero() {
+		return fmt.Errorf("The device does not hold a tree")
+	}
+	if self.version > VERSION {
+		return fmt.Errorf("The tree is in version %d, this version only reads up to %d", self.version, VERSION)
 	}
+	return nil
 }
@@ -0,0 +1,189 @@
+package varchar
+
+import "testing"
+
+import (
+	"os"
+)
+
+import (
+	bs "file-structures/block/byteslice"
+	file "file-structures/block/file2"
+)
+
+const CRASHWAL = "/tmp/__y_crash_wal"
+
+func crashopen(t *testing.T, image []byte) (*file.FaultFile, *file.WALFile, *Varchar) {
+	ff, err := file.LoadFaultFile(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := file.NewWALFile(ff, CRASHWAL)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := OpenVarchar(wf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ff, wf, v
+}
+
+func crashread(t *testing.T, v *Varchar, key int64, expected bs.ByteSlice) {
+	if got, err := v.Read(key); err != nil {
+		t.Fatal(err)
+	} else if !got.Eq(expected) {
+		t.Fatalf("Varchar %d was not as expected", key)
+	}
+}
+
+// The image left behind by a crash at any write of the operation must hold
+// either every change it made or none of them, and the free list must still
+// hand out space which does not overlap a live varchar.
+func TestVarcharCrash(t *testing.T) {
+	defer os.Remove(CRASHWAL)
+	os.Remove(CRASHWAL)
+	ff := file.NewFaultFile()
+	if err := ff.Open(); err != nil {
+		t.Fatal(err)
+	}
+	wf := file.NewWALFile(ff, CRASHWAL)
+	if err := wf.Open(); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVarchar(wf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := make(map[int64]bs.ByteSlice)
+	var keys []int64
+	for i := 0; i < 30; i++ {
+		value := randslice(50 + 400*i)
+		key, err := v.Write(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = value
+		keys = append(keys, key)
+	}
+	for _, key := range keys[10:15] {
+		if err := v.Remove(key); err != nil {
+			t.Fatal(err)
+		}
+		delete(before, key)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base := ff.Bytes()
+
+	updates := keys[:3]
+	removes := keys[3:6]
+	writes := []int{100, 3000, 9000}
+	updated := make(map[int64]bs.ByteSlice)
+	for _, key := range updates {
+		updated[key] = randslice(len(before[key]))
+	}
+	var written []bs.ByteSlice
+	for _, length := range writes {
+		written = append(written, randslice(length))
+	}
+	op := func(wf *file.WALFile, v *Varchar) (keys []int64, err error) {
+		if err := wf.Begin(); err != nil {
+			return nil, err
+		}
+		for _, key := range updates {
+			if err := v.Update(key, updated[key]); err != nil {
+				return nil, err
+			}
+		}
+		for _, key := range removes {
+			if err := v.Remove(key); err != nil {
+				return nil, err
+			}
+		}
+		for _, value := range written {
+			key, err := v.Write(value)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		}
+		return keys, wf.Commit()
+	}
+
+	_, wf, v = crashopen(t, base)
+	written_keys, err := op(wf, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tear := range []bool{false, true} {
+		for _, power := range []bool{false, true} {
+			for n := 1; ; n++ {
+				ff, wf, v := crashopen(t, base)
+				if tear {
+					ff.TearWrite(n)
+				} else {
+					ff.FailWrite(n)
+				}
+				_, err := op(wf, v)
+				if err == nil && !ff.Crashed() {
+					if err := v.Close(); err != nil {
+						t.Fatal(err)
+					}
+					break
+				} else if !ff.Crashed() {
+					t.Fatal(err)
+				}
+				wf.Close()
+
+				image := ff.Bytes()
+				if power {
+					image = ff.SyncedBytes()
+				}
+				_, _, v = crashopen(t, image)
+				live := make(map[int64]bs.ByteSlice)
+				for key, value := range before {
+					live[key] = value
+				}
+				if got, err := v.Read(updates[0]); err != nil {
+					t.Fatal(err)
+				} else if got.Eq(updated[updates[0]]) {
+					for key, value := range updated {
+						live[key] = value
+					}
+					for _, key := range removes {
+						delete(live, key)
+					}
+					for i, key := range written_keys {
+						live[key] = written[i]
+					}
+				}
+				for key, value := range live {
+					crashread(t, v, key, value)
+				}
+				for i := 0; i < 10; i++ {
+					value := randslice(50 + 700*i)
+					key, err := v.Write(value)
+					if err != nil {
+						t.Fatal(err)
+					}
+					live[key] = value
+				}
+				for key, value := range live {
+					crashread(t, v, key, value)
+				}
+				if err := v.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+}
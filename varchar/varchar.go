@@ -12,6 +12,12 @@ import (
 const LENSIZE = 8
 const PTRSIZE = 8
 
+// The top byte of a varchar's length word holds its slack, the bytes it took
+// from the free list past its length. They go back on the list with it. It is
+// new in file2 format version 2, older files never set it.
+const SLACKSHIFT = 56
+const LENMASK = 1<<SLACKSHIFT - 1
+
 const METADATASIZE = 8
 
 type metadata struct {
@@ -156,6 +162,9 @@ type ctrlblk struct {
 
 const CONTROLSIZE = 20
 
+// STRUCTURE_TYPE tags the files holding a Varchar.
+var STRUCTURE_TYPE = file.Tag("VCHR")
+
 func (self *ctrlblk) Bytes() []byte {
 	bytes := make([]byte, CONTROLSIZE)
 	copy(bytes[0:8], bs.ByteSlice64(uint64(self.end)))
@@ -192,10 +201,16 @@ func NewVarchar(file file.BlockDevice) (self *Varchar, err error) {
 			},
 		}
 	}
+	if err := file.SetStructureType(STRUCTURE_TYPE); err != nil {
+		return nil, err
+	}
 	return self, self.write_ctrlblk()
 }
 
 func OpenVarchar(file file.BlockDevice) (self *Varchar, err error) {
+	if err := check_type(file); err != nil {
+		return nil, err
+	}
 	self = &Varchar{
 		file: file,
 	}
@@ -205,6 +220,11 @@ func OpenVarchar(file file.BlockDevice) (self *Varchar, err error) {
 	return self, nil
 }
 
+// check_type refuses devices some other structure has claimed.
+func check_type(f file.BlockDevice) error {
+	return file.CheckStructureType(f, STRUCTURE_TYPE)
+}
+
 func (self *Varchar) Close() error {
 	return self.file.Close()
 }
@@ -259,7 +279,7 @@ func (self *Varchar) alloc_new(length uint64) (key int64, blocks []*block, err e
 	}
 	key = self.ctrl.end
 
-	if err := self.set_length(key, start_blk, length); err != nil {
+	if err := self.set_length(key, start_blk, length, 0); err != nil {
 		return 0, nil, err
 	}
 
@@ -407,25 +427,39 @@ func (self *Varchar) alloc_free(length uint64) (key int64, blocks []*block, err
 		return self.alloc_new(length)
 	}
 
+	// taken is the space the varchar uses up, its length stays as asked for so
+	// a Read returns exactly what was written. Space taken past the length is
+	// kept as the varchar's slack.
+	taken := length
+	if free.length-taken >= FREE_VARCHAR_SIZE {
+		// The header of the free block split off has to fit in front of the
+		// block metadata, if it does not take the rest of the block as well.
+		block_size := datasize(self.file)
+		split := find_split(free, taken)
+		if gap := block_size - self.block_offset(split.key); gap < FREE_VARCHAR_SIZE {
+			taken += uint64(gap)
+		}
+	}
+
 	var nextkey int64
-	if free.length == length {
+	if free.length == taken {
 		// If the selected block is the same size as the freeblk remove it from
 		// the list.
 		self.ctrl.free_len -= 1
 		nextkey = free.next
 		dirty = append(dirty, pfv)
-	} else if free.length-length < FREE_VARCHAR_SIZE {
+	} else if free.length-taken < FREE_VARCHAR_SIZE {
 		// Removing the amt from the block would result in a undersized free block
 		// so remove it from the list and allocate the extra space to the
 		// allocated block.
-		length = free.length
 		self.ctrl.free_len -= 1
 		nextkey = free.next
 		dirty = append(dirty, pfv)
+		taken = free.length
 	} else {
 		// Split the block
 		start_length := free.length
-		newfree := find_split(free, length) // find free + length
+		newfree := find_split(free, taken) // find free + taken
 		if start_length < newfree.length {
 			panic(fmt.Errorf("split failed"))
 		}
@@ -452,7 +486,7 @@ func (self *Varchar) alloc_free(length uint64) (key int64, blocks []*block, err
 	if blk, err := readBlock(self.file, self.block_key(key)); err != nil {
 		return 0, nil, err
 	} else {
-		if err := self.set_length(key, blk, length); err != nil {
+		if err := self.set_length(key, blk, length, taken-length); err != nil {
 			return 0, nil, err
 		}
 		if err := blk.WriteBlock(self.file); err != nil {
@@ -715,7 +749,7 @@ func (self *Varchar) free(key int64) (err error) {
 	if err != nil {
 		return err
 	}
-	length := self.length(key, start_blk)
+	length := self.length(key, start_blk) + self.slack(key, start_blk)
 	fv := &free_varchar{key: key, length: length}
 	// insert the freed varchar into the list
 	// keep the list key order
@@ -724,17 +758,25 @@ func (self *Varchar) free(key int64) (err error) {
 
 func (self *Varchar) length(key int64, blk *block) (length uint64) {
 	offset := self.block_offset(key)
-	return blk.data[offset : offset+LENSIZE].Int64()
+	return blk.data[offset:offset+LENSIZE].Int64() & LENMASK
 }
 
-func (self *Varchar) set_length(key int64, blk *block, length uint64) (err error) {
+func (self *Varchar) slack(key int64, blk *block) (slack uint64) {
+	offset := self.block_offset(key)
+	return blk.data[offset:offset+LENSIZE].Int64() >> SLACKSHIFT
+}
+
+func (self *Varchar) set_length(key int64, blk *block, length, slack uint64) (err error) {
 	block_size := datasize(self.file)
 	offset := self.block_offset(key)
 	if offset > block_size {
 		return fmt.Errorf("Would write length off the end of the block")
 	}
+	if length > LENMASK || slack > 0xff {
+		return fmt.Errorf("Length %d with slack %d does not fit the length word", length, slack)
+	}
 
-	copy(blk.data[offset:offset+LENSIZE], bs.ByteSlice64(length))
+	copy(blk.data[offset:offset+LENSIZE], bs.ByteSlice64(length|slack<<SLACKSHIFT))
 	return nil
 }
 
@@ -398,3 +398,46 @@ func TestReadWriteUpdateRemove(t *testing.T) {
 		t.Fatalf("Expected free_len == 1 got %d", varchar.ctrl.free_len)
 	}
 }
+
+// Reusing free space must neither put a free header over the block metadata
+// nor hand back a varchar padded out to the size of the free block it took.
+func TestReuseFreeSpace(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		mf := file.NewMemBlockFile()
+		if err := mf.Open(); err != nil {
+			t.Fatal(err)
+		}
+		varchar, err := NewVarchar(mf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := make(map[int64]bs.ByteSlice)
+		var keys []int64
+		for i := 0; i < 60; i++ {
+			if len(keys) > 0 && r.Intn(2) == 0 {
+				j := r.Intn(len(keys))
+				if err := varchar.Remove(keys[j]); err != nil {
+					t.Fatal(err)
+				}
+				delete(records, keys[j])
+				keys = append(keys[:j], keys[j+1:]...)
+			}
+			record := make(bs.ByteSlice, r.Intn(300+r.Intn(2)*5000)+10)
+			r.Read(record)
+			key, err := varchar.Write(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+			records[key] = record
+		}
+		for key, record := range records {
+			if got, err := varchar.Read(key); err != nil {
+				t.Fatal(err)
+			} else if !got.Eq(record) {
+				t.Fatalf("Expected record %d of %d bytes got %d bytes", key, len(record), len(got))
+			}
+		}
+	}
+}